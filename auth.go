@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requireAuth wraps h so that it requires the bearer token read from
+// -web.auth-token-file. The file is read on every request so the token can
+// be rotated. If required is false and no token file is configured, h is
+// served without authentication; if required is true it is refused.
+func requireAuth(h http.HandlerFunc, required bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *webAuthTokenFile == "" {
+			if required {
+				http.Error(w, "forbidden: -web.auth-token-file is not configured", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+			return
+		}
+		token, err := os.ReadFile(*webAuthTokenFile)
+		if err != nil {
+			log.Println("error: reading web auth token:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		want := strings.TrimSpace(string(token))
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
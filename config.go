@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of the -config file, in YAML or JSON:
+//
+//	volumeDirs: [/etc/config]
+//	webhooks:
+//	- url: http://localhost:9090/-/reload
+//	  method: PUT
+//	  status: 204
+//	  headers: {Authorization: "Bearer @/run/secrets/token"}
+//	retries: 5
+//	firstFailureGrace: 2s
+//	ziti:
+//	  enabled: true
+//	  service: prometheus-reload
+//	flags:
+//	  webhook-dedupe: true
+//
+// Each setting stands for a flag, and flags takes any other flag by name.
+// A flag given on the command line takes precedence over its setting in the
+// file, which takes precedence over the flag's default; a list given on the
+// command line, e.g. -volume-dir, replaces the file's list rather than
+// adding to it.
+type Config struct {
+	VolumeDirs        []string              `yaml:"volumeDirs"`
+	Webhooks          []WebhookConfig       `yaml:"webhooks"`
+	Retries           *string               `yaml:"retries"`
+	FirstFailureGrace *string               `yaml:"firstFailureGrace"`
+	Timeout           *string               `yaml:"timeout"`
+	Ziti              ZitiConfig            `yaml:"ziti"`
+	Flags             map[string]flagValues `yaml:"flags"`
+}
+
+// flagValues holds the values of a flag in the flags of the -config file,
+// given as a single value or, for flags that may be used multiple times, a
+// list.
+type flagValues []string
+
+func (v *flagValues) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode((*[]string)(v))
+	}
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	*v = flagValues{s}
+	return nil
+}
+
+// WebhookConfig is a webhook of the -config file, a -webhook-url with its
+// options.
+type WebhookConfig struct {
+	URL         string            `yaml:"url"`
+	Method      string            `yaml:"method"`
+	Status      int               `yaml:"status"`
+	CA          string            `yaml:"ca"`
+	Canary      bool              `yaml:"canary"`
+	Identity    string            `yaml:"identity"`
+	AppData     string            `yaml:"appData"`
+	DialTimeout string            `yaml:"dialTimeout"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+// ZitiConfig holds the ziti flags in the -config file.
+type ZitiConfig struct {
+	Enabled        *string `yaml:"enabled"`
+	IdentityFile   *string `yaml:"identityFile"`
+	Service        *string `yaml:"service"`
+	TargetIdentity *string `yaml:"targetIdentity"`
+	DialTimeout    *string `yaml:"dialTimeout"`
+}
+
+// loadConfig reads the config file and sets the flags of fs it specifies
+// that were not given on the command line. Unknown keys are an error, so that a
+// misspelt setting is not silently ignored.
+func loadConfig(fs *flag.FlagSet, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("reading config: %v", err)
+	}
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config %s: %v", file, err)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	apply := func(name string, values ...string) error {
+		if set[name] {
+			return nil
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("config %s: unknown flag %q", file, name)
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("config %s: invalid %s %q: %v", file, name, v, err)
+			}
+		}
+		return nil
+	}
+	applyPtr := func(name string, v *string) error {
+		if v == nil {
+			return nil
+		}
+		return apply(name, *v)
+	}
+
+	if err := apply("volume-dir", cfg.VolumeDirs...); err != nil {
+		return err
+	}
+	var hooks []string
+	for _, h := range cfg.Webhooks {
+		hooks = append(hooks, h.flagValue())
+	}
+	if err := apply("webhook-url", hooks...); err != nil {
+		return err
+	}
+	for _, err := range []error{
+		applyPtr("webhook-retries", cfg.Retries),
+		applyPtr("webhook-first-failure-grace", cfg.FirstFailureGrace),
+		applyPtr("webhook-timeout", cfg.Timeout),
+		applyPtr("ziti.enabled", cfg.Ziti.Enabled),
+		applyPtr("ziti.identity.file", cfg.Ziti.IdentityFile),
+		applyPtr("ziti.service", cfg.Ziti.Service),
+		applyPtr("ziti.target.identity", cfg.Ziti.TargetIdentity),
+		applyPtr("ziti.dial.timeout", cfg.Ziti.DialTimeout),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(cfg.Flags))
+	for name := range cfg.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" {
+			return fmt.Errorf("config %s: config cannot be set in the config file", file)
+		}
+		if err := apply(name, cfg.Flags[name]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagValue returns the -webhook-url value of h.
+func (h WebhookConfig) flagValue() string {
+	opts := []string{h.URL}
+	if h.Method != "" {
+		opts = append(opts, "method="+h.Method)
+	}
+	if h.Status != 0 {
+		opts = append(opts, "status="+strconv.Itoa(h.Status))
+	}
+	if h.CA != "" {
+		opts = append(opts, "ca="+h.CA)
+	}
+	if h.Canary {
+		opts = append(opts, "canary=true")
+	}
+	if h.Identity != "" {
+		opts = append(opts, "identity="+h.Identity)
+	}
+	if h.AppData != "" {
+		opts = append(opts, "appdata="+h.AppData)
+	}
+	if h.DialTimeout != "" {
+		opts = append(opts, "dialtimeout="+h.DialTimeout)
+	}
+	names := make([]string, 0, len(h.Headers))
+	for name := range h.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		opts = append(opts, "header="+name+": "+h.Headers[name])
+	}
+	return strings.Join(opts, ";")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// commandLine returns a flag set sharing the flags of the command line,
+// parsed from args, and restores the flags a config file may set when the
+// test ends.
+func commandLine(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	setFlag(t, &volumeDirs, nil)
+	setFlag(t, &webhook, nil)
+	setFlag(t, webhookRetries, *webhookRetries)
+	setFlag(t, webhookTimeout, *webhookTimeout)
+	setFlag(t, webhookFirstFailGrace, *webhookFirstFailGrace)
+	setFlag(t, webhookDedupe, *webhookDedupe)
+	setFlag(t, zitiEnabled, *zitiEnabled)
+	setFlag(t, zitiService, *zitiService)
+	setFlag(t, zitiDialTimeout, *zitiDialTimeout)
+	fs := flag.NewFlagSet("configmap-reload", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	// main registers the list flags.
+	fs.Var(&volumeDirs, "volume-dir", "")
+	fs.Var(&webhook, "webhook-url", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestLoadConfig(t *testing.T) {
+	const full = `
+volumeDirs: [/etc/a, /etc/b]
+webhooks:
+- url: http://localhost:9090/-/reload
+  method: PUT
+  status: 204
+  headers: {Authorization: Bearer token}
+- url: http://other/reload
+retries: "5"
+firstFailureGrace: 2s
+timeout: 3s
+ziti:
+  service: prometheus-reload
+  dialTimeout: 7s
+flags:
+  webhook-dedupe: "true"
+`
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		wantErr string
+		check   func(t *testing.T)
+	}{
+		{
+			name: "yaml",
+			file: full,
+			check: func(t *testing.T) {
+				if !slices.Equal(volumeDirs, volumeDirsFlag{"/etc/a", "/etc/b"}) {
+					t.Errorf("volume dirs %q, want /etc/a and /etc/b", volumeDirs)
+				}
+				if len(webhook) != 2 {
+					t.Fatalf("got %d webhooks, want 2", len(webhook))
+				}
+				h := webhook[0]
+				if h.String() != "http://localhost:9090/-/reload" || h.method != "PUT" || h.status != 204 {
+					t.Errorf("got webhook %s with method %q and status %d, want PUT and 204", h, h.method, h.status)
+				}
+				if len(h.headers) != 1 || h.headers[0].name != "Authorization" || h.headers[0].value != "Bearer token" {
+					t.Errorf("got headers %v, want Authorization", h.headers)
+				}
+				if *webhookRetries != 5 || *webhookFirstFailGrace != 2*time.Second || *webhookTimeout != 3*time.Second {
+					t.Errorf("got retries %d, first failure grace %s, timeout %s, want 5, 2s, 3s", *webhookRetries, *webhookFirstFailGrace, *webhookTimeout)
+				}
+				if *zitiService != "prometheus-reload" || *zitiDialTimeout != 7*time.Second {
+					t.Errorf("got ziti service %q and dial timeout %s, want prometheus-reload and 7s", *zitiService, *zitiDialTimeout)
+				}
+				if !*webhookDedupe {
+					t.Error("webhook-dedupe of flags was not set")
+				}
+			},
+		},
+		{
+			name: "json",
+			file: `{"volumeDirs": ["/etc/json"], "retries": "3", "flags": {"webhook-dedupe": "true"}}`,
+			check: func(t *testing.T) {
+				if !slices.Equal(volumeDirs, volumeDirsFlag{"/etc/json"}) || *webhookRetries != 3 || !*webhookDedupe {
+					t.Errorf("got volume dirs %q, retries %d, dedupe %v", volumeDirs, *webhookRetries, *webhookDedupe)
+				}
+			},
+		},
+		{
+			name: "command line takes precedence",
+			file: full,
+			args: []string{"-volume-dir=/cli", "-webhook-retries=7", "-ziti.service=cli-service"},
+			check: func(t *testing.T) {
+				if !slices.Equal(volumeDirs, volumeDirsFlag{"/cli"}) {
+					t.Errorf("volume dirs %q, want the command line's /cli only", volumeDirs)
+				}
+				if *webhookRetries != 7 || *zitiService != "cli-service" {
+					t.Errorf("got retries %d and ziti service %q, want the command line's 7 and cli-service", *webhookRetries, *zitiService)
+				}
+				if *webhookTimeout != 3*time.Second {
+					t.Errorf("timeout %s, want the file's 3s", *webhookTimeout)
+				}
+			},
+		},
+		{
+			name:  "empty",
+			file:  "",
+			check: func(t *testing.T) {},
+		},
+		{name: "unknown key", file: "retry: 5\n", wantErr: "field retry not found"},
+		{name: "unknown ziti key", file: "ziti: {services: a}\n", wantErr: "field services not found"},
+		{name: "unknown flag", file: "flags: {no-such-flag: x}\n", wantErr: `unknown flag "no-such-flag"`},
+		{name: "config in flags", file: "flags: {config: other.yaml}\n", wantErr: "config cannot be set in the config file"},
+		{name: "invalid value", file: "retries: many\n", wantErr: `invalid webhook-retries "many"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := commandLine(t, tt.args...)
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(file, []byte(tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := loadConfig(fs, file)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t)
+		})
+	}
+}
@@ -2,21 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
-	"github.com/openziti/sdk-golang/ziti"
-	"github.com/openziti/sdk-golang/ziti/config"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
+	"net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	fsnotify "github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -25,24 +30,130 @@ const namespace = "configmap_reload"
 var (
 	volumeDirs        volumeDirsFlag
 	webhook           webhookFlag
+	teardownWebhook   webhookFlag
+	watchPrefixes     stringsFlag
+	execCommands      stringsFlag
+	webhookHeaders    headersFlag
+	envHeaders        envHeadersFlag
 	webhookMethod     = flag.String("webhook-method", "POST", "the HTTP method url to use to send the webhook")
 	webhookStatusCode = flag.Int("webhook-status-code", 200, "the HTTP status code indicating successful triggering of reload")
-	webhookRetries    = flag.Int("webhook-retries", 1, "the amount of times to retry the webhook reload request")
+	webhookRetries    = flag.Int("webhook-retries", 1, "the number of attempts of a webhook reload request; 0 makes a single attempt, negative retries until it succeeds")
 	listenAddress     = flag.String("web.listen-address", ":9533", "Address to listen on for web interface and telemetry.")
 	metricPath        = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	enablePprof       = flag.Bool("pprof", false, "expose net/http/pprof profiling handlers under /debug/pprof/ on the web server; they are refused without -web.auth-token-file, as they reveal the command line")
+	configFile        = flag.String("config", "", "a YAML or JSON file with settings for the flags not given on the command line")
+	healthPath        = flag.String("web.health-path", "/healthz", "Path under which to expose the liveness check.")
+	reloadHistorySize = flag.Int("web.reload-history", 0, "the number of recent webhook reloads to show on the web page, along with the watched directories and webhooks; 0 only links to the metrics")
+	webAuthTokenFile  = flag.String("web.auth-token-file", "", "a file holding the bearer token required by the administrative web endpoints")
+	zitiEnabled       = flag.Bool("ziti.enabled", false, "call webhooks over ziti; without it ziti is used only if the ziti identity file exists")
 	zitiIdentityFile  = flag.String("ziti.identity.file", "/run/secrets/ziti.identity.json", "the path to the ziti identity to use")
 	zitiService       = flag.String("ziti.service", "configmap-reload", "the path to the ziti identity to use")
 	zitiTarget        = flag.String("ziti.target.identity", "", "the name of the ziti identity to dial")
+	zitiDialTimeout   = flag.Duration("ziti.dial.timeout", 5*time.Second, "the time limit for connecting to the ziti service")
+	webhookDNSCheck   = flag.String("webhook-dns-check", "off", "whether to resolve webhook hosts at startup; one of off, warn or fail")
+	webhookSeqHeader  = flag.Bool("webhook-seq-header", false, "send a per-webhook, monotonically increasing X-Reload-Seq header with every reload")
+	webhookSeqFile    = flag.String("webhook-seq-file", "", "the file to persist reload sequence numbers in so they survive restarts")
+
+	disableFile             = flag.String("disable-file", "", "a file whose existence disables reloads, e.g. on a mounted volume; changes detected meanwhile are handled as -disable-policy says")
+	disablePolicy           = flag.String("disable-policy", "queue", "what to do with changes detected while -disable-file exists; one of queue, to reload once it is removed, or drop")
+	dryRun                  = flag.Bool("dry-run", false, "watch and detect changes as usual, but log the webhook requests and exec commands of a reload instead of sending or running them")
+	ignoreInitial           = flag.Duration("ignore-initial", 0, "ignore changes detected within this long after the watches are registered")
+	watchCoalesceWindow     = flag.Duration("watch-coalesce-window", 0, "coalesce raw filesystem events for the same path arriving within this window before handling them; 0 disables")
+	watchRecheckInterval    = flag.Duration("watch-recheck-interval", defaultRecheckInterval, "how often to recheck the ..data symlink of watched directories for swaps missed by the watcher; 0 disables")
+	reloadQuorumWindow      = flag.Duration("reload-quorum-window", 0, "hold back changes until every -reload-quorum-dir, or all volume dirs if none is given, changed within this long, then reload all of them; 0 disables")
+	watcherPanicPolicy      = flag.String("watcher-panic-policy", "restart", "what to do when the event loop panics; one of restart, to recover and restart it, or exit")
+	recursive               = flag.Bool("recursive", false, "also watch the directories below each volume dir, including ones created later")
+	changeDetection         = flag.String("change-detection", "content", "what changes of the keys trigger a reload; one of content, permissions, for a changed file mode or owner only, or both")
+	emptyConfig             = flag.String("empty-config", "reload", "what to do when a change leaves a volume dir without keys; one of reload, marking the reload with an X-Reload-Empty header, or skip")
+	reloadOnStart           = flag.Bool("reload-on-start", false, "call the webhooks and exec commands once at startup, before handling changes, to prime downstream services")
+	pushgatewayURL          = flag.String("pushgateway-url", "", "the Pushgateway to push the metrics to after every reload and at shutdown, for reloaders too short-lived to be scraped; each push is limited to -shutdown-timeout")
+	pushgatewayJob          = flag.String("pushgateway-job", "configmap-reload", "the job name to push the metrics to -pushgateway-url under")
+	rewatchConcurrency      = flag.Int("rewatch-concurrency", 1, "the maximum number of directories /rewatch registers with the watcher at once")
+	snapshotMaxFiles        = flag.Int("snapshot-max-files", 0, "the maximum number of files per watched directory whose content is read and hashed to detect changes; further ones are compared by size and modification time. 0 reads all")
+	snapshotMaxBytes        = flag.Int64("snapshot-max-file-bytes", 0, "the size above which a file's content is not read and hashed to detect changes, but compared by size and modification time; 0 reads all")
+	snapshotAsync           = flag.Bool("snapshot-async", false, "read and hash changed directories in the background, so that large ones do not hold up the handling of other events")
+	verifyMetricsURL        = flag.String("verify-metrics-url", "", "the metrics endpoint of the reloaded target to scrape after a reload, verifying it by a change of -verify-metric; empty disables")
+	verifyMetric            = flag.String("verify-metric", "", "the metric of -verify-metrics-url whose value changes with a reload, e.g. a config version, as name or name{label=\"value\",...}")
+	verifyTimeout           = flag.Duration("verify-timeout", 10*time.Second, "how long to wait after a reload for -verify-metric to change")
+	webhookURLFile          = flag.String("webhook-url-file", "", "a file of webhook URLs to call along with the -webhook-url ones, one per line with optional ;key=value options; blank lines and lines starting with # are ignored")
+	webhookURLFileWatch     = flag.Bool("webhook-url-file-watch", false, "re-read -webhook-url-file when it changes and call the webhooks it then lists, without a restart")
+	execConcurrency         = flag.Int("exec-concurrency", 1, "the maximum number of -exec-command commands to run at once; further ones wait for a running one to finish")
+	volumeDirAllowMissing   = flag.Bool("volume-dir-allow-missing", false, "start even if a -volume-dir does not exist yet, e.g. because its volume is mounted later, and watch it once /rewatch finds it; /readyz reports not-ready until then")
+	watchAllEvents          = flag.Bool("watch-all-events", false, "trigger a reload on any create, write, remove or rename of a file in a watched directory, not only on ConfigMap updates")
+	watchPollChecksums      = flag.Bool("watch-poll-checksums", false, "also compare the checksums of the watched files at every -watch-recheck-interval and reload on content changes the watcher did not report")
+	shutdownTimeout         = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight reloads to complete on SIGTERM or SIGINT before exiting")
+	listenFailurePolicy     = flag.String("web.listen-failure-policy", "fail", "what to do when the web server cannot listen; fail exits, continue keeps watching without metrics")
+	reloadDebounce          = flag.Duration("reload-debounce", 200*time.Millisecond, "wait until no further change was detected for this long before reloading, coalescing bursts of changes; 0 reloads on every change right away")
+	startupWarmup           = flag.Duration("startup-warmup", 0, "defer reloads for changes detected within this long after startup until it has passed")
+	reloadWindowFlag        = flag.String("reload-window", "", "a daily local time window, e.g. 22:00-23:00, outside of which reloads are deferred until it opens; empty allows reloads at any time")
+	logTimestampFormat      = flag.String("log-timestamp-format", "default", "the format of log timestamps; one of default, rfc3339 or rfc3339nano")
+	logFormat               = flag.String("log-format", "text", "the format of log lines; one of text or json, which logs each webhook request attempt as a single event")
+	logLevel                = flag.String("log-level", "info", "the minimum level of logged lines; one of debug, info, warn or error")
+	logReloadDir            = flag.Bool("log-reload-dir", false, "prefix the log lines of a reload with the directory or source URL that changed, after its reload ID")
+	logTimezone             = flag.String("log-timezone", "local", "the timezone of log timestamps; one of local or utc")
+	failedReloadRequeue     = flag.Bool("failed-reload-requeue", false, "queue reloads that exhausted their retries and retry them later")
+	failedReloadQueueSize   = flag.Int("failed-reload-requeue-size", 10, "the maximum number of failed reloads to queue")
+	failedReloadInterval    = flag.Duration("failed-reload-requeue-interval", time.Minute, "how often to retry queued failed reloads")
+	failedReloadQueueFile   = flag.String("failed-reload-requeue-file", "", "the file to persist the failed reload queue in so it survives restarts")
+	outcomeFIFO             = flag.String("outcome-fifo", "", "a FIFO to write a line with the outcome of every webhook reload to; created if it does not exist")
+	readyFailureThreshold   = flag.Int("ready-failure-threshold", 0, "report not-ready on /readyz after this many consecutive reload failures of a webhook; 0 disables")
+	reloadPerKey            = flag.Bool("reload-per-key", false, "send a separate reload for each key changed in an update, with the key in a JSON body, instead of a single reload")
+	reloadCancelSuperseded  = flag.Bool("reload-cancel-superseded", false, "cancel an in-flight reload, including its pending retries, when a newer change of the same directory is detected")
+	metricsIncludeRuntime   = flag.Bool("metrics.include-runtime", true, "expose the go_* and process_* metrics of the Go runtime and the process, e.g. memory, goroutines and GC")
+	metricsMaxLabelLength   = flag.Int("metrics.max-label-length", 0, "shorten webhook label values longer than this to a prefix and a stable hash; 0 disables shortening")
+	webhookBodyDiff         = flag.Bool("webhook-body-diff", false, "send a line diff of the changed config as the webhook request body")
+	webhookALPN             = flag.String("webhook-alpn", "", "the comma-separated TLS ALPN protocols to offer to webhooks in order of preference, e.g. http/1.1 or h2,http/1.1; empty uses the default")
+	webhookBody             = flag.String("webhook-body", "", "a payload to send as the webhook request body with any method")
+	webhookBodyFile         = flag.String("webhook-body-file", "", "a file holding the payload to send as the webhook request body, re-read for every reload")
+	webhookContentType      = flag.String("webhook-content-type", "application/json", "the Content-Type of the -webhook-body or -webhook-body-file payload, and of -webhook-body-contents instead of the detected type")
+	webhookBodyContents     = flag.Bool("webhook-body-contents", false, "send the raw content of the changed key as the webhook request body when a reload is for a single key, e.g. of a single-key ConfigMap")
+	webhookBodyKeys         = flag.Bool("webhook-body-keys", false, "send the names of the changed keys as a JSON array as the webhook request body")
+	webhookBodyContentsMax  = flag.Int("webhook-body-contents-max-bytes", 1024*1024, "the maximum size of the content sent with -webhook-body-contents; larger content fails the reload")
+	webhookBodyDiffMax      = flag.Int("webhook-body-diff-max-bytes", 64*1024, "the maximum size of the diff sent with -webhook-body-diff")
+	webhookDedupe           = flag.Bool("webhook-dedupe", false, "call each webhook at most once per content state of all watched directories, e.g. when several change together")
+	webhookConcurrency      = flag.Int("webhook-concurrency", 0, "the maximum number of webhooks to send a reload to at once; 0 sends to all of them at once. Ignored with -webhook-ordered")
+	webhookOrdered          = flag.Bool("webhook-ordered", false, "call the webhooks in the order given and stop at the first one that fails")
+	webhookExpectContinue   = flag.Duration("webhook-expect-continue-timeout", 0, "send requests with a body with Expect: 100-continue and wait this long for the endpoint to accept before sending the body; 0 disables")
+	webhookIdempotencyKey   = flag.Bool("webhook-idempotency-key", false, "send an Idempotency-Key header derived from the hash of the changed content")
+	webhookResolverAddr     = flag.String("webhook-resolver", "", "the DNS server, as host[:port], to resolve webhook hostnames with instead of the system resolver")
+	webhookRequireHeader    = flag.String("webhook-require-response-header", "", "a header the webhook response must carry, e.g. an echoed correlation header, for the reload to count as successful")
+	webhookResponseTimeout  = flag.Duration("webhook-response-timeout", 0, "the time to wait for response headers after the webhook request was sent; 0 waits indefinitely")
+	webhookTCPKeepAlive     = flag.Duration("webhook-tcp-keepalive", 30*time.Second, "the interval of TCP keep-alive probes on webhook connections, which keeps idle connections open through stateful firewalls; negative disables")
+	webhookTLSCert          = flag.String("webhook-tls-cert", "", "a PEM client certificate to present to webhooks, re-read when it changes; requires -webhook-tls-key")
+	webhookTLSKey           = flag.String("webhook-tls-key", "", "the PEM private key of -webhook-tls-cert")
+	webhookTLSCA            = flag.String("webhook-tls-ca", "", "a PEM CA bundle to verify webhook certificates against instead of the system roots")
+	webhookTLSInsecure      = flag.Bool("webhook-tls-insecure-skip-verify", false, "do not verify webhook certificates; only for testing")
+	webhookKeepWarm         = flag.Duration("webhook-keep-warm", 0, "send a HEAD request to the origin of every webhook at startup and then at this interval, so that reloads find an open connection; 0 disables")
+	webhookTimeout          = flag.Duration("webhook-timeout", 0, "the time limit for each webhook request attempt, including reading the response; 0 waits indefinitely")
+	maxConfigAge            = flag.Duration("max-config-age", 0, "flag a watched directory as stale when it has not changed for this long, e.g. a secret that should be rotated; 0 disables")
+	otelEndpoint            = flag.String("otel-endpoint", "", "the OTLP/HTTP endpoint URL, e.g. http://otel-collector:4318, to export reload traces and metrics to; empty disables")
+	webhookFirstFailGrace   = flag.Duration("webhook-first-failure-grace", 0, "retry a failed first attempt after this long instead of the retry interval, and do not count its failure if that retry succeeds; 0 disables")
+	webhookFollowRedirects  = flag.Bool("webhook-follow-redirects", true, "follow redirects returned by the webhook; when disabled the redirect response is checked against -webhook-status-code")
+	webhookMaxRedirects     = flag.Int("webhook-max-redirects", 10, "the maximum number of redirects to follow for a webhook request")
+	sourceURL               = flag.String("source-url", "", "a URL of a remote config source to poll, reloading when its content changes")
+	sourcePollInterval      = flag.Duration("source-poll-interval", time.Minute, "how often to poll -source-url")
+	webhookTLSRenegotiation = flag.String("webhook-tls-renegotiation", "never", "TLS renegotiation support for legacy webhook endpoints; one of never, once or freely")
 
 	lastReloadError = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "last_reload_error",
 		Help:      "Whether the last reload resulted in an error (1 for error, 0 for success)",
 	}, []string{"webhook"})
+	lastReloadSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_reload_success_timestamp_seconds",
+		Help:      "Unix time of the last successful reload",
+	}, []string{"webhook"})
 	requestDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "last_request_duration_seconds",
-		Help:      "Duration of last webhook request",
+		Help:      "Duration of last webhook request; request_duration_seconds is preferred",
+	}, []string{"webhook"})
+	requestDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of every webhook request attempt, successful or not",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
 	}, []string{"webhook"})
 	successReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
@@ -59,64 +170,335 @@ var (
 		Name:      "watcher_errors_total",
 		Help:      "Total filesystem watcher errors",
 	})
+	watcherPanics = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watcher_panics_total",
+		Help:      "Total panics of the event loop",
+	})
 	requestsByStatusCode = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "requests_total",
 		Help:      "Total requests by response status code",
 	}, []string{"webhook", "status_code"})
+	directoryVanished = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "directory_vanished",
+		Help:      "Whether the ..data of a watched directory was removed (1 for removed, 0 otherwise)",
+	}, []string{"directory"})
+	configStale = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_stale",
+		Help:      "Whether a watched directory has not changed within -max-config-age (1 for stale, 0 otherwise)",
+	}, []string{"directory"})
+	configBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_bytes",
+		Help:      "Total size in bytes of the keys of a watched directory as of its last change",
+	}, []string{"directory"})
+	execErrorsByReason = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exec_errors_total",
+		Help:      "Total exec command errors by reason",
+	}, []string{"command", "reason"})
+	watcherCoalescedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watcher_coalesced_events_total",
+		Help:      "Total raw filesystem watcher events merged into an earlier event for the same path",
+	})
+	retryAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retry_attempts_total",
+		Help:      "Total individual webhook request attempts, including retries, by outcome",
+	}, []string{"webhook", "outcome"})
+	interChange = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "inter_change_seconds",
+		Help:      "Time between consecutive detected changes of a watched directory",
+		Buckets:   []float64{1, 10, 60, 300, 900, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600},
+	}, []string{"directory"})
+	requestsByMethod = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_by_method_total",
+		Help:      "Total requests by HTTP method",
+	}, []string{"webhook", "method"})
+	zitiIdentityReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ziti_identity_reloads_total",
+		Help:      "Total number of times the ziti context was rebuilt after the identity file changed",
+	})
+	zitiOpenConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ziti_open_connections",
+		Help:      "Number of currently open connections dialed over ziti",
+	})
+	shutdownReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shutdown_reloads_total",
+		Help:      "Total reloads in flight at shutdown by outcome, drained or abandoned after -shutdown-timeout",
+	}, []string{"outcome"})
+	dryRunTriggers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dry_run_triggers_total",
+		Help:      "Total webhook reload requests logged instead of sent with -dry-run",
+	}, []string{"webhook"})
+	reloadsDisabledGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reloads_disabled",
+		Help:      "Whether reloads are disabled because the -disable-file exists",
+	})
+	watchLost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_lost_total",
+		Help:      "Total times the watch of a volume dir was lost because it was removed or moved",
+	}, []string{"directory"})
+	reloadVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reload_verifications_total",
+		Help:      "Total reloads checked with -verify-metrics-url by outcome, verified or unverified",
+	}, []string{"outcome"})
+	webhookWarmups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_warmups_total",
+		Help:      "Total -webhook-keep-warm requests by outcome",
+	}, []string{"webhook", "outcome"})
+	canaryReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "canary_reloads_total",
+		Help:      "Total reloads of canary webhooks by outcome; a failure skips the other webhooks",
+	}, []string{"webhook", "outcome"})
+	sourcePollErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_poll_errors_total",
+		Help:      "Total errors polling the -source-url",
+	})
 )
 
+// registry holds the metrics exposed on the telemetry path. It is separate
+// from the default registry so that the Go runtime and process collectors
+// the latter comes with can be left out with -metrics.include-runtime=false.
+var registry = prometheus.NewRegistry()
+
+// registerRuntimeMetrics adds the go_* and process_* metrics of the Go
+// runtime and the process to reg.
+func registerRuntimeMetrics(reg *prometheus.Registry) {
+	reg.MustRegister(collectors.NewGoCollector())
+	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
 func init() {
-	prometheus.MustRegister(lastReloadError)
-	prometheus.MustRegister(requestDuration)
-	prometheus.MustRegister(successReloads)
-	prometheus.MustRegister(requestErrorsByReason)
-	prometheus.MustRegister(watcherErrors)
-	prometheus.MustRegister(requestsByStatusCode)
+	registry.MustRegister(lastReloadError)
+	registry.MustRegister(lastReloadSuccess)
+	registry.MustRegister(requestDuration)
+	registry.MustRegister(requestDurations)
+	registry.MustRegister(successReloads)
+	registry.MustRegister(requestErrorsByReason)
+	registry.MustRegister(watcherErrors)
+	registry.MustRegister(watcherPanics)
+	registry.MustRegister(requestsByStatusCode)
+	registry.MustRegister(requestsByMethod)
+	registry.MustRegister(interChange)
+	registry.MustRegister(retryAttempts)
+	registry.MustRegister(directoryVanished)
+	registry.MustRegister(configStale)
+	registry.MustRegister(configBytes)
+	registry.MustRegister(execErrorsByReason)
+	registry.MustRegister(watcherCoalescedEvents)
+	registry.MustRegister(zitiIdentityReloads)
+	registry.MustRegister(zitiOpenConnections)
+	registry.MustRegister(sourcePollErrors)
+	registry.MustRegister(canaryReloads)
+	registry.MustRegister(shutdownReloads)
+	registry.MustRegister(webhookWarmups)
+	registry.MustRegister(dryRunTriggers)
+	registry.MustRegister(reloadVerifications)
+	registry.MustRegister(watchLost)
+	registry.MustRegister(reloadsDisabledGauge)
 }
 
 func main() {
-	flag.Var(&volumeDirs, "volume-dir", "the config map volume directory to watch for updates; may be used multiple times")
-	flag.Var(&webhook, "webhook-url", "the url to send a request to when the specified config map volume directory has been updated")
+	flag.Var(&volumeDirs, "volume-dir", "the config map volume directory, or single mounted file, to watch for updates, optionally followed by ;key=value options; may be used multiple times")
+	flag.Var(&webhook, "webhook-url", "the url to send a request to when the specified config map volume directory has been updated, optionally followed by ;key=value options; may be used multiple times")
+	flag.Var(&teardownWebhook, "teardown-webhook-url", "the url to send a request to when the ..data of a watched config map volume directory is removed; may be used multiple times")
+	flag.Var(&webhookHeaders, "webhook-header", "a header, as \"Name: Value\", to send with every webhook request; a value ending in @path, e.g. \"Bearer @path\", takes the rest from the file at path for every request; may be used multiple times")
+	flag.Var(&envHeaders, "webhook-env-header", "a header, as Name=VAR, to send with every webhook request with the value of the environment variable VAR, e.g. X-Pod-Name=POD_NAME; not sent if VAR is unset; may be used multiple times")
+	flag.Var(&execCommands, "exec-command", "a shell command to run after the webhooks when a config map volume directory has been updated; may be used multiple times")
+	flag.Var(&contentTypes, "content-type", "only trigger a reload for changes of keys whose content is of this type, e.g. application/json, application/yaml or text/*; may be used multiple times")
+	flag.Var(triggers, "yaml-trigger", "only trigger a reload for changes of a key, given as key=path, that change the value at a dot-separated path in its YAML documents; may be used multiple times")
+	flag.Var(&quorumDirs, "reload-quorum-dir", "a volume dir that must change, along with the other ones given, within -reload-quorum-window to trigger a reload; may be used multiple times")
+	flag.Var(&watchPrefixes, "watch-prefix", "trigger a reload when a file whose name starts with this prefix is created in a watched directory; may be used multiple times")
 	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfig(flag.CommandLine, *configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := configureLogger(*logFormat, *logLevel, *logTimestampFormat, *logTimezone); err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsIncludeRuntime {
+		registerRuntimeMetrics(registry)
+	}
+
+	if *listenFailurePolicy != "fail" && *listenFailurePolicy != "continue" {
+		log.Fatalf("invalid web.listen-failure-policy %q: must be one of fail or continue", *listenFailurePolicy)
+	}
+
+	execSlots = make(chan struct{}, max(*execConcurrency, 1))
+	if *reloadHistorySize > 0 {
+		history = newReloadHistory(*reloadHistorySize)
+	}
+
+	if *webhookBody != "" && *webhookBodyFile != "" {
+		log.Fatal("webhook-body and webhook-body-file are mutually exclusive")
+	}
+
+	if *watchPollChecksums && *watchRecheckInterval <= 0 {
+		log.Fatal("watch-poll-checksums requires a positive watch-recheck-interval")
+	}
 
-	if len(volumeDirs) < 1 {
-		log.Println("Missing volume-dir")
+	if len(volumeDirs) < 1 && *sourceURL == "" {
+		log.Println("Missing volume-dir or source-url")
 		log.Println()
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if len(webhook) < 1 {
-		log.Println("Missing webhook-url")
+	inlineWebhooks := webhook
+	if *webhookURLFile != "" {
+		fromFile, err := readWebhookFile(*webhookURLFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhook = append(append(webhookFlag{}, inlineWebhooks...), fromFile...)
+	} else if *webhookURLFileWatch {
+		log.Fatal("webhook-url-file-watch requires webhook-url-file")
+	}
+
+	if len(webhook) < 1 && len(execCommands) < 1 {
+		log.Println("Missing webhook-url or exec-command")
 		log.Println()
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	httpClient := http.DefaultClient
-
-	if _, err := os.Stat("/path/to/whatever"); err == nil {
-		var zitiContext ziti.Context
-		log.Println("creating ziti context using file at: ", *zitiIdentityFile)
-		cfg, err := config.NewFromFile(*zitiIdentityFile)
-		if err == nil {
-			log.Println("ziti identity file found. using ziti transport")
-			zitiContext = ziti.NewContextWithConfig(cfg)
-			zitiTransport := http.DefaultTransport.(*http.Transport).Clone() // copy default transport
-			zitiTransport.DialContext = func(_ context.Context, _ string, addr string) (net.Conn, error) {
-				log.Println("dialing service: ", zitiService)
-				dialOpts := &ziti.DialOptions{
-					ConnectTimeout: 5000 * time.Second,
-					AppData:        nil,
-				}
-				if zitiTarget != nil && *zitiTarget != "" {
-					log.Println("using target identity: ", *zitiTarget)
-					dialOpts.Identity = *zitiTarget
-				}
-				return zitiContext.DialWithOptions(*zitiService, dialOpts)
-			}
-			httpClient = &http.Client{Transport: zitiTransport}
+	if *otelEndpoint != "" {
+		shutdown, err := setupOTel(context.Background(), *otelEndpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer shutdown(context.Background())
+	}
+
+	targets, err := newWatchTargets(volumeDirs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var window *reloadWindow
+	if *reloadWindowFlag != "" {
+		window, err = parseReloadWindow(*reloadWindowFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var verifySelector metricSelector
+	if *verifyMetricsURL != "" {
+		if *verifyMetric == "" {
+			log.Fatal("verify-metrics-url requires verify-metric")
+		}
+		sel, err := parseMetricSelector(*verifyMetric)
+		if err != nil {
+			log.Fatal(err)
+		}
+		verifySelector = sel
+		if *verifyTimeout <= 0 {
+			log.Fatalf("invalid verify-timeout %s: must be positive", *verifyTimeout)
+		}
+	}
+	if *disablePolicy != "queue" && *disablePolicy != "drop" {
+		log.Fatalf("invalid disable-policy %q: must be one of queue or drop", *disablePolicy)
+	}
+	switch *changeDetection {
+	case "content", "permissions", "both":
+	default:
+		log.Fatalf("invalid change-detection %q: must be one of content, permissions or both", *changeDetection)
+	}
+	if *emptyConfig != "reload" && *emptyConfig != "skip" {
+		log.Fatalf("invalid empty-config %q: must be one of reload or skip", *emptyConfig)
+	}
+	if *watcherPanicPolicy != "restart" && *watcherPanicPolicy != "exit" {
+		log.Fatalf("invalid watcher-panic-policy %q: must be one of restart or exit", *watcherPanicPolicy)
+	}
+
+	if len(quorumDirs) > 0 && *reloadQuorumWindow <= 0 {
+		log.Fatal("-reload-quorum-dir requires a positive -reload-quorum-window")
+	}
+	var quorum *reloadQuorum
+	if *reloadQuorumWindow > 0 {
+		quorum, err = newReloadQuorum(targets, quorumDirs, *reloadQuorumWindow)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// allWebhooks holds both the reload and the teardown webhooks.
+	allWebhooks := append(append([]*webhookTarget{}, webhook...), teardownWebhook...)
+	if err := checkWebhookResolution(*webhookDNSCheck, allWebhooks); err != nil {
+		log.Fatal(err)
+	}
+
+	sequence, err := newReloadSequence(*webhookSeqFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	transport, err := newWebhookTransport()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *outcomeFIFO != "" {
+		fifo, err := openOutcomeFIFO(*outcomeFIFO)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fifo.Close()
+		outcomes = newOutcomeWriter(fifo)
+	}
+
+	var failed *reloadQueue
+	if *failedReloadRequeue {
+		if *failedReloadQueueSize < 1 {
+			log.Fatal("failed-reload-requeue-size must be at least 1")
+		}
+		failed, err = newReloadQueue(*failedReloadQueueFile, *failedReloadQueueSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	httpClient, webhookDialer, err := setupZiti(transport, allWebhooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// prepare gives a webhook the client its scheme and options require.
+	prepare := func(h *webhookTarget) error {
+		if h.Scheme != "ziti" {
+			return h.configureClient(httpClient.Transport.(*http.Transport))
+		}
+		if webhookDialer == nil {
+			return fmt.Errorf("invalid webhook URL %s: the ziti transport of ziti:// webhooks is only set up if one is given at startup", h.Redacted())
+		}
+		h.client = webhookDialer.webhookClient(transport, h)
+		return nil
+	}
+	for _, h := range allWebhooks {
+		if err := prepare(h); err != nil {
+			log.Fatal(err)
 		}
 	}
 
@@ -126,93 +508,466 @@ func main() {
 	}
 	defer watcher.Close()
 
-	go func() {
+	r := &reloader{httpClient: httpClient, settings: flagReloadSettings(), webhooks: webhook, sequence: sequence, failed: failed}
+	if failed != nil {
+		go failed.run(*failedReloadInterval, r.currentWebhooks, func(h *webhookTarget, ev reloadEvent) bool {
+			return r.fire(context.Background(), h, ev) == nil
+		})
+	}
+	if *dryRun {
+		log.Println("dry run: logging reloads instead of sending webhook requests or running exec commands")
+	}
+	if *webhookURLFileWatch {
+		err := watchWebhookFile(*webhookURLFile, prepare, func(fromFile []*webhookTarget) {
+			r.setWebhooks(append(append([]*webhookTarget{}, inlineWebhooks...), fromFile...))
+		})
+		if err != nil {
+			log.Println("error: watching webhook-url-file:", err)
+		}
+	}
+	if *verifyMetricsURL != "" && !*dryRun {
+		r.verifier = &reloadVerifier{url: *verifyMetricsURL, selector: verifySelector, timeout: *verifyTimeout, client: &http.Client{Transport: transport}}
+	}
+	if *pushgatewayURL != "" {
+		r.pusher = newMetricsPusher(*pushgatewayURL, *pushgatewayJob, *shutdownTimeout)
+	}
+	if *webhookKeepWarm > 0 && !*dryRun {
+		go r.keepWarm(*webhookKeepWarm)
+	}
+	d := &dispatcher{reloader: r}
+
+	// Mounting and registering the watches can produce events of their
+	// own, which -ignore-initial suppresses for a short window. Changes
+	// during the -startup-warmup window are held back until it is over.
+	started := time.Now()
+	warmupUntil := started.Add(*startupWarmup)
+
+	// On kqueue based systems a swap of the "..data" symlink does not
+	// always produce an event, so the targets are also rechecked
+	// periodically there by default.
+	var recheck <-chan time.Time
+	if *watchRecheckInterval > 0 {
+		recheck = time.Tick(*watchRecheckInterval)
+	}
+
+	// -max-config-age flags directories that went without a change for too
+	// long, counting from startup for those that have not changed yet.
+	var staleCheck <-chan time.Time
+	if *maxConfigAge > 0 {
+		staleCheck = time.Tick(staleCheckInterval(*maxConfigAge))
+		for _, dir := range targets.dirs() {
+			configStale.WithLabelValues(dir).Set(0)
+		}
+	}
+
+	// -source-url is polled in the background and its changes handled
+	// along with those of the watched directories.
+	sourceChanges := make(chan reloadEvent)
+	if *sourceURL != "" {
+		source := newSourcePoller(*sourceURL, &http.Client{Transport: transport, Timeout: *sourcePollInterval})
+		go source.run(*sourcePollInterval, sourceChanges)
+	}
+
+	// -disable-file is checked for removal every second, so that changes
+	// held while it existed are sent.
+	var disableCheck <-chan time.Time
+	if *disableFile != "" {
+		disableCheck = time.Tick(time.Second)
+		reloadsDisabled()
+	}
+
+	// With -snapshot-async the changed directories are read and hashed in
+	// the background, and their results handled by the event loop.
+	var snapshots *asyncSnapshots
+	var snapshotResults <-chan snapshotResult
+	if *snapshotAsync {
+		snapshots = newAsyncSnapshots()
+		snapshotResults = snapshots.results
+	}
+
+	watches := newWatchSet(watcher, targets)
+	eventLoop := func() {
+		var (
+			warmup     <-chan time.Time
+			windowOpen <-chan time.Time
+			deferred   = heldChanges{}
+			disabled   = heldChanges{}
+			flush      <-chan time.Time
+			pending    = &eventCoalescer{}
+			debounced  = newDebouncer(*reloadDebounce)
+		)
+		// send dispatches the reload for a change, logging msg, unless
+		// reloads are disabled by -disable-file, in which case the change
+		// is held until they are enabled again or dropped.
+		send := func(ev reloadEvent, msg string) {
+			if !reloadsDisabled() {
+				ev.logln(msg)
+				d.dispatch(ev)
+				return
+			}
+			if *disablePolicy == "drop" {
+				ev.logf("dropping change of %s: reloads are disabled by %s", ev.dir, *disableFile)
+				return
+			}
+			ev.logf("deferring change of %s until %s is removed", ev.dir, *disableFile)
+			disabled.hold(ev)
+		}
+		// release dispatches the reload for a change unless it is deferred.
+		release := func(ev reloadEvent) {
+			if time.Now().Before(warmupUntil) {
+				ev.logf("deferring change of %s until the startup warmup is over", ev.dir)
+				deferred.hold(ev)
+				if warmup == nil {
+					warmup = time.After(time.Until(warmupUntil))
+				}
+				return
+			}
+			if now := time.Now(); window != nil && !window.contains(now) {
+				ev.logf("deferring change of %s until the reload window opens", ev.dir)
+				deferred.hold(ev)
+				if windowOpen == nil {
+					windowOpen = time.After(time.Until(window.nextOpen(now)))
+				}
+				return
+			}
+			send(ev, "config map updated")
+		}
+		// trigger dispatches the reload for a detected change unless it is
+		// ignored, held back for the reload quorum or deferred.
+		trigger := func(ev reloadEvent) {
+			if inInitialWindow(time.Now(), started, *ignoreInitial) {
+				ev.logf("ignoring change of %s within the initial window", ev.dir)
+				return
+			}
+			if quorum != nil && quorum.requires(ev.dir) {
+				ready := quorum.add(ev, time.Now())
+				if ready == nil {
+					ev.logf("holding change of %s until the rest of the reload quorum changed", ev.dir)
+					return
+				}
+				for _, ev := range ready {
+					release(ev)
+				}
+				return
+			}
+			release(ev)
+		}
+		// settle holds changes back until none arrived for
+		// -reload-debounce.
+		settle := func(ev reloadEvent) {
+			if *reloadDebounce <= 0 {
+				trigger(ev)
+				return
+			}
+			debounced.hold(ev)
+		}
+		// changed settles the reload for a detected change of a directory,
+		// unless it is ignored.
+		changed := func(ev reloadEvent, ok bool) {
+			if !ok && ev.empty {
+				ev.logf("ignoring change of %s: it has no keys left and -empty-config is skip", ev.dir)
+				return
+			}
+			if !ok && ev.unchanged {
+				ev.logf("ignoring change of %s: no key changed as -change-detection %s requires", ev.dir, *changeDetection)
+				return
+			}
+			if !ok {
+				ev.logf("ignoring change of %s: no changed key passes the -content-type and -yaml-trigger filters", ev.dir)
+				return
+			}
+			settle(ev)
+		}
+		handle := func(event fsnotify.Event) {
+			if watches.lose(event) {
+				return
+			}
+			if *recursive {
+				watches.followTree(event)
+			}
+			if targets.isVanishEvent(event) {
+				dir := filepath.Dir(event.Name)
+				log.Printf("%s vanished: its ..data was removed", dir)
+				d.teardown(dir)
+				return
+			}
+			if !targets.isValidEvent(event) {
+				return
+			}
+			if snapshots != nil {
+				dir := filepath.Dir(event.Name)
+				if t, ok := targets[dir]; ok {
+					snapshots.take(t, dir)
+					return
+				}
+			}
+			changed(targets.change(event))
+		}
+		// rewatched checks dir, which is watched again or for the first
+		// time, for changes of its content while it was not watched.
+		rewatched := func(dir string) {
+			// The directory may have been recreated with other content
+			// while it was not watched.
+			if t := targets[dir]; t.dataDir {
+				t.dataTarget = readDataTarget(dir)
+			}
+			if !targets.dirChanged(dir) {
+				return
+			}
+			ev, ok := targets.changeDir(dir)
+			if ok {
+				ev.logf("content of %s changed while it was not watched", dir)
+			}
+			changed(ev, ok)
+		}
 		for {
 			select {
-			case event := <-watcher.Events:
+			case dir := <-watches.rewatched:
+				rewatched(dir)
+			case done := <-watches.reconciles:
+				res := watches.reconcile()
+				done <- res
+				for _, dir := range res.Added {
+					rewatched(dir)
+				}
+			case res := <-snapshotResults:
+				if snapshots.done(res) {
+					changed(targets.applySnapshot(res.dir, res.snapshot, res.err))
+				}
+			case ev := <-sourceChanges:
+				ev.logf("%s changed", ev.dir)
+				settle(ev)
+			case event, ok := <-watcher.Events:
 				//used for debugging to trigger the case...
 				//case <-time.After(5 * time.Second):
-				if !isValidEvent(event) {
+				if !ok {
+					log.Println("error: the watcher stopped delivering events")
+					return
+				}
+				if *watchCoalesceWindow <= 0 {
+					handle(event)
+					continue
+				}
+				if pending.add(event) {
+					watcherCoalescedEvents.Inc()
+				}
+				if flush == nil {
+					flush = time.After(*watchCoalesceWindow)
+				}
+			case <-flush:
+				flush = nil
+				for _, event := range pending.take() {
+					handle(event)
+				}
+			case <-recheck:
+				for _, event := range targets.recheckEvents() {
+					handle(event)
+				}
+				if !*watchPollChecksums {
 					continue
 				}
-				log.Println("config map updated")
-				for _, h := range webhook {
-					begun := time.Now()
-					req, err := http.NewRequest(*webhookMethod, h.String(), nil)
-					if err != nil {
-						setFailureMetrics(h.String(), "client_request_create")
-						log.Println("error:", err)
+				for _, dir := range targets.changedDirs() {
+					ev, ok := targets.changeDir(dir)
+					if !ok {
 						continue
 					}
-					userInfo := h.User
-					if userInfo != nil {
-						if password, passwordSet := userInfo.Password(); passwordSet {
-							req.SetBasicAuth(userInfo.Username(), password)
-						}
-					}
-
-					successfulReloadWebhook := false
-
-					for retries := *webhookRetries; retries != 0; retries-- {
-						log.Printf("performing webhook request (%d/%d/%s)", retries, *webhookRetries, req.URL)
-						resp, err := httpClient.Do(req)
-						if err != nil {
-							setFailureMetrics(h.String(), "client_request_do")
-							log.Println("error:", err)
-							time.Sleep(time.Second * 10)
-							continue
-						}
-						resp.Body.Close()
-						requestsByStatusCode.WithLabelValues(h.String(), strconv.Itoa(resp.StatusCode)).Inc()
-						if resp.StatusCode != *webhookStatusCode {
-							setFailureMetrics(h.String(), "client_response")
-							log.Println("error:", "Received response code", resp.StatusCode, ", expected", *webhookStatusCode)
-							time.Sleep(time.Second * 10)
-							continue
-						}
-
-						setSuccessMetrics(h.String(), begun)
-						log.Println("successfully triggered reload")
-						successfulReloadWebhook = true
-						break
-					}
-
-					if !successfulReloadWebhook {
-						setFailureMetrics(h.String(), "retries_exhausted")
-						log.Println("error:", "Webhook reload retries exhausted")
+					ev.logf("content of %s changed without being reported", dir)
+					settle(ev)
+				}
+			case now := <-staleCheck:
+				targets.checkStale(now, started, *maxConfigAge)
+			case <-warmup:
+				warmup = nil
+				if now := time.Now(); window != nil && !window.contains(now) {
+					log.Println("deferring changes from the startup warmup until the reload window opens")
+					if windowOpen == nil {
+						windowOpen = time.After(time.Until(window.nextOpen(now)))
 					}
+					continue
+				}
+				for _, ev := range deferred.take() {
+					send(ev, "config map updated during startup warmup")
+				}
+			case <-debounced.settled:
+				for _, ev := range debounced.take() {
+					trigger(ev)
+				}
+			case <-windowOpen:
+				windowOpen = nil
+				for _, ev := range deferred.take() {
+					send(ev, "config map updated outside the reload window")
+				}
+			case <-disableCheck:
+				if reloadsDisabled() {
+					continue
+				}
+				for _, ev := range disabled.take() {
+					ev.logln("config map updated while reloads were disabled")
+					d.dispatch(ev)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					log.Println("error: the watcher stopped delivering events")
+					return
 				}
-			case err := <-watcher.Errors:
 				watcherErrors.Inc()
 				log.Println("error:", err)
 			}
 		}
-	}()
+	}
 
-	for _, d := range volumeDirs {
-		log.Printf("Watching directory: %q", d)
-		err = watcher.Add(d)
-		if err != nil {
+	for _, dir := range targets.dirs() {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		if err := watches.add(dir); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	log.Fatal(serverMetrics(*listenAddress, *metricPath))
+	var start func()
+	if *reloadOnStart {
+		start = func() { reloadOnStartup(d, targets) }
+	}
+	go superviseEventLoop(start, eventLoop)
+
+	// On SIGTERM or SIGINT reloads in flight are given -shutdown-timeout to
+	// complete before exiting.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- serverMetrics(*listenAddress, *metricPath, watches, r, httpClient)
+	}()
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case err := <-serverErr:
+			if err != nil {
+				log.Fatal(err)
+			}
+			// The server was skipped by -web.listen-failure-policy
+			// continue; keep watching until stopped.
+			serverErr = nil
+		case sig = <-stop:
+		}
+	}
+	log.Printf("received %s, draining in-flight reloads", sig)
+	d.shutdown(*shutdownTimeout)
+	if r.pusher != nil {
+		r.pusher.push()
+	}
+}
+
+// reloadOnStartup calls the webhooks once with the content present at
+// startup, before changes are handled, so that downstream services that
+// started first are primed by -reload-on-start.
+func reloadOnStartup(d *dispatcher, targets watchTargets) {
+	ev := reloadEvent{id: newReloadID(), state: targets.state()}
+	if reloadsDisabled() {
+		ev.logf("not reloading on start: reloads are disabled by %s", *disableFile)
+		return
+	}
+	ev.logln("reloading on start")
+	d.dispatch(ev)
+}
+
+// inInitialWindow reports whether a change detected at now is within the
+// -ignore-initial window after the watches were registered at started.
+func inInitialWindow(now, started time.Time, window time.Duration) bool {
+	return now.Before(started.Add(window))
+}
+
+// superviseEventLoop runs start, if not nil, and then the event loop,
+// recovering from a panic in either according to -watcher-panic-policy: by
+// restarting the event loop, which loses changes it held back, or by
+// exiting. The process is alive from the start, so that a startup reload
+// that takes long to retry does not fail the liveness check.
+func superviseEventLoop(start, loop func()) {
+	atomic.StoreInt32(&eventLoopAlive, 1)
+	defer atomic.StoreInt32(&eventLoopAlive, 0)
+	for {
+		panicked := func() (panicked bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					panicked = true
+					watcherPanics.Inc()
+					log.Printf("error: event loop panicked: %v\n%s", r, debug.Stack())
+				}
+			}()
+			if start != nil {
+				run := start
+				start = nil
+				run()
+			}
+			loop()
+			return false
+		}()
+		if !panicked {
+			return
+		}
+		if *watcherPanicPolicy == "exit" {
+			log.Fatal("exiting after the event loop panicked")
+		}
+		log.Println("restarting the event loop")
+	}
+}
+
+// webhookLabel returns the webhook label value for h. When
+// -metrics.max-label-length is set, longer URLs are cut to a prefix followed
+// by a short hash of the full URL, which keeps the value stable per webhook
+// while bounding its length.
+func webhookLabel(h *webhookTarget) string {
+	s := h.String()
+	max := *metricsMaxLabelLength
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	sum := sha256.Sum256([]byte(s))
+	suffix := "~" + hex.EncodeToString(sum[:])[:12]
+	if max <= len(suffix) {
+		return suffix[1:]
+	}
+	return s[:max-len(suffix)] + suffix
 }
 
-func setFailureMetrics(h, reason string) {
-	requestErrorsByReason.WithLabelValues(h, reason).Inc()
+func setFailureMetrics(h, reason, id string) {
+	incWithExemplar(requestErrorsByReason.WithLabelValues(h, reason), id)
 	lastReloadError.WithLabelValues(h).Set(1.0)
 }
 
-func setSuccessMetrics(h string, begun time.Time) {
+func setSuccessMetrics(h string, begun time.Time, id string) {
 	requestDuration.WithLabelValues(h).Set(time.Since(begun).Seconds())
-	successReloads.WithLabelValues(h).Inc()
+	incWithExemplar(successReloads.WithLabelValues(h), id)
 	lastReloadError.WithLabelValues(h).Set(0.0)
+	lastReloadSuccess.WithLabelValues(h).SetToCurrentTime()
+}
+
+// incWithExemplar increments c, attaching the reload ID id as an exemplar
+// if it is set, so that a sample can be traced to the logs of its reload.
+func incWithExemplar(c prometheus.Counter, id string) {
+	if a, ok := c.(prometheus.ExemplarAdder); ok && id != "" {
+		a.AddWithExemplar(1, prometheus.Labels{"reload_id": id})
+		return
+	}
+	c.Inc()
+}
+
+// methodLabel returns the method label value for a request, folding
+// non-standard methods into "OTHER" to bound the metric's cardinality.
+func methodLabel(method string) string {
+	switch method = strings.ToUpper(method); method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
 }
 
 func isValidEvent(event fsnotify.Event) bool {
-	if event.Op&fsnotify.Create != fsnotify.Create {
+	// Depending on the filesystem the "..data" swap surfaces as a Create
+	// or as a Rename of the symlink.
+	if event.Op&(fsnotify.Create|fsnotify.Rename) == 0 {
 		return false
 	}
 	if filepath.Base(event.Name) != "..data" {
@@ -221,25 +976,77 @@ func isValidEvent(event fsnotify.Event) bool {
 	return true
 }
 
-func serverMetrics(listenAddress, metricsPath string) error {
-	http.Handle(metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`
-			<html>
-			<head><title>ConfigMap Reload Metrics</title></head>
-			<body>
-			<h1>ConfigMap Reload</h1>
-			<p><a href='` + metricsPath + `'>Metrics</a></p>
-			</body>
-			</html>
-		`))
-	})
-	return http.ListenAndServe(listenAddress, nil)
+// checkWebhookResolution resolves the host of every webhook so that a
+// misconfigured URL is noticed at startup rather than at the first reload.
+// In "warn" mode failures are only logged, in "fail" mode the first failure
+// is returned.
+func checkWebhookResolution(mode string, webhooks []*webhookTarget) error {
+	switch mode {
+	case "off":
+		return nil
+	case "warn", "fail":
+	default:
+		return fmt.Errorf("invalid webhook-dns-check mode %q: must be one of off, warn or fail", mode)
+	}
+	resolver := newWebhookResolver()
+	for _, h := range webhooks {
+		host := h.Hostname()
+		// The host of a ziti:// webhook names a ziti service, not a DNS
+		// name.
+		if h.Scheme == "ziti" || host == "" || net.ParseIP(host) != nil {
+			continue
+		}
+		if _, err := resolver.LookupHost(context.Background(), host); err != nil {
+			if mode == "fail" {
+				return fmt.Errorf("unable to resolve webhook host %q: %v", host, err)
+			}
+			log.Printf("warning: unable to resolve webhook host %q: %v", host, err)
+		}
+	}
+	return nil
+}
+
+// serverMetrics runs the web server. It returns nil without serving if it
+// cannot listen and -web.listen-failure-policy is continue.
+func serverMetrics(listenAddress, metricsPath string, watches *watchSet, r *reloader, httpClient *http.Client) error {
+	mux := newServeMux(metricsPath, watches, r, httpClient)
+	ln, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		if *listenFailurePolicy != "continue" {
+			return err
+		}
+		log.Printf("error: %v; continuing to watch without the web server", err)
+		return nil
+	}
+	return http.Serve(ln, mux)
+}
+
+// newServeMux returns the handlers of the web server.
+func newServeMux(metricsPath string, watches *watchSet, r *reloader, httpClient *http.Client) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.InstrumentMetricHandler(registry, promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	mux.HandleFunc("/readyz", readyHandler(watches))
+	mux.HandleFunc(*healthPath, healthHandler())
+	mux.HandleFunc("/rewatch", requireAuth(watches.rewatchHandler, true))
+	mux.HandleFunc("/replay", requireAuth(replayHandler(r), true))
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", requireAuth(pprof.Index, true))
+		mux.HandleFunc("/debug/pprof/cmdline", requireAuth(pprof.Cmdline, true))
+		mux.HandleFunc("/debug/pprof/profile", requireAuth(pprof.Profile, true))
+		mux.HandleFunc("/debug/pprof/symbol", requireAuth(pprof.Symbol, true))
+		mux.HandleFunc("/debug/pprof/trace", requireAuth(pprof.Trace, true))
+	}
+	mux.HandleFunc("/", indexHandler(metricsPath, watches, r))
+	return mux
 }
 
 type volumeDirsFlag []string
 
-type webhookFlag []*url.URL
+type webhookFlag []*webhookTarget
+
+type stringsFlag []string
+
+type headersFlag []webhookHeader
 
 func (v *volumeDirsFlag) Set(value string) error {
 	*v = append(*v, value)
@@ -250,12 +1057,34 @@ func (v *volumeDirsFlag) String() string {
 	return fmt.Sprint(*v)
 }
 
+func (v *stringsFlag) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+func (v *stringsFlag) String() string {
+	return fmt.Sprint(*v)
+}
+
+func (v *headersFlag) Set(value string) error {
+	hdr, err := parseWebhookHeader(value)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, hdr)
+	return nil
+}
+
+func (v *headersFlag) String() string {
+	return fmt.Sprint(*v)
+}
+
 func (v *webhookFlag) Set(value string) error {
-	u, err := url.Parse(value)
+	h, err := parseWebhookTarget(value)
 	if err != nil {
-		return fmt.Errorf("invalid URL: %v", err)
+		return err
 	}
-	*v = append(*v, u)
+	*v = append(*v, h)
 	return nil
 }
 
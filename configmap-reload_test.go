@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setFlag sets the flag variable p to v for the duration of the test.
+func setFlag[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// captureLog returns the buffer the standard logger writes to for the
+// duration of the test.
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	var buf syncBuffer
+	w, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use, e.g. by the
+// goroutines of a reload logging at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func mustParseWebhook(t *testing.T, value string) *webhookTarget {
+	t.Helper()
+	h, err := parseWebhookTarget(value)
+	if err != nil {
+		t.Fatalf("parseWebhookTarget(%q): %v", value, err)
+	}
+	return h
+}
+
+func TestCheckWebhookResolution(t *testing.T) {
+	setFlag(t, webhookResolverAddr, "")
+	unresolvable := "http://configmap-reload.invalid/reload"
+	tests := []struct {
+		name     string
+		mode     string
+		webhooks []string
+		wantErr  string
+		wantWarn bool
+	}{
+		{name: "off", mode: "off", webhooks: []string{unresolvable}},
+		{name: "warn unresolvable", mode: "warn", webhooks: []string{unresolvable}, wantWarn: true},
+		{name: "warn resolvable", mode: "warn", webhooks: []string{"http://localhost:9090/-/reload"}},
+		{name: "fail unresolvable", mode: "fail", webhooks: []string{"http://localhost/reload", unresolvable}, wantErr: `unable to resolve webhook host "configmap-reload.invalid"`},
+		{name: "fail resolvable", mode: "fail", webhooks: []string{"http://localhost:9090/-/reload"}},
+		{name: "ip", mode: "fail", webhooks: []string{"http://127.0.0.1:9090/-/reload", "http://[::1]:9090/-/reload"}},
+		{name: "ziti service", mode: "fail", webhooks: []string{"ziti://unresolvable-service/-/reload"}},
+		{name: "invalid mode", mode: "strict", wantErr: "invalid webhook-dns-check mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var webhooks []*webhookTarget
+			for _, w := range tt.webhooks {
+				webhooks = append(webhooks, mustParseWebhook(t, w))
+			}
+			logs := captureLog(t)
+			err := checkWebhookResolution(tt.mode, webhooks)
+			if warned := strings.Contains(logs.String(), "warning: unable to resolve webhook host"); warned != tt.wantWarn {
+				t.Errorf("logged %q, want a warning: %v", logs, tt.wantWarn)
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookLabel(t *testing.T) {
+	long := mustParseWebhook(t, "http://webhook.example/reload?"+strings.Repeat("x", 100))
+	other := mustParseWebhook(t, "http://webhook.example/reload?"+strings.Repeat("x", 99)+"y")
+	short := mustParseWebhook(t, "http://a/reload")
+
+	setFlag(t, metricsMaxLabelLength, 0)
+	if got := webhookLabel(long); got != long.String() {
+		t.Errorf("unbounded label %q, want the URL", got)
+	}
+
+	setFlag(t, metricsMaxLabelLength, 40)
+	if got := webhookLabel(short); got != short.String() {
+		t.Errorf("label of a short URL %q, want the URL", got)
+	}
+	label := webhookLabel(long)
+	if len(label) != 40 || !strings.HasPrefix(label, "http://webhook.example/relo~") {
+		t.Errorf("label %q, want a 40 byte prefix of the URL with its hash", label)
+	}
+	if again := webhookLabel(long); again != label {
+		t.Errorf("label %q, then %q: not stable", label, again)
+	}
+	if webhookLabel(other) == label {
+		t.Errorf("URLs with the same prefix share the label %q", label)
+	}
+
+	// A limit shorter than the hash suffix leaves only the hash.
+	setFlag(t, metricsMaxLabelLength, 5)
+	if got := webhookLabel(long); len(got) != 12 {
+		t.Errorf("label %q with a limit of 5, want the 12 character hash", got)
+	}
+}
+
+func TestPprofHandlers(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		enabled   bool
+		tokenFile string
+		token     string
+		wantCode  int
+		wantPprof bool
+	}{
+		{name: "disabled", wantCode: http.StatusOK},
+		{name: "without token file", enabled: true, wantCode: http.StatusForbidden},
+		{name: "without token", enabled: true, tokenFile: tokenFile, wantCode: http.StatusUnauthorized},
+		{name: "with token", enabled: true, tokenFile: tokenFile, token: "secret", wantCode: http.StatusOK, wantPprof: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, enablePprof, tt.enabled)
+			setFlag(t, webAuthTokenFile, tt.tokenFile)
+			mux := newServeMux("/metrics", nil, testReloader(http.DefaultTransport), http.DefaultClient)
+
+			req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("GET /debug/pprof/: %d, want %d", rec.Code, tt.wantCode)
+			}
+			// Without -pprof the path is served the web page instead.
+			if got := strings.Contains(rec.Body.String(), "Types of profiles available"); got != tt.wantPprof {
+				t.Errorf("GET /debug/pprof/ served the pprof index: %v, want %v", got, tt.wantPprof)
+			}
+		})
+	}
+}
+
+func TestInInitialWindow(t *testing.T) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		after  time.Duration
+		window time.Duration
+		want   bool
+	}{
+		{name: "no window", after: 0, window: 0, want: false},
+		{name: "right after registering", after: 0, window: 5 * time.Second, want: true},
+		{name: "within the window", after: 4 * time.Second, window: 5 * time.Second, want: true},
+		{name: "window over", after: 5 * time.Second, window: 5 * time.Second, want: false},
+		{name: "after the window", after: time.Minute, window: 5 * time.Second, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inInitialWindow(started.Add(tt.after), started, tt.window); got != tt.want {
+				t.Errorf("change %s after startup ignored: %v, want %v", tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerMetricsListenFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	tests := []struct {
+		policy  string
+		wantErr bool
+	}{
+		{policy: "fail", wantErr: true},
+		// With continue main keeps watching without the server.
+		{policy: "continue", wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			setFlag(t, listenFailurePolicy, tt.policy)
+			logs := captureLog(t)
+			returned := make(chan error, 1)
+			go func() {
+				returned <- serverMetrics(taken.Addr().String(), "/metrics", nil, testReloader(http.DefaultTransport), http.DefaultClient)
+			}()
+			select {
+			case err := <-returned:
+				if tt.wantErr && err == nil {
+					t.Error("serverMetrics returned no error for a port in use")
+				}
+				if !tt.wantErr {
+					if err != nil {
+						t.Errorf("serverMetrics returned %v, want nil", err)
+					}
+					if !strings.Contains(logs.String(), "continuing to watch without the web server") {
+						t.Errorf("logged %q, want the listen error", logs.String())
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("serverMetrics did not return for a port in use")
+			}
+		})
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	names := func(reg *prometheus.Registry) map[string]bool {
+		t.Helper()
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[string]bool{}
+		for _, f := range families {
+			found[f.GetName()] = true
+		}
+		return found
+	}
+	if found := names(registry); found["go_goroutines"] || found["process_cpu_seconds_total"] {
+		t.Error("runtime metrics are registered before -metrics.include-runtime is applied")
+	}
+	reg := prometheus.NewRegistry()
+	registerRuntimeMetrics(reg)
+	found := names(reg)
+	for _, name := range []string{"go_goroutines", "go_memstats_alloc_bytes", "go_gc_duration_seconds", "process_cpu_seconds_total"} {
+		if !found[name] {
+			t.Errorf("%s is not exposed with -metrics.include-runtime", name)
+		}
+	}
+	// The metrics handler exposes its own promhttp_* series, as it did with
+	// the default registry.
+	mux := newServeMux("/metrics", nil, testReloader(nil), http.DefaultClient)
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if i == 1 && !strings.Contains(rec.Body.String(), "promhttp_metric_handler_requests_total") {
+			t.Error("promhttp_metric_handler_requests_total is not exposed")
+		}
+	}
+}
+
+func TestSuperviseEventLoopRestarts(t *testing.T) {
+	setFlag(t, watcherPanicPolicy, "restart")
+	logs := captureLog(t)
+	before := testutil.ToFloat64(watcherPanics)
+	runs := 0
+	superviseEventLoop(nil, func() {
+		runs++
+		if atomic.LoadInt32(&eventLoopAlive) != 1 {
+			t.Error("the event loop is not alive while it runs")
+		}
+		if runs < 3 {
+			panic("injected")
+		}
+	})
+	if runs != 3 {
+		t.Errorf("the event loop ran %d times, want 3: restarted after each of 2 panics", runs)
+	}
+	if got := testutil.ToFloat64(watcherPanics) - before; got != 2 {
+		t.Errorf("watcher_panics_total increased by %g, want 2", got)
+	}
+	if atomic.LoadInt32(&eventLoopAlive) != 0 {
+		t.Error("the event loop is alive after it returned")
+	}
+	if !strings.Contains(logs.String(), "event loop panicked: injected") {
+		t.Errorf("logged %q, want the panic", logs.String())
+	}
+}
+
+func TestLiveDuringStartupReload(t *testing.T) {
+	setFlag(t, disableFile, "")
+	captureLog(t)
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "..2024_01_01", map[string]string{"key": "value"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &countingTransport{statuses: []int{503, 200}}
+	d := &dispatcher{reloader: testReloader(rt, mustParseWebhook(t, "http://reload/live"))}
+	d.settings.retries = 2
+	d.settings.retryInterval = 500 * time.Millisecond
+	var started atomic.Bool
+	looped := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		superviseEventLoop(func() {
+			started.Store(true)
+			reloadOnStartup(d, targets)
+		}, func() {
+			close(looped)
+			<-stop
+		})
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for rt.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The startup reload waits to retry its failed attempt.
+	rec := httptest.NewRecorder()
+	healthHandler()(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz responded %d while the startup reload retries, want %d", rec.Code, http.StatusOK)
+	}
+	if !started.Load() || rt.count() != 1 {
+		t.Errorf("sent %d requests, want the startup reload to be waiting to retry", rt.count())
+	}
+	<-looped
+	if rt.count() != 2 {
+		t.Errorf("sent %d requests before the event loop ran, want the startup reload and its retry", rt.count())
+	}
+	close(stop)
+	<-done
+}
+
+func TestReloadOnStartup(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled bool
+		wantDo   int
+		wantLog  string
+	}{
+		{name: "enabled", wantDo: 1, wantLog: "reloading on start"},
+		{name: "disabled", disabled: true, wantDo: 0, wantLog: "not reloading on start: reloads are disabled by"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sentinel := filepath.Join(t.TempDir(), "disabled")
+			if tt.disabled {
+				if err := os.WriteFile(sentinel, nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setFlag(t, disableFile, sentinel)
+			setFlag(t, &reloadsOff, false)
+			t.Cleanup(func() { reloadsDisabledGauge.Set(0) })
+			logs := captureLog(t)
+			dir := t.TempDir()
+			writeConfigMap(t, dir, "..2024_01_01", map[string]string{"key": "value"})
+			targets, err := newWatchTargets([]string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rt := &countingTransport{statuses: []int{200}}
+			d := &dispatcher{reloader: testReloader(rt, mustParseWebhook(t, "http://reload/"+tt.name))}
+
+			reloadOnStartup(d, targets)
+			d.drain(time.Second)
+			if got := rt.count(); got != tt.wantDo {
+				t.Errorf("sent %d requests, want %d", got, tt.wantDo)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("log %q does not contain %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
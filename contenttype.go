@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// contentTypes holds the -content-type values. When set, only changes of
+// keys whose content is of one of these types trigger a reload.
+var contentTypes stringsFlag
+
+// sniffContentType returns the media type of data. http.DetectContentType
+// reports JSON and YAML as plain text, so those are recognised first: valid
+// JSON as application/json, and text that parses as a YAML mapping or
+// sequence as application/yaml.
+func sniffContentType(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && json.Valid(trimmed) && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return "application/json"
+	}
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	if mediaType == "text/plain" {
+		var doc interface{}
+		if yaml.Unmarshal(data, &doc) == nil {
+			switch doc.(type) {
+			case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+				return "application/yaml"
+			}
+		}
+	}
+	return mediaType
+}
+
+// matchesContentType reports whether data is of one of the -content-type
+// types. A type may end in /* to match all its subtypes, e.g. text/*.
+func matchesContentType(data []byte) bool {
+	mediaType := sniffContentType(data)
+	for _, t := range contentTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterContentTypes returns the keys whose content matches -content-type,
+// judged by their new content or, for removed keys, their old content.
+// Keys whose content was not read are kept.
+func filterContentTypes(old, new dirSnapshot, keys []string) []string {
+	var filtered []string
+	for _, k := range keys {
+		e, ok := new[k]
+		if !ok {
+			e = old[k]
+		}
+		if e.unread || matchesContentType(e.data) {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered
+}
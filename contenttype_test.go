@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{data: `{"port": 8080}`, want: "application/json"},
+		{data: "[1, 2]\n", want: "application/json"},
+		{data: "port: 8080\nname: app\n", want: "application/yaml"},
+		{data: "- a\n- b\n", want: "application/yaml"},
+		{data: "just some words\n", want: "text/plain"},
+		{data: "\x00\x01\x02\xff", want: "application/octet-stream"},
+		{data: "\x89PNG\r\n\x1a\n", want: "image/png"},
+	}
+	for _, tt := range tests {
+		if got := sniffContentType([]byte(tt.data)); got != tt.want {
+			t.Errorf("sniffContentType(%q) = %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestContentTypeFilter(t *testing.T) {
+	setFlag(t, &contentTypes, stringsFlag{"application/json", "application/yaml"})
+	tests := []struct {
+		name     string
+		key      string
+		content  string
+		wantFire bool
+	}{
+		{name: "JSON", key: "config.json", content: `{"level": "debug"}`, wantFire: true},
+		{name: "binary", key: "blob.bin", content: "\x00\x01\x02\xff\xfe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeConfigMap(t, dir, "v1", map[string]string{"config.json": `{"level": "info"}`, "blob.bin": "\x00\x00"})
+			targets, err := newWatchTargets([]string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := map[string]string{"config.json": `{"level": "info"}`, "blob.bin": "\x00\x00"}
+			data[tt.key] = tt.content
+			writeConfigMap(t, dir, "v2", data)
+			ev, fire := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create})
+			if fire != tt.wantFire {
+				t.Errorf("change of %s fires: %v, want %v", tt.key, fire, tt.wantFire)
+			}
+			if fire && (len(ev.keys) != 1 || ev.keys[0] != tt.key) {
+				t.Errorf("reloads for %q, want %s", ev.keys, tt.key)
+			}
+		})
+	}
+}
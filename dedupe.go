@@ -0,0 +1,31 @@
+package main
+
+import (
+	"sync"
+)
+
+// deliveredStates records, per webhook, the content state of the watched
+// directories it last successfully reloaded for. With -webhook-dedupe a
+// webhook is not called again for a state it already reloaded for, so that
+// several directories changing together cause a single call.
+type deliveredStates struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+var delivered = &deliveredStates{states: map[string]string{}}
+
+func (d *deliveredStates) seen(h *webhookTarget, state string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return state != "" && d.states[h.String()] == state
+}
+
+func (d *deliveredStates) record(h *webhookTarget, state string) {
+	if state == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.states[h.String()] = state
+}
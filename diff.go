@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDiffCells bounds the size of the table computed by diffLines, so that
+// diffing two large files does not take excessive time or memory.
+const maxDiffCells = 4 << 20
+
+// diffSnapshots renders a line-based diff of the given changed keys between
+// old and new, with one section per key. The result is cut to maxBytes.
+func diffSnapshots(old, new dirSnapshot, keys []string, maxBytes int) string {
+	var b strings.Builder
+	for _, k := range keys {
+		if old[k].unread || new[k].unread {
+			fmt.Fprintf(&b, "--- a/%s\n+++ b/%s\n@@ not read, compared by size and modification time @@\n", k, k)
+			continue
+		}
+		writeKeyDiff(&b, k, old[k].data, new[k].data)
+	}
+	return truncateDiff(b.String(), maxBytes)
+}
+
+// setDiffs sets the diffs of the keys of ev between its base and snapshot.
+func (ev *reloadEvent) setDiffs() {
+	ev.diffs = map[string]string{}
+	for _, k := range ev.keys {
+		ev.diffs[k] = diffSnapshots(ev.base, ev.snapshot, []string{k}, *webhookBodyDiffMax)
+	}
+	ev.diff = diffSnapshots(ev.base, ev.snapshot, ev.keys, *webhookBodyDiffMax)
+}
+
+func writeKeyDiff(b *strings.Builder, key string, old, new []byte) {
+	fmt.Fprintf(b, "--- a/%s\n+++ b/%s\n", key, key)
+	oldLines, newLines := splitLines(string(old)), splitLines(string(new))
+	if len(oldLines)*len(newLines) > maxDiffCells {
+		fmt.Fprintf(b, "@@ %d lines changed to %d lines, too large to diff @@\n", len(oldLines), len(newLines))
+		return
+	}
+	for _, l := range diffLines(oldLines, newLines) {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+}
+
+// truncateDiff cuts diff to maxBytes, marking it as truncated. It is cut at
+// the start of a rune, so that the body stays valid UTF-8.
+func truncateDiff(diff string, maxBytes int) string {
+	const marker = "... diff truncated\n"
+	if maxBytes <= 0 || len(diff) <= maxBytes {
+		return diff
+	}
+	if maxBytes <= len(marker) {
+		return marker[:maxBytes]
+	}
+	cut := maxBytes - len(marker)
+	for cut > 0 && !utf8.RuneStart(diff[cut]) {
+		cut--
+	}
+	return diff[:cut] + marker
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the removed lines of a prefixed with "-" and the added
+// lines of b prefixed with "+", based on their longest common subsequence.
+// Unchanged lines are omitted.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return out
+}
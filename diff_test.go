@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+func TestChangeDiff(t *testing.T) {
+	setFlag(t, webhookBodyDiff, true)
+	setFlag(t, webhookBodyDiffMax, 0)
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"app.yaml": "level: info\nport: 80\n", "other": "x\n"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataCreate := fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create}
+
+	writeConfigMap(t, dir, "v2", map[string]string{"app.yaml": "level: debug\nport: 80\n", "other": "x\n"})
+	ev, ok := targets.change(dataCreate)
+	if !ok {
+		t.Fatal("the update is not a change")
+	}
+	want := "--- a/app.yaml\n+++ b/app.yaml\n-level: info\n+level: debug\n"
+	if ev.diff != want {
+		t.Errorf("diff of the first update:\n%s\nwant:\n%s", ev.diff, want)
+	}
+	if ev.diffs["app.yaml"] != want {
+		t.Errorf("diff of app.yaml:\n%s\nwant:\n%s", ev.diffs["app.yaml"], want)
+	}
+
+	// The next update is diffed against the content of the previous one.
+	writeConfigMap(t, dir, "v3", map[string]string{"app.yaml": "level: debug\nport: 8080\n", "other": "x\n"})
+	if ev, _ = targets.change(dataCreate); ev.diff != "--- a/app.yaml\n+++ b/app.yaml\n-port: 80\n+port: 8080\n" {
+		t.Errorf("diff of the second update:\n%s", ev.diff)
+	}
+}
+
+func TestTruncateDiff(t *testing.T) {
+	diff := "--- a/k\n+++ b/k\n-old line\n+new line\n"
+	tests := []struct {
+		maxBytes int
+		want     string
+	}{
+		{maxBytes: 0, want: diff},
+		{maxBytes: len(diff), want: diff},
+		{maxBytes: 30, want: "--- a/k\n+++... diff truncated\n"},
+		{maxBytes: 5, want: "... d"},
+	}
+	for _, tt := range tests {
+		if got := truncateDiff(diff, tt.maxBytes); got != tt.want || (tt.maxBytes > 0 && len(got) > tt.maxBytes) {
+			t.Errorf("truncateDiff(%d) = %q, want %q", tt.maxBytes, got, tt.want)
+		}
+	}
+	// A cut within a multi-byte rune backs up to its start.
+	if got := truncateDiff("+grüße\n"+strings.Repeat("x", 30), 23); got != "+gr... diff truncated\n" || !utf8.ValidString(got) {
+		t.Errorf("truncateDiff cut within a rune: %q", got)
+	}
+}
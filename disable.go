@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// reloadsOff is whether -disable-file existed when it was last checked.
+var reloadsOff bool
+
+// reloadsDisabled reports whether reloads are disabled because -disable-file
+// exists, updating the reloads disabled gauge and logging when that changed
+// since the last check.
+func reloadsDisabled() bool {
+	if *disableFile == "" {
+		return false
+	}
+	_, err := os.Stat(*disableFile)
+	off := err == nil
+	if off != reloadsOff {
+		if off {
+			log.Printf("reloads disabled: %s exists", *disableFile)
+			reloadsDisabledGauge.Set(1)
+		} else {
+			log.Printf("reloads enabled: %s was removed", *disableFile)
+			reloadsDisabledGauge.Set(0)
+		}
+		reloadsOff = off
+	}
+	return off
+}
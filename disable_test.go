@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReloadsDisabled(t *testing.T) {
+	sentinel := filepath.Join(t.TempDir(), "disabled")
+	setFlag(t, disableFile, sentinel)
+	setFlag(t, &reloadsOff, false)
+	t.Cleanup(func() { reloadsDisabledGauge.Set(0) })
+	logs := captureLog(t)
+
+	// The changes are handled as the event loop's send does: dispatched
+	// while reloads are enabled, held while they are disabled and sent
+	// once the file is removed.
+	var dispatched []reloadEvent
+	held := heldChanges{}
+	send := func(ev reloadEvent) {
+		if reloadsDisabled() {
+			held.hold(ev)
+			return
+		}
+		dispatched = append(dispatched, ev)
+	}
+	check := func(wantDisabled bool) {
+		t.Helper()
+		if got := reloadsDisabled(); got != wantDisabled {
+			t.Fatalf("reloads disabled: %v, want %v", got, wantDisabled)
+		}
+		want := 0.0
+		if wantDisabled {
+			want = 1
+		}
+		if got := testutil.ToFloat64(reloadsDisabledGauge); got != want {
+			t.Errorf("reloads_disabled = %g, want %g", got, want)
+		}
+	}
+
+	check(false)
+	send(reloadEvent{id: "enabled", dir: "/config", keys: []string{"a"}})
+
+	writeFile(t, sentinel, "")
+	check(true)
+	send(reloadEvent{id: "first", dir: "/config", keys: []string{"b"}})
+	send(reloadEvent{id: "second", dir: "/config", keys: []string{"c"}})
+	if len(dispatched) != 1 {
+		t.Fatalf("dispatched %d reloads while disabled, want only the one before", len(dispatched)-1)
+	}
+
+	if err := os.Remove(sentinel); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+	dispatched = append(dispatched, held.take()...)
+	if len(dispatched) != 2 || dispatched[1].id != "first" || strings.Join(dispatched[1].keys, ",") != "b,c" {
+		t.Errorf("dispatched %+v, want the held changes as one reload after the file was removed", dispatched)
+	}
+	for _, want := range []string{"reloads disabled: " + sentinel + " exists", "reloads enabled: " + sentinel + " was removed"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logged %q, want %q", logs.String(), want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dispatcher sends the reloads for detected changes.
+type dispatcher struct {
+	*reloader
+
+	// inFlightReloads holds the last reload started for each directory
+	// when -reload-cancel-superseded is set, so that only a newer change of
+	// the same directory supersedes it.
+	inFlightReloads map[string]inFlightReload
+
+	// mu guards running and closed, which track the reloads in flight so
+	// that they can be drained on shutdown.
+	mu       sync.Mutex
+	running  int
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// inFlightReload is a reload running in the background, which cancel stops
+// and done is closed after.
+type inFlightReload struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// begin registers a reload as in flight. It reports false once draining
+// started, in which case the reload must not be sent.
+func (d *dispatcher) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.running++
+	d.inFlight.Add(1)
+	return true
+}
+
+func (d *dispatcher) finish() {
+	d.mu.Lock()
+	d.running--
+	d.mu.Unlock()
+	d.inFlight.Done()
+}
+
+// drain stops new reloads and waits up to timeout for those in flight to
+// complete, returning how many completed and how many were abandoned.
+func (d *dispatcher) drain(timeout time.Duration) (drained, abandoned int) {
+	d.mu.Lock()
+	d.closed = true
+	started := d.running
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	d.mu.Lock()
+	abandoned = d.running
+	d.mu.Unlock()
+	return started - abandoned, abandoned
+}
+
+// shutdown drains the reloads in flight for up to timeout, counting and
+// logging how many were drained and abandoned.
+func (d *dispatcher) shutdown(timeout time.Duration) {
+	drained, abandoned := d.drain(timeout)
+	shutdownReloads.WithLabelValues("drained").Add(float64(drained))
+	shutdownReloads.WithLabelValues("abandoned").Add(float64(abandoned))
+	if abandoned > 0 {
+		log.Printf("error: abandoned %d in-flight reload(s) after %s; drained %d", abandoned, timeout, drained)
+	} else {
+		log.Printf("drained %d in-flight reload(s), exiting", drained)
+	}
+}
+
+// dispatch sends the reload for ev. Without -reload-cancel-superseded it
+// blocks until the reload has completed; with it the reload runs in the
+// background and any reload still in flight for the same directory is
+// cancelled first; reloads for other directories keep running.
+func (d *dispatcher) dispatch(ev reloadEvent) {
+	if !*reloadCancelSuperseded {
+		if !d.begin() {
+			ev.logf("not reloading for the change of %s: shutting down", ev.dir)
+			return
+		}
+		defer d.finish()
+		d.reloadAll(context.Background(), ev)
+		return
+	}
+	if prev, ok := d.inFlightReloads[ev.dir]; ok {
+		prev.cancel()
+		<-prev.done
+		delete(d.inFlightReloads, ev.dir)
+	}
+	if !d.begin() {
+		ev.logf("not reloading for the change of %s: shutting down", ev.dir)
+		return
+	}
+	if d.inFlightReloads == nil {
+		d.inFlightReloads = map[string]inFlightReload{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	d.inFlightReloads[ev.dir] = inFlightReload{cancel: cancel, done: done}
+	go func() {
+		defer close(done)
+		defer cancel()
+		defer d.finish()
+		d.reloadAll(ctx, ev)
+	}()
+}
+
+// teardown sends the reload request to every -teardown-webhook-url after
+// dir vanished.
+func (d *dispatcher) teardown(dir string) {
+	if !d.begin() {
+		return
+	}
+	defer d.finish()
+	for _, h := range teardownWebhook {
+		d.fire(context.Background(), h, reloadEvent{id: newReloadID(), dir: dir, teardown: true})
+	}
+}
+
+// heldChanges are the changes held back until they can be sent, by
+// directory, e.g. during the startup warmup or outside the reload window.
+type heldChanges map[string]reloadEvent
+
+// hold adds the change ev, merging it with one held for the same directory.
+func (c heldChanges) hold(ev reloadEvent) {
+	if prev, ok := c[ev.dir]; ok {
+		ev = mergeEvents(prev, ev)
+	}
+	c[ev.dir] = ev
+}
+
+// take returns the held changes ordered by directory and forgets them.
+func (c heldChanges) take() []reloadEvent {
+	dirs := make([]string, 0, len(c))
+	for dir := range c {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	events := make([]reloadEvent, len(dirs))
+	for i, dir := range dirs {
+		events[i] = c[dir]
+		delete(c, dir)
+	}
+	return events
+}
+
+// debouncer holds changes back until none arrived for its delay, so that a
+// burst of events for one swap, or several ConfigMaps updated together,
+// trigger once per directory.
+type debouncer struct {
+	delay time.Duration
+	held  heldChanges
+	// settled fires once delay passed without a further change.
+	settled <-chan time.Time
+}
+
+func newDebouncer(delay time.Duration) *debouncer {
+	return &debouncer{delay: delay, held: heldChanges{}}
+}
+
+// hold adds the change ev and restarts the wait for the changes to settle.
+func (d *debouncer) hold(ev reloadEvent) {
+	d.held.hold(ev)
+	d.settled = time.After(d.delay)
+}
+
+// take returns the held changes ordered by directory once they settled.
+func (d *debouncer) take() []reloadEvent {
+	d.settled = nil
+	return d.held.take()
+}
+
+// mergeEvents combines two events for the same directory, keeping the
+// content state of the later one, the keys changed by either and the reload
+// ID of the earlier one, whose detection started the reload cycle. With
+// -webhook-body-diff the diffs are taken again from the content before the
+// earlier change, so that they cover both.
+func mergeEvents(earlier, later reloadEvent) reloadEvent {
+	seen := map[string]bool{}
+	var keys []string
+	for _, k := range append(earlier.keys, later.keys...) {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	later.keys = keys
+	if earlier.id != "" {
+		later.id = earlier.id
+	}
+	if earlier.diffs != nil && later.diffs != nil {
+		later.base = earlier.base
+		later.setDiffs()
+	}
+	return later
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDispatchCancelSuperseded(t *testing.T) {
+	tests := []struct {
+		name          string
+		dirs          [2]string
+		wantCancelled bool
+	}{
+		{name: "same directory", dirs: [2]string{"/config/a", "/config/a"}, wantCancelled: true},
+		{name: "other directory", dirs: [2]string{"/config/a", "/config/b"}, wantCancelled: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, reloadCancelSuperseded, true)
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			// outcome receives whether the first, blocked request was
+			// cancelled by the client.
+			outcome := make(chan bool, 1)
+			var seen atomic.Bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("dir") != tt.dirs[0] || seen.Swap(true) {
+					return
+				}
+				close(started)
+				select {
+				case <-release:
+					outcome <- false
+				case <-r.Context().Done():
+					outcome <- true
+				}
+			}))
+			defer srv.Close()
+
+			d := &dispatcher{reloader: testReloader(srv.Client().Transport, mustParseWebhook(t, srv.URL+"/reload?dir="+tt.dirs[0]))}
+			d.dispatch(reloadEvent{id: newReloadID(), dir: tt.dirs[0]})
+			<-started
+			// The second reload is sent to another webhook so that the
+			// server handles it without waiting for the first.
+			d.setWebhooks([]*webhookTarget{mustParseWebhook(t, srv.URL+"/reload?dir=other")})
+			go d.dispatch(reloadEvent{id: newReloadID(), dir: tt.dirs[1]})
+
+			var cancelled bool
+			select {
+			case cancelled = <-outcome:
+			case <-time.After(500 * time.Millisecond):
+				close(release)
+				cancelled = <-outcome
+			}
+			if cancelled != tt.wantCancelled {
+				t.Errorf("first reload cancelled = %v, want %v", cancelled, tt.wantCancelled)
+			}
+			if _, abandoned := d.drain(5 * time.Second); abandoned != 0 {
+				t.Errorf("%d reload(s) still in flight after drain", abandoned)
+			}
+		})
+	}
+}
+
+func TestMergeEvents(t *testing.T) {
+	earlier := reloadEvent{id: "first", dir: "/config", keys: []string{"b", "a"}, hash: "h1"}
+	later := reloadEvent{id: "second", dir: "/config", keys: []string{"c", "a"}, hash: "h2"}
+	got := mergeEvents(earlier, later)
+	if got.id != "first" || got.hash != "h2" {
+		t.Errorf("got id %q and hash %q, want first and h2", got.id, got.hash)
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(got.keys, want) {
+		t.Errorf("got keys %q, want %q", got.keys, want)
+	}
+}
+
+func TestMergeEventsDiff(t *testing.T) {
+	setFlag(t, webhookBodyDiff, true)
+	setFlag(t, webhookBodyDiffMax, 0)
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"a": "1\n", "b": "1\n"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataCreate := fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create}
+	writeConfigMap(t, dir, "v2", map[string]string{"a": "2\n", "b": "1\n"})
+	earlier, _ := targets.change(dataCreate)
+	writeConfigMap(t, dir, "v3", map[string]string{"a": "2\n", "b": "2\n"})
+	later, _ := targets.change(dataCreate)
+
+	// The merged change is diffed against the content before the earlier
+	// change, so the diffs of both survive.
+	got := mergeEvents(earlier, later)
+	diffA, diffB := "--- a/a\n+++ b/a\n-1\n+2\n", "--- a/b\n+++ b/b\n-1\n+2\n"
+	if got.diff != diffA+diffB {
+		t.Errorf("merged diff:\n%s\nwant:\n%s", got.diff, diffA+diffB)
+	}
+	if got.diffs["a"] != diffA || got.diffs["b"] != diffB {
+		t.Errorf("merged diffs %q, want both keys diffed", got.diffs)
+	}
+	got.key = "a"
+	body, _, err := requestBody(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"directory":"` + dir + `","key":"a","diff":"--- a/a\n+++ b/a\n-1\n+2\n"}`; string(body) != want {
+		t.Errorf("per-key body %s, want %s", body, want)
+	}
+}
+
+func TestDispatchCancelsReloadInBackoff(t *testing.T) {
+	setFlag(t, reloadCancelSuperseded, true)
+	logs := captureLog(t)
+	h := mustParseWebhook(t, "http://webhook-backoff/reload")
+	rt := &countingTransport{statuses: []int{503, 200}}
+	d := &dispatcher{reloader: testReloader(rt, h)}
+	d.settings.retries = 3
+	d.settings.retryInterval = time.Hour
+
+	d.dispatch(reloadEvent{id: newReloadID(), dir: "/config"})
+	deadline := time.Now().Add(5 * time.Second)
+	for rt.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// The first reload is waiting an hour to retry its failed attempt when
+	// the newer change of the same directory arrives.
+	d.dispatch(reloadEvent{id: newReloadID(), dir: "/config"})
+	if _, abandoned := d.drain(5 * time.Second); abandoned != 0 {
+		t.Fatalf("%d reload(s) still in flight after drain", abandoned)
+	}
+	if got := rt.count(); got != 2 {
+		t.Errorf("sent %d requests, want the failed one and the newer reload", got)
+	}
+	if !strings.Contains(logs.String(), "reload of http://webhook-backoff/reload cancelled: superseded by a newer change") {
+		t.Errorf("the first reload was not cancelled; logged:\n%s", logs)
+	}
+}
+
+func TestHeldChanges(t *testing.T) {
+	// Changes during the startup warmup are held rather than dropped and
+	// sent, one per directory, once it is over.
+	held := heldChanges{}
+	held.hold(reloadEvent{id: "first", dir: "/config-b", keys: []string{"a"}, hash: "h1"})
+	held.hold(reloadEvent{id: "other", dir: "/config-a", keys: []string{"x"}, hash: "h3"})
+	held.hold(reloadEvent{id: "second", dir: "/config-b", keys: []string{"b"}, hash: "h2"})
+
+	var got []string
+	for _, ev := range held.take() {
+		got = append(got, ev.dir+" "+ev.id+" "+ev.hash+" "+strings.Join(ev.keys, ","))
+	}
+	want := []string{"/config-a other h3 x", "/config-b first h2 a,b"}
+	if !slices.Equal(got, want) {
+		t.Errorf("took %q, want %q", got, want)
+	}
+	if len(held) != 0 {
+		t.Errorf("%d changes still held after taking them", len(held))
+	}
+}
+
+func TestTeardownOnDataRemoved(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"a": "1"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &countingTransport{statuses: []int{200}}
+	setFlag(t, &teardownWebhook, webhookFlag{mustParseWebhook(t, "http://teardown/unmounted")})
+	d := &dispatcher{reloader: testReloader(rt, mustParseWebhook(t, "http://reload/"))}
+
+	// Removing a key is not the unmount of the ConfigMap.
+	if targets.isVanishEvent(fsnotify.Event{Name: filepath.Join(dir, "a"), Op: fsnotify.Remove}) {
+		t.Fatal("the removal of a key is a vanish event")
+	}
+	data := filepath.Join(dir, "..data")
+	if err := os.Remove(data); err != nil {
+		t.Fatal(err)
+	}
+	event := fsnotify.Event{Name: data, Op: fsnotify.Remove}
+	if !targets.isVanishEvent(event) {
+		t.Fatal("the removal of ..data is not a vanish event")
+	}
+	if targets.isVanishEvent(event) {
+		t.Error("the removal of ..data is reported twice")
+	}
+	if got := testutil.ToFloat64(directoryVanished.WithLabelValues(dir)); got != 1 {
+		t.Errorf("directory_vanished = %g, want 1", got)
+	}
+
+	d.teardown(dir)
+	if rt.count() != 1 || rt.requests[0].URL.Host != "teardown" {
+		t.Fatalf("sent %d requests, want the teardown webhook only", rt.count())
+	}
+}
+
+func TestDispatcherShutdown(t *testing.T) {
+	tests := []struct {
+		name          string
+		release       time.Duration
+		timeout       time.Duration
+		wantDrained   float64
+		wantAbandoned float64
+	}{
+		{name: "drained", release: 20 * time.Millisecond, timeout: 5 * time.Second, wantDrained: 1},
+		{name: "abandoned", release: time.Second, timeout: 20 * time.Millisecond, wantAbandoned: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, reloadCancelSuperseded, true)
+			started := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(tt.release):
+				case <-r.Context().Done():
+				}
+			}))
+			defer srv.Close()
+			d := &dispatcher{reloader: testReloader(srv.Client().Transport, mustParseWebhook(t, srv.URL+"/reload"))}
+			drained := testutil.ToFloat64(shutdownReloads.WithLabelValues("drained"))
+			abandoned := testutil.ToFloat64(shutdownReloads.WithLabelValues("abandoned"))
+
+			d.dispatch(reloadEvent{id: newReloadID(), dir: "/config"})
+			<-started
+			d.shutdown(tt.timeout)
+			if got := testutil.ToFloat64(shutdownReloads.WithLabelValues("drained")) - drained; got != tt.wantDrained {
+				t.Errorf("counted %g drained reloads, want %g", got, tt.wantDrained)
+			}
+			if got := testutil.ToFloat64(shutdownReloads.WithLabelValues("abandoned")) - abandoned; got != tt.wantAbandoned {
+				t.Errorf("counted %g abandoned reloads, want %g", got, tt.wantAbandoned)
+			}
+			// No reload starts once shutting down.
+			d.dispatch(reloadEvent{id: newReloadID(), dir: "/config"})
+		})
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	d := newDebouncer(delay)
+	if d.settled != nil {
+		t.Fatal("settled before any change")
+	}
+	// A burst: the events of one swap of /a, then a change of /b.
+	d.hold(reloadEvent{id: "first", dir: "/a", keys: []string{"x"}})
+	time.Sleep(delay / 2)
+	d.hold(reloadEvent{id: "second", dir: "/a", keys: []string{"y"}})
+	d.hold(reloadEvent{id: "third", dir: "/b", keys: []string{"z"}})
+	last := time.Now()
+
+	<-d.settled
+	if waited := time.Since(last); waited < delay {
+		t.Errorf("settled %s after the last change, want at least %s", waited, delay)
+	}
+	got := d.take()
+	if len(got) != 2 || got[0].id != "first" || !slices.Equal(got[0].keys, []string{"x", "y"}) || got[1].id != "third" {
+		t.Errorf("took %+v, want one reload per directory", got)
+	}
+	if d.settled != nil || len(d.take()) != 0 {
+		t.Error("changes are still held after they were taken")
+	}
+}
+
+func TestDebouncerDiff(t *testing.T) {
+	setFlag(t, webhookBodyDiff, true)
+	setFlag(t, webhookBodyDiffMax, 0)
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"a": "1\n", "b": "1\n"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataCreate := fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create}
+	d := newDebouncer(time.Millisecond)
+	// Two updates in quick succession are sent as one reload, whose body
+	// carries the changes of both.
+	writeConfigMap(t, dir, "v2", map[string]string{"a": "2\n", "b": "1\n"})
+	ev, _ := targets.change(dataCreate)
+	d.hold(ev)
+	writeConfigMap(t, dir, "v3", map[string]string{"a": "2\n", "b": "2\n"})
+	ev, _ = targets.change(dataCreate)
+	d.hold(ev)
+
+	<-d.settled
+	got := d.take()
+	if len(got) != 1 {
+		t.Fatalf("took %d reloads, want one", len(got))
+	}
+	body, contentType, err := requestBody(got[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--- a/a\n+++ b/a\n-1\n+2\n--- a/b\n+++ b/b\n-1\n+2\n"
+	if string(body) != want || contentType != "text/x-diff; charset=utf-8" {
+		t.Errorf("sent %s body:\n%s\nwant:\n%s", contentType, body, want)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// execOutputWait is how long a command that exited is given for its output
+// pipe to close, e.g. because it started a background process that keeps it
+// open. The pipe is closed after that, which breaks it for that process.
+const execOutputWait = time.Second
+
+// execSlots bounds the number of exec commands running at once to
+// -exec-concurrency across all reloads; commands beyond it wait for a slot.
+var execSlots chan struct{}
+
+// runExecCommands runs every -exec-command for ev. Each command is run with
+// "sh -c" and receives the change as JSON on its standard input; its output
+// is logged. With an -exec-concurrency above 1 the commands run concurrently,
+// otherwise one after the other in the order given. Either way they take a
+// slot of execSlots, so that concurrent reloads stay within the limit too.
+func runExecCommands(ctx context.Context, ev reloadEvent) {
+	if *execConcurrency <= 1 {
+		for _, c := range execCommands {
+			if !runExecCommandInSlot(ctx, c, ev) {
+				return
+			}
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, c := range execCommands {
+		wg.Add(1)
+		go func(c string) {
+			defer wg.Done()
+			runExecCommandInSlot(ctx, c, ev)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// runExecCommandInSlot runs command once a slot of execSlots is free. It
+// reports false if ctx was cancelled first, in which case command is not run.
+func runExecCommandInSlot(ctx context.Context, command string, ev reloadEvent) bool {
+	select {
+	case execSlots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	defer func() { <-execSlots }()
+	if ctx.Err() != nil {
+		return false
+	}
+	runExecCommand(ctx, command, ev)
+	return true
+}
+
+func runExecCommand(ctx context.Context, command string, ev reloadEvent) bool {
+	if *dryRun {
+		ev.logf("dry run: would run %q", command)
+		return true
+	}
+	payload, err := json.Marshal(struct {
+		Directory string   `json:"directory"`
+		Keys      []string `json:"keys"`
+		Empty     bool     `json:"empty,omitempty"`
+	}{ev.dir, ev.keys, ev.empty})
+	if err != nil {
+		setExecFailure(ev, command, "exec_start", err)
+		return false
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = execOutputWait
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		setExecFailure(ev, command, "exec_start", err)
+		return false
+	}
+	ev.logf("running exec command %q", command)
+	if err := cmd.Start(); err != nil {
+		setExecFailure(ev, command, "exec_start", err)
+		return false
+	}
+
+	// A command that exits, or closes its input, without reading the whole
+	// payload breaks the pipe. Writing then fails with EPIPE, which is
+	// recorded but does not stop the command from being waited for. Only
+	// writes to a broken standard output or error raise SIGPIPE in Go
+	// programs, so this cannot take the reloader down; the command's own
+	// output breaking is reported by Wait instead.
+	_, writeErr := io.Copy(stdin, bytes.NewReader(payload))
+	closeErr := stdin.Close()
+	pipeBroken := isBrokenPipe(writeErr) || isBrokenPipe(closeErr)
+
+	err = cmd.Wait()
+	if out := strings.TrimSpace(output.String()); out != "" {
+		ev.logf("exec command %q output: %s", command, out)
+	}
+	if pipeBroken {
+		setExecFailure(ev, command, "exec_pipe_error", errors.New("command closed its input before reading the payload"))
+	} else if writeErr != nil {
+		setExecFailure(ev, command, "exec_pipe_error", writeErr)
+	}
+	if err != nil {
+		reason := "exec_exit"
+		if isBrokenOutput(err) {
+			reason = "exec_pipe_error"
+		}
+		setExecFailure(ev, command, reason, err)
+		return false
+	}
+	ev.logf("exec command %q succeeded", command)
+	return !pipeBroken && writeErr == nil
+}
+
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)
+}
+
+// isBrokenOutput reports whether err, returned by Wait, shows that the output
+// pipe of a command broke: the command was killed by SIGPIPE writing to it,
+// or it exited leaving the pipe open, which was closed after execOutputWait.
+func isBrokenOutput(err error) bool {
+	if errors.Is(err, exec.ErrWaitDelay) {
+		return true
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGPIPE
+}
+
+func setExecFailure(ev reloadEvent, command, reason string, err error) {
+	execErrorsByReason.WithLabelValues(command, reason).Inc()
+	ev.logf("error: exec command %q: %s: %v", command, reason, err)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExecCommandClosesPipes(t *testing.T) {
+	// The payload is larger than a pipe buffer, so that writing it is
+	// still going on when the command closes its input and output.
+	keys := make([]string, 2000)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i) + "-" + strings.Repeat("x", 64)
+	}
+	ev := reloadEvent{id: newReloadID(), dir: "/config", keys: keys}
+	tests := []struct {
+		command    string
+		wantOK     bool
+		wantPipe   float64
+		wantExit   float64
+		wantOutput string
+	}{
+		{command: "cat >/dev/null; echo read", wantOK: true, wantOutput: "read"},
+		{command: "exec 0<&- 1>&- 2>&-; sleep 0.1", wantPipe: 1},
+		{command: "exec 0<&-; exit 3", wantPipe: 1, wantExit: 1},
+		// The output breaks: the command dies writing to it, or leaves it
+		// open to a background process, which loses it once it is closed.
+		{command: "cat >/dev/null; kill -PIPE $$", wantPipe: 1},
+		{command: "cat >/dev/null; (sleep 2; echo late) & echo early", wantPipe: 1, wantOutput: "early"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			logs := captureLog(t)
+			pipe := execErrorsByReason.WithLabelValues(tt.command, "exec_pipe_error")
+			exit := execErrorsByReason.WithLabelValues(tt.command, "exec_exit")
+			pipeBefore, exitBefore := testutil.ToFloat64(pipe), testutil.ToFloat64(exit)
+			if ok := runExecCommand(context.Background(), tt.command, ev); ok != tt.wantOK {
+				t.Errorf("runExecCommand reported success: %v, want %v", ok, tt.wantOK)
+			}
+			if got := testutil.ToFloat64(pipe) - pipeBefore; got != tt.wantPipe {
+				t.Errorf("exec_errors_total{reason=\"exec_pipe_error\"} = %g, want %g", got, tt.wantPipe)
+			}
+			if got := testutil.ToFloat64(exit) - exitBefore; got != tt.wantExit {
+				t.Errorf("exec_errors_total{reason=\"exec_exit\"} = %g, want %g", got, tt.wantExit)
+			}
+			if tt.wantOutput != "" && !strings.Contains(logs.String(), "output: "+tt.wantOutput) {
+				t.Errorf("logged %q, want the output %q", logs.String(), tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestRunExecCommandsConcurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		reloads int
+	}{
+		{name: "concurrent commands", limit: 2, reloads: 1},
+		// Commands run one after the other still share the limit with those
+		// of other reloads.
+		{name: "concurrent reloads", limit: 1, reloads: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRunExecCommandsConcurrency(t, tt.limit, tt.reloads)
+		})
+	}
+}
+
+func testRunExecCommandsConcurrency(t *testing.T, limit, reloads int) {
+	running, seen := t.TempDir(), filepath.Join(t.TempDir(), "seen")
+	// Each command counts the commands running while it runs.
+	var commands stringsFlag
+	for i := 0; i < 5; i++ {
+		commands = append(commands, fmt.Sprintf(
+			`f=$(mktemp %[1]s/XXXXXX); ls %[1]s | wc -l >>%[2]s; sleep 0.3; rm $f`, running, seen))
+	}
+	setFlag(t, &execCommands, commands)
+	setFlag(t, execConcurrency, limit)
+	setFlag(t, &execSlots, make(chan struct{}, limit))
+	captureLog(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < reloads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runExecCommands(context.Background(), reloadEvent{id: newReloadID(), dir: "/config"})
+		}()
+	}
+	wg.Wait()
+	data, err := os.ReadFile(seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := strings.Fields(string(data))
+	if len(counts) != len(commands)*reloads {
+		t.Fatalf("%d commands ran, want %d", len(counts), len(commands)*reloads)
+	}
+	most := 0
+	for _, c := range counts {
+		n, err := strconv.Atoi(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		most = max(most, n)
+	}
+	if most != limit {
+		t.Errorf("at most %d commands ran at once, want %d", most, limit)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// eventLoopAlive is 1 while the event loop is running.
+var eventLoopAlive int32
+
+// failureCounts counts, per webhook, the reloads that failed since the last
+// successful one of the same webhook, so that the success of one webhook
+// does not hide that another keeps failing.
+type failureCounts struct {
+	mu     sync.Mutex
+	counts map[string]webhookFailures
+}
+
+type webhookFailures struct {
+	webhook string
+	n       int64
+}
+
+var consecutiveFailures = &failureCounts{counts: map[string]webhookFailures{}}
+
+func (f *failureCounts) record(h *webhookTarget, success bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if success {
+		delete(f.counts, h.String())
+		return
+	}
+	c := f.counts[h.String()]
+	f.counts[h.String()] = webhookFailures{webhook: h.Redacted(), n: c.n + 1}
+}
+
+// worst returns the webhook with the most consecutive failures, and their
+// number.
+func (f *failureCounts) worst() webhookFailures {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var worst webhookFailures
+	for _, c := range f.counts {
+		if c.n > worst.n || c.n == worst.n && c.webhook < worst.webhook {
+			worst = c
+		}
+	}
+	return worst
+}
+
+// retain forgets the failures of the webhooks not among webhooks, e.g. after
+// -webhook-url-file no longer lists them.
+func (f *failureCounts) retain(webhooks []*webhookTarget) {
+	keep := map[string]bool{}
+	for _, h := range webhooks {
+		keep[h.String()] = true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for u := range f.counts {
+		if !keep[u] {
+			delete(f.counts, u)
+		}
+	}
+}
+
+// recordOutcome records the final outcome of the reload of h for ev, after
+// any retries, for readiness, the outcome FIFO, the reload history and the
+// reload span in ctx.
+func recordOutcome(ctx context.Context, h *webhookTarget, ev reloadEvent, success bool, reason string) {
+	setOutcome(ctx, success, reason)
+	history.record(h, ev, success, reason)
+	consecutiveFailures.record(h, success)
+	if success {
+		outcomes.report(h, "success", "")
+		return
+	}
+	outcomes.report(h, "failure", reason)
+}
+
+// readyHandler reports not-ready while a watched directory is not
+// registered with the watcher, e.g. one missing at startup or whose watch of
+// a removed volume dir is lost, and once -ready-failure-threshold
+// consecutive reloads of any webhook have failed, until a reload of that
+// webhook succeeds again.
+func readyHandler(watches *watchSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if lost := watches.lostDirs(); len(lost) > 0 {
+			http.Error(w, fmt.Sprintf("not ready: lost the watch of %s until it reappears", strings.Join(lost, ", ")), http.StatusServiceUnavailable)
+			return
+		}
+		registered, total := watches.watching()
+		if registered == 0 && total > 0 {
+			http.Error(w, "not ready: no directory is watched yet", http.StatusServiceUnavailable)
+			return
+		}
+		if registered < total {
+			http.Error(w, fmt.Sprintf("not ready: watching %d of %d directories", registered, total), http.StatusServiceUnavailable)
+			return
+		}
+		if worst := consecutiveFailures.worst(); *readyFailureThreshold > 0 && worst.n >= int64(*readyFailureThreshold) {
+			http.Error(w, fmt.Sprintf("not ready: %d consecutive reload failures of %s", worst.n, worst.webhook), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// healthHandler reports healthy while the event loop handling the watcher's
+// events is running. Directories that are not watched are left to
+// readyHandler: a restart does not bring back a missing volume dir, so it
+// must not fail the liveness check.
+func healthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&eventLoopAlive) == 0 {
+			http.Error(w, "unhealthy: the event loop is not running", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+func TestReadyFailureThreshold(t *testing.T) {
+	setFlag(t, readyFailureThreshold, 2)
+	old := consecutiveFailures
+	consecutiveFailures = &failureCounts{counts: map[string]webhookFailures{}}
+	t.Cleanup(func() { consecutiveFailures = old })
+
+	a := mustParseWebhook(t, "http://a/reload")
+	b := mustParseWebhook(t, "http://b/reload")
+	teardown := mustParseWebhook(t, "http://teardown/reload")
+	ready := readyHandler(newWatchSet(nil, nil))
+	check := func(wantStatus int, wantBody string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != wantStatus || !strings.Contains(rec.Body.String(), wantBody) {
+			t.Fatalf("got %d %q, want %d %q", rec.Code, rec.Body.String(), wantStatus, wantBody)
+		}
+	}
+
+	consecutiveFailures.record(a, false)
+	check(http.StatusOK, "ok")
+	// The successes of other webhooks, teardown ones included, do not
+	// reset the failures of a.
+	consecutiveFailures.record(b, true)
+	consecutiveFailures.record(teardown, true)
+	consecutiveFailures.record(a, false)
+	check(http.StatusServiceUnavailable, "not ready: 2 consecutive reload failures of http://a/reload")
+
+	consecutiveFailures.record(a, true)
+	check(http.StatusOK, "ok")
+
+	consecutiveFailures.record(b, false)
+	consecutiveFailures.record(b, false)
+	check(http.StatusServiceUnavailable, "of http://b/reload")
+	// b is no longer configured, e.g. after -webhook-url-file changed.
+	consecutiveFailures.retain([]*webhookTarget{a})
+	check(http.StatusOK, "ok")
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	setFlag(t, healthPath, "/livez")
+	setFlag(t, &eventLoopAlive, 0)
+	captureLog(t)
+	a, b := t.TempDir(), t.TempDir()
+	targets, err := newWatchTargets([]string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	watches := newWatchSet(watcher, targets)
+	mux := newServeMux("/metrics", watches, testReloader(nil), http.DefaultClient)
+	check := func(path string, wantStatus int, wantBody string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != wantStatus || !strings.Contains(rec.Body.String(), wantBody) {
+			t.Errorf("%s: got %d %q, want %d %q", path, rec.Code, rec.Body.String(), wantStatus, wantBody)
+		}
+	}
+
+	// Before the first watch is added and the event loop started.
+	check("/readyz", http.StatusServiceUnavailable, "not ready: no directory is watched yet")
+	check("/livez", http.StatusServiceUnavailable, "unhealthy: the event loop is not running")
+
+	atomic.StoreInt32(&eventLoopAlive, 1)
+	if err := watches.add(a); err != nil {
+		t.Fatal(err)
+	}
+	// A directory that is not watched yet is not a reason to restart.
+	check("/readyz", http.StatusServiceUnavailable, "not ready: watching 1 of 2 directories")
+	check("/livez", http.StatusOK, "ok")
+
+	if err := watches.add(b); err != nil {
+		t.Fatal(err)
+	}
+	check("/readyz", http.StatusOK, "ok")
+	check("/livez", http.StatusOK, "ok")
+
+	// Nor is a lost watch, which is re-watched once the directory
+	// reappears.
+	if err := os.RemoveAll(b); err != nil {
+		t.Fatal(err)
+	}
+	if !watches.lose(fsnotify.Event{Name: b, Op: fsnotify.Remove}) {
+		t.Fatal("removing the volume dir did not lose its watch")
+	}
+	check("/readyz", http.StatusServiceUnavailable, "not ready: lost the watch of "+b)
+	check("/livez", http.StatusOK, "ok")
+	if res := watches.reconcile(); len(res.Added) != 0 {
+		t.Fatalf("reconcile added %q of a removed directory", res.Added)
+	}
+	if err := os.Mkdir(b, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	watches.reconcile()
+	check("/readyz", http.StatusOK, "ok")
+
+	// The event loop died.
+	atomic.StoreInt32(&eventLoopAlive, 0)
+	check("/livez", http.StatusServiceUnavailable, "unhealthy: the event loop is not running")
+	check("/readyz", http.StatusOK, "ok")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadHistory keeps the final outcomes of the most recent webhook reloads
+// in a ring buffer of -web.reload-history entries, and the last outcome of
+// every webhook, for the web page.
+type reloadHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	next    int
+	last    map[string]historyEntry
+}
+
+// historyEntry is the final outcome of a reload of a webhook, after any
+// retries.
+type historyEntry struct {
+	At      time.Time
+	ID      string
+	Dir     string
+	Keys    string
+	Webhook string
+	Success bool
+	Reason  string
+}
+
+// history is the reload history, or nil if -web.reload-history is 0.
+var history *reloadHistory
+
+func newReloadHistory(size int) *reloadHistory {
+	return &reloadHistory{entries: make([]historyEntry, 0, size), last: map[string]historyEntry{}}
+}
+
+func (r *reloadHistory) record(h *webhookTarget, ev reloadEvent, success bool, reason string) {
+	if r == nil {
+		return
+	}
+	e := historyEntry{
+		At:      time.Now(),
+		ID:      ev.id,
+		Dir:     ev.dir,
+		Keys:    strings.Join(ev.keys, ", "),
+		Webhook: h.display(),
+		Success: success,
+		Reason:  reason,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+	} else {
+		r.entries[r.next] = e
+	}
+	r.next = (r.next + 1) % cap(r.entries)
+	r.last[h.String()] = e
+}
+
+// recent returns the entries, newest first.
+func (r *reloadHistory) recent() []historyEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recent := make([]historyEntry, 0, len(r.entries))
+	for i := 1; i <= len(r.entries); i++ {
+		recent = append(recent, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return recent
+}
+
+// lastOf returns the last outcome of the webhook h, if it was reloaded.
+func (r *reloadHistory) lastOf(h *webhookTarget) (historyEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.last[h.String()]
+	return e, ok
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<html>
+<head><title>ConfigMap Reload Metrics</title></head>
+<body>
+<h1>ConfigMap Reload</h1>
+<p><a href='{{.MetricsPath}}'>Metrics</a></p>
+{{- if .History}}
+<h2>Watched directories</h2>
+<table>
+<tr><th>Directory</th><th>Watched</th></tr>
+{{- range .Dirs}}
+<tr><td>{{.Dir}}</td><td>{{if .Watched}}yes{{else}}no{{end}}</td></tr>
+{{- end}}
+</table>
+<h2>Webhooks</h2>
+<table>
+<tr><th>Webhook</th><th>Method</th><th>Last reload</th><th>Outcome</th></tr>
+{{- range .Webhooks}}
+<tr><td>{{.URL}}</td><td>{{.Method}}</td>{{if .Reloaded}}<td>{{.Last.At.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{if .Last.Success}}success{{else}}failure: {{.Last.Reason}}{{end}}</td>{{else}}<td>never</td><td></td>{{end}}</tr>
+{{- end}}
+</table>
+{{- if .ExecCommands}}
+<p>{{.ExecCommands}} exec command(s) run after every reload.</p>
+{{- end}}
+<h2>Recent reloads</h2>
+<table>
+<tr><th>Time</th><th>Reload ID</th><th>Directory</th><th>Changed keys</th><th>Webhook</th><th>Outcome</th></tr>
+{{- range .Recent}}
+<tr><td>{{.At.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.ID}}</td><td>{{.Dir}}</td><td>{{.Keys}}</td><td>{{.Webhook}}</td><td>{{if .Success}}success{{else}}failure: {{.Reason}}{{end}}</td></tr>
+{{- else}}
+<tr><td colspan="6">no reloads yet</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+type indexDir struct {
+	Dir     string
+	Watched bool
+}
+
+type indexWebhook struct {
+	URL      string
+	Method   string
+	Reloaded bool
+	Last     historyEntry
+}
+
+// indexHandler serves the web page linking to the metrics and, with
+// -web.reload-history, showing the watched directories, the last outcome of
+// every webhook and the most recent reloads.
+func indexHandler(metricsPath string, watches *watchSet, reloader *reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			MetricsPath  string
+			History      bool
+			Dirs         []indexDir
+			Webhooks     []indexWebhook
+			ExecCommands int
+			Recent       []historyEntry
+		}{MetricsPath: metricsPath, History: history != nil}
+		if history != nil {
+			data.Dirs = watches.status()
+			for _, h := range reloader.currentWebhooks() {
+				last, ok := history.lastOf(h)
+				data.Webhooks = append(data.Webhooks, indexWebhook{URL: h.display(), Method: h.httpMethod(), Reloaded: ok, Last: last})
+			}
+			data.ExecCommands = len(execCommands)
+			data.Recent = history.recent()
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := indexTemplate.Execute(w, data); err != nil {
+			log.Println("error: rendering the web page:", err)
+		}
+	}
+}
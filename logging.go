@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// logWriter writes the lines of the standard logger, which writes each line
+// with a single call to Write, so no buffering is needed. It drops the lines
+// below -log-level, and either prefixes them with the current time in a
+// configurable layout and zone or, with -log-format json, hands them to
+// jsonLogger.
+type logWriter struct {
+	out    io.Writer
+	layout string
+	utc    bool
+	level  slog.Level
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	level, msg := lineLevel(trimReloadPrefix(strings.TrimSuffix(string(p), "\n")))
+	if level < w.level {
+		return len(p), nil
+	}
+	if jsonLogger != nil {
+		jsonLogger.Log(context.Background(), level, msg)
+		return len(p), nil
+	}
+	now := time.Now()
+	if w.utc {
+		now = now.UTC()
+	}
+	if _, err := io.WriteString(w.out, now.Format(w.layout)+" "); err != nil {
+		return 0, err
+	}
+	return w.out.Write(p)
+}
+
+// lineLevel returns the level of a log line, which is error for lines
+// starting with "error: ", warn for lines starting with "warning: ", debug
+// for lines starting with "debug: " and info for all others, and the line
+// without that prefix.
+func lineLevel(line string) (slog.Level, string) {
+	if msg, ok := strings.CutPrefix(line, "error: "); ok {
+		return slog.LevelError, msg
+	}
+	if msg, ok := strings.CutPrefix(line, "warning: "); ok {
+		return slog.LevelWarn, msg
+	}
+	if msg, ok := strings.CutPrefix(line, "debug: "); ok {
+		return slog.LevelDebug, msg
+	}
+	return slog.LevelInfo, line
+}
+
+// trimReloadPrefix returns line without the bracketed reload ID and
+// directory that prefix the lines of a reload cycle with -log-format text.
+func trimReloadPrefix(line string) string {
+	for strings.HasPrefix(line, "[") {
+		i := strings.Index(line, "] ")
+		if i < 0 {
+			break
+		}
+		line = line[i+2:]
+	}
+	return line
+}
+
+// jsonLogger writes the log lines as JSON objects with -log-format json, and
+// is nil with -log-format text.
+var jsonLogger *slog.Logger
+
+// configureLogger sets up the standard logger according to the log format,
+// level, timestamp format and timezone flags.
+func configureLogger(logFormat, level, format, timezone string) error {
+	var utc bool
+	switch timezone {
+	case "local":
+	case "utc":
+		utc = true
+	default:
+		return fmt.Errorf("invalid log-timezone %q: must be one of local or utc", timezone)
+	}
+
+	var layout string
+	switch format {
+	case "default":
+		layout = "2006/01/02 15:04:05"
+	case "rfc3339":
+		layout = time.RFC3339
+	case "rfc3339nano":
+		layout = time.RFC3339Nano
+	default:
+		return fmt.Errorf("invalid log-timestamp-format %q: must be one of default, rfc3339 or rfc3339nano", format)
+	}
+
+	var minLevel slog.Level
+	switch level {
+	case "debug":
+		minLevel = slog.LevelDebug
+	case "info":
+		minLevel = slog.LevelInfo
+	case "warn":
+		minLevel = slog.LevelWarn
+	case "error":
+		minLevel = slog.LevelError
+	default:
+		return fmt.Errorf("invalid log-level %q: must be one of debug, info, warn or error", level)
+	}
+
+	switch logFormat {
+	case "text":
+	case "json":
+		jsonLogger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: minLevel,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if utc && len(groups) == 0 && a.Key == slog.TimeKey {
+					a.Value = slog.TimeValue(a.Value.Time().UTC())
+				}
+				return a
+			},
+		}))
+	default:
+		return fmt.Errorf("invalid log-format %q: must be one of text or json", logFormat)
+	}
+	log.SetFlags(0)
+	log.SetOutput(&logWriter{out: os.Stderr, layout: layout, utc: utc, level: minLevel})
+	return nil
+}
+
+// newReloadID returns a random ID correlating the log lines and metric
+// exemplars of one reload cycle, from the detection of a change to the
+// delivery of its reload.
+func newReloadID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// logf logs a line of the reload cycle of ev, prefixed with its reload ID
+// and, with -log-reload-dir, the directory that changed. With -log-format
+// json these are the reload_id and dir fields instead.
+func (ev reloadEvent) logf(format string, v ...interface{}) {
+	ev.log(fmt.Sprintf(format, v...))
+}
+
+// logln logs a line of the reload cycle of ev, prefixed like logf.
+func (ev reloadEvent) logln(v ...interface{}) {
+	ev.log(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (ev reloadEvent) log(line string) {
+	if jsonLogger == nil {
+		log.Print(ev.logPrefix() + line)
+		return
+	}
+	level, msg := lineLevel(line)
+	jsonLogger.LogAttrs(context.Background(), level, msg, ev.logAttrs()...)
+}
+
+func (ev reloadEvent) logAttrs() []slog.Attr {
+	var attrs []slog.Attr
+	if ev.id != "" {
+		attrs = append(attrs, slog.String("reload_id", ev.id))
+	}
+	if ev.dir != "" {
+		attrs = append(attrs, slog.String("dir", ev.dir))
+	}
+	return attrs
+}
+
+// logAttempt logs the outcome of a webhook request attempt as a single
+// webhook_attempt event with -log-format json, at debug level if it
+// succeeded and at warn level with the reason and error if it failed. With
+// -log-format text the attempt is logged in several lines by fire instead.
+func (ev reloadEvent) logAttempt(h *webhookTarget, attempt int, begun time.Time, statusCode int, reason string, err error) {
+	if jsonLogger == nil {
+		return
+	}
+	level := slog.LevelDebug
+	attrs := append(ev.logAttrs(),
+		slog.String("event", "webhook_attempt"),
+		slog.String("webhook", h.Redacted()),
+		slog.Int("attempt", attempt),
+		slog.Int64("duration_ms", time.Since(begun).Milliseconds()),
+	)
+	if statusCode != 0 {
+		attrs = append(attrs, slog.Int("status_code", statusCode))
+	}
+	if reason != "" {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("reason", reason))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	jsonLogger.LogAttrs(context.Background(), level, "webhook request attempt", attrs...)
+}
+
+func (ev reloadEvent) logPrefix() string {
+	var prefix string
+	if ev.id != "" {
+		prefix = "[" + ev.id + "] "
+	}
+	if *logReloadDir && ev.dir != "" {
+		prefix += "[" + ev.dir + "] "
+	}
+	return prefix
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+func TestLogWriterTimestamp(t *testing.T) {
+	local := time.FixedZone("test", 5*60*60)
+	oldLocal := time.Local
+	time.Local = local
+	t.Cleanup(func() { time.Local = oldLocal })
+
+	tests := []struct {
+		format, timezone string
+		want             *regexp.Regexp
+	}{
+		{"default", "local", regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d reloaded\n$`)},
+		{"rfc3339", "utc", regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ reloaded\n$`)},
+		{"rfc3339", "local", regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\+05:00 reloaded\n$`)},
+		{"rfc3339nano", "utc", regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(\.\d+)?Z reloaded\n$`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.timezone, func(t *testing.T) {
+			captureLog(t)
+			if err := configureLogger("text", "info", tt.format, tt.timezone); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			w := log.Writer().(*logWriter)
+			w.out = &out
+			w.Write([]byte("reloaded\n"))
+			if !tt.want.MatchString(out.String()) {
+				t.Errorf("logged %q, want it to match %s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureLoggerInvalid(t *testing.T) {
+	captureLog(t)
+	for _, args := range [][4]string{
+		{"xml", "info", "default", "local"},
+		{"text", "trace", "default", "local"},
+		{"text", "info", "unix", "local"},
+		{"text", "info", "default", "CET"},
+	} {
+		if err := configureLogger(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("configureLogger%q succeeded, want an error", args)
+		}
+	}
+}
+
+func TestReloadIDCorrelation(t *testing.T) {
+	tests := []struct {
+		format string
+		// id returns the reload ID of the logged line containing msg.
+		id func(t *testing.T, logs, msg string) string
+	}{
+		{"text", func(t *testing.T, logs, msg string) string {
+			m := regexp.MustCompile(`\[([0-9a-f]+)\] ` + regexp.QuoteMeta(msg)).FindStringSubmatch(logs)
+			if m == nil {
+				t.Fatalf("logged %q, want a line %q with a reload ID", logs, msg)
+			}
+			return m[1]
+		}},
+		{"json", func(t *testing.T, logs, msg string) string {
+			for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+				var entry struct {
+					Msg      string `json:"msg"`
+					ReloadID string `json:"reload_id"`
+				}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(entry.Msg, msg) {
+					return entry.ReloadID
+				}
+			}
+			t.Fatalf("logged %q, want a line %q", logs, msg)
+			return ""
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			logs := captureLog(t)
+			if tt.format == "json" {
+				setFlag(t, &jsonLogger, slog.New(slog.NewJSONHandler(logs, nil)))
+			}
+			dir := t.TempDir()
+			writeConfigMap(t, dir, "v1", map[string]string{"a": "1"})
+			targets, err := newWatchTargets([]string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeConfigMap(t, dir, "v2", map[string]string{"a": "2"})
+			ev, ok := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create})
+			if !ok {
+				t.Fatal("the update is not a change")
+			}
+			// As the event loop logs a detected change before dispatching it.
+			ev.logln("config map updated")
+			r := testReloader(&countingTransport{statuses: []int{200}}, mustParseWebhook(t, "http://app/-/reload"))
+			r.reloadWebhooks(context.Background(), ev)
+
+			detected := tt.id(t, logs.String(), "config map updated")
+			delivered := tt.id(t, logs.String(), "successfully triggered reload")
+			if detected == "" || detected != delivered {
+				t.Errorf("detection logged with reload ID %q, delivery with %q, want the same", detected, delivered)
+			}
+		})
+	}
+}
+
+func TestLogReloadDir(t *testing.T) {
+	setFlag(t, logReloadDir, true)
+	logs := captureLog(t)
+	h := mustParseWebhook(t, "http://webhook-log-dir/reload")
+	r := testReloader(&countingTransport{statuses: []int{200}}, h)
+	dirs := []string{"/config/app", "/config/sidecar"}
+	for _, dir := range dirs {
+		r.reloadWebhooks(context.Background(), reloadEvent{id: newReloadID(), dir: dir})
+	}
+	for _, dir := range dirs {
+		for _, msg := range []string{"performing webhook request", "successfully triggered reload"} {
+			if !regexp.MustCompile(`\[[0-9a-f]+\] \[` + regexp.QuoteMeta(dir) + `\] ` + msg).MatchString(logs.String()) {
+				t.Errorf("logged %q, want %q prefixed with [%s]", logs.String(), msg, dir)
+			}
+		}
+	}
+	// Lines of reloads without a directory, e.g. at startup, are not
+	// prefixed with one.
+	if got := (reloadEvent{id: "abc"}).logPrefix(); got != "[abc] " {
+		t.Errorf("prefixed a reload without a directory with %q", got)
+	}
+}
+
+func TestLogWriterLevel(t *testing.T) {
+	var out bytes.Buffer
+	w := &logWriter{out: &out, layout: time.RFC3339, level: slog.LevelWarn}
+	w.Write([]byte("debug: warmed\n"))
+	w.Write([]byte("[0123456789abcdef] reloaded\n"))
+	w.Write([]byte("warning: slow\n"))
+	w.Write([]byte("error: failed\n"))
+	if got := regexp.MustCompile(`(?m)^\S+ `).ReplaceAllString(out.String(), ""); got != "warning: slow\nerror: failed\n" {
+		t.Errorf("logged %q at -log-level warn", got)
+	}
+}
+
+func TestJSONWebhookAttempts(t *testing.T) {
+	logs := captureLog(t)
+	setFlag(t, &jsonLogger, slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	h := mustParseWebhook(t, "http://webhook-json-attempts/reload")
+	r := testReloader(&countingTransport{statuses: []int{503, 200}}, h)
+	r.settings.retries = 2
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+		t.Fatal(err)
+	}
+
+	type attempt struct {
+		Level      string `json:"level"`
+		Event      string `json:"event"`
+		Webhook    string `json:"webhook"`
+		Attempt    int    `json:"attempt"`
+		StatusCode int    `json:"status_code"`
+		Reason     string `json:"reason"`
+	}
+	var attempts []attempt
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var a attempt
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("logged %q, not a JSON object: %v", line, err)
+		}
+		if fields["event"] != "webhook_attempt" {
+			continue
+		}
+		if _, ok := fields["duration_ms"]; !ok {
+			t.Errorf("logged an attempt without duration_ms: %s", line)
+		}
+		json.Unmarshal([]byte(line), &a)
+		attempts = append(attempts, a)
+	}
+	want := []attempt{
+		{Level: "WARN", Event: "webhook_attempt", Webhook: "http://webhook-json-attempts/reload", Attempt: 1, StatusCode: 503, Reason: "client_response"},
+		{Level: "DEBUG", Event: "webhook_attempt", Webhook: "http://webhook-json-attempts/reload", Attempt: 2, StatusCode: 200},
+	}
+	if !slices.Equal(attempts, want) {
+		t.Errorf("logged the attempts %+v, want %+v", attempts, want)
+	}
+}
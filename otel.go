@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/jimmidyson/configmap-reload"
+
+// The tracer and instruments come from the global providers, which are
+// no-ops unless -otel-endpoint installs exporting ones.
+var (
+	tracer       trace.Tracer
+	otelReloads  metric.Int64Counter
+	otelAttempts metric.Int64Histogram
+)
+
+func init() {
+	useOTelProviders(otel.GetTracerProvider(), otel.GetMeterProvider())
+}
+
+// setOTelProviders installs tp and mp as the global providers and takes the
+// tracer and instruments from them.
+func setOTelProviders(tp trace.TracerProvider, mp metric.MeterProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	useOTelProviders(tp, mp)
+}
+
+func useOTelProviders(tp trace.TracerProvider, mp metric.MeterProvider) {
+	tracer = tp.Tracer(instrumentationName)
+	meter := mp.Meter(instrumentationName)
+	otelReloads, _ = meter.Int64Counter("configmap_reload.reloads", metric.WithDescription("Webhook reloads by outcome"))
+	otelAttempts, _ = meter.Int64Histogram("configmap_reload.reload.attempts", metric.WithDescription("Webhook request attempts per reload"))
+}
+
+// setupOTel installs OTLP/HTTP trace and metric exporters sending to
+// endpoint, a URL such as http://otel-collector:4318. The returned function
+// flushes and stops them.
+func setupOTel(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("configmap-reload"),
+	))
+	if err != nil {
+		return nil, err
+	}
+	traceExporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter), sdktrace.WithResource(res))
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)), sdkmetric.WithResource(res))
+	setOTelProviders(tp, mp)
+	return func(ctx context.Context) error {
+		if err := tp.Shutdown(ctx); err != nil {
+			return err
+		}
+		return mp.Shutdown(ctx)
+	}, nil
+}
+
+// reloadSpan traces a reload of one webhook, including its retries.
+type reloadSpan struct {
+	trace.Span
+	webhook  string
+	attempts int64
+	outcome  string
+}
+
+type reloadSpanKey struct{}
+
+func startReloadSpan(ctx context.Context, h *webhookTarget, ev reloadEvent) (context.Context, *reloadSpan) {
+	label := webhookLabel(h)
+	ctx, span := tracer.Start(ctx, "reload", trace.WithAttributes(
+		attribute.String("directory", ev.dir),
+		attribute.String("webhook", label),
+	))
+	s := &reloadSpan{Span: span, webhook: label, outcome: "cancelled"}
+	return context.WithValue(ctx, reloadSpanKey{}, s), s
+}
+
+// setOutcome records the final outcome of the reload traced in ctx, if any.
+func setOutcome(ctx context.Context, success bool, reason string) {
+	s, ok := ctx.Value(reloadSpanKey{}).(*reloadSpan)
+	if !ok {
+		return
+	}
+	if success {
+		s.outcome = "success"
+		return
+	}
+	s.outcome = "failure"
+	s.SetStatus(codes.Error, reason)
+	s.SetAttributes(attribute.String("reason", reason))
+}
+
+func (s *reloadSpan) attempt() {
+	s.attempts++
+	s.AddEvent("attempt", trace.WithTimestamp(time.Now()))
+}
+
+func (s *reloadSpan) end() {
+	s.SetAttributes(
+		attribute.String("outcome", s.outcome),
+		attribute.Int64("attempts", s.attempts),
+	)
+	s.End()
+	attrs := metric.WithAttributes(
+		attribute.String("webhook", s.webhook),
+		attribute.String("outcome", s.outcome),
+	)
+	ctx := context.Background()
+	otelReloads.Add(ctx, 1, attrs)
+	otelAttempts.Record(ctx, s.attempts, attrs)
+}
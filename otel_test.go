@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestReloadSpans(t *testing.T) {
+	// Each run records into fresh providers, so that the spans and metrics
+	// of earlier runs with -count are not seen.
+	oldTP, oldMP := otel.GetTracerProvider(), otel.GetMeterProvider()
+	t.Cleanup(func() { setOTelProviders(oldTP, oldMP) })
+	spans := tracetest.NewSpanRecorder()
+	metrics := sdkmetric.NewManualReader()
+	setOTelProviders(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)), sdkmetric.NewMeterProvider(sdkmetric.WithReader(metrics)))
+
+	ok := mustParseWebhook(t, "http://webhook-otel-ok/reload")
+	failing := mustParseWebhook(t, "http://webhook-otel-failing/reload")
+	r := testReloader(&countingTransport{statuses: []int{503, 200}}, ok)
+	r.settings.retries = 3
+	if err := r.fire(context.Background(), ok, reloadEvent{id: newReloadID(), dir: "/config"}); err != nil {
+		t.Fatal(err)
+	}
+	r = testReloader(&countingTransport{statuses: []int{500}}, failing)
+	if err := r.fire(context.Background(), failing, reloadEvent{id: newReloadID(), dir: "/config"}); err == nil {
+		t.Fatal("fire succeeded against a failing webhook")
+	}
+
+	ended := spans.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(ended))
+	}
+	for i, want := range []struct {
+		webhook  string
+		outcome  string
+		attempts int64
+		status   codes.Code
+	}{
+		{webhookLabel(ok), "success", 2, codes.Unset},
+		{webhookLabel(failing), "failure", 1, codes.Error},
+	} {
+		s := ended[i]
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range s.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if s.Name() != "reload" || attrs["directory"].AsString() != "/config" || attrs["webhook"].AsString() != want.webhook {
+			t.Errorf("span %d is %q with attributes %v", i, s.Name(), s.Attributes())
+		}
+		if attrs["outcome"].AsString() != want.outcome || attrs["attempts"].AsInt64() != want.attempts {
+			t.Errorf("span %d has outcome %s after %d attempts, want %s after %d", i, attrs["outcome"].AsString(), attrs["attempts"].AsInt64(), want.outcome, want.attempts)
+		}
+		if len(s.Events()) != int(want.attempts) {
+			t.Errorf("span %d has %d attempt events, want %d", i, len(s.Events()), want.attempts)
+		}
+		if s.Status().Code != want.status {
+			t.Errorf("span %d has status %v, want %v", i, s.Status().Code, want.status)
+		}
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := metrics.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	reloads := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "configmap_reload.reloads" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				outcome, _ := dp.Attributes.Value("outcome")
+				reloads[outcome.AsString()] += dp.Value
+			}
+		}
+	}
+	if reloads["success"] != 1 || reloads["failure"] != 1 {
+		t.Errorf("counted reloads %v, want one success and one failure", reloads)
+	}
+}
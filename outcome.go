@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// outcomeWriter echoes reload outcomes, one line each, to a local reader
+// such as a FIFO. Lines are queued and written by a separate goroutine and
+// are dropped rather than blocking reloads when nobody is reading.
+type outcomeWriter struct {
+	lines chan string
+}
+
+// outcomes is the destination of -outcome-fifo, or nil if it is not set.
+var outcomes *outcomeWriter
+
+func newOutcomeWriter(w io.Writer) *outcomeWriter {
+	o := &outcomeWriter{lines: make(chan string, 100)}
+	go func() {
+		for line := range o.lines {
+			if _, err := io.WriteString(w, line); err != nil {
+				log.Println("error: writing reload outcome:", err)
+			}
+		}
+	}()
+	return o
+}
+
+// report queues an outcome line for h, e.g.
+//
+//	2024-01-02T15:04:05Z http://localhost:9090/-/reload failure retries_exhausted
+func (o *outcomeWriter) report(h *webhookTarget, outcome, reason string) {
+	if o == nil {
+		return
+	}
+	line := fmt.Sprintf("%s %s %s", time.Now().UTC().Format(time.RFC3339), h.Redacted(), outcome)
+	if reason != "" {
+		line += " " + reason
+	}
+	select {
+	case o.lines <- line + "\n":
+	default:
+		log.Println("error: reload outcome queue full, dropping outcome for", h.Redacted())
+	}
+}
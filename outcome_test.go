@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestOutcomeWriterReport(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+	o := newOutcomeWriter(w)
+	h := mustParseWebhook(t, "http://user:secret@a/reload")
+	o.report(h, "failure", "retries_exhausted")
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ http://user:xxxxx@a/reload failure retries_exhausted\n$`)
+	if !want.MatchString(line) {
+		t.Errorf("got outcome line %q", line)
+	}
+}
+
+func TestOutcomeWriterDoesNotBlock(t *testing.T) {
+	// Nobody reads the pipe, so the writer is stuck on the first line.
+	r, w := io.Pipe()
+	defer r.Close()
+	o := newOutcomeWriter(w)
+	h := mustParseWebhook(t, "http://a/reload")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*cap(o.lines); i++ {
+			o.report(h, "success", "")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("report blocked on a reader that is not reading")
+	}
+}
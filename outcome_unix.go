@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openOutcomeFIFO opens the FIFO at path, creating it if needed. It is opened
+// for reading and writing so that opening does not block until a reader
+// appears. O_NONBLOCK lets Go's poller handle the file, but does not make
+// writes fail when the reader falls behind: the poller parks the writer
+// until the FIFO has room. Only the queue of the outcomeWriter keeps
+// reloads from blocking on a slow reader.
+func openOutcomeFIFO(path string) (*os.File, error) {
+	if err := syscall.Mkfifo(path, 0600); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR|syscall.O_NONBLOCK, 0)
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenOutcomeFIFO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outcomes")
+	// Opening does not wait for a reader.
+	f, err := openOutcomeFIFO(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("%s is not a FIFO: %v", path, err)
+	}
+
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	newOutcomeWriter(f).report(mustParseWebhook(t, "http://a/reload"), "success", "")
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(line, " http://a/reload success\n") {
+		t.Errorf("read outcome line %q", line)
+	}
+
+	// An existing FIFO is opened again.
+	again, err := openOutcomeFIFO(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.Close()
+}
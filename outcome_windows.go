@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openOutcomeFIFO(path string) (*os.File, error) {
+	return nil, errors.New("outcome-fifo is not supported on windows")
+}
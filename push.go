@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsPusher pushes the metrics to -pushgateway-url for reloaders that
+// are not around long enough to be scraped. Reloads request a push, which
+// is sent in the background so that a slow Pushgateway does not hold them
+// up; requests made while a push is pending are coalesced into it.
+type metricsPusher struct {
+	url, job string
+	// timeout is the time limit of a push.
+	timeout time.Duration
+	pending chan struct{}
+	// mu serializes pushes, as the one at shutdown may overlap with one
+	// requested by a reload.
+	mu sync.Mutex
+}
+
+func newMetricsPusher(url, job string, timeout time.Duration) *metricsPusher {
+	p := &metricsPusher{url: url, job: job, timeout: timeout, pending: make(chan struct{}, 1)}
+	go func() {
+		for range p.pending {
+			p.push()
+		}
+	}()
+	return p
+}
+
+// request schedules a push, unless one is pending already.
+func (p *metricsPusher) request() {
+	select {
+	case p.pending <- struct{}{}:
+	default:
+	}
+}
+
+// push pushes the current metrics right away. The metrics are grouped by the
+// host name, so that the pushes of several replicas do not replace each
+// other.
+func (p *metricsPusher) push() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pusher := push.New(p.url, p.job).Gatherer(registry).Client(&http.Client{Timeout: p.timeout})
+	if host, err := os.Hostname(); err == nil {
+		pusher = pusher.Grouping("instance", host)
+	}
+	if err := pusher.Push(); err != nil {
+		log.Println("error: pushing metrics:", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushMetrics(t *testing.T) {
+	type push struct {
+		method, path string
+		size         int
+	}
+	var (
+		mu     sync.Mutex
+		pushes []push
+	)
+	pushed := make(chan struct{}, 2)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pushes = append(pushes, push{r.Method, r.URL.Path, len(b)})
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		pushed <- struct{}{}
+	}))
+	defer gateway.Close()
+	captureLog(t)
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := mustParseWebhook(t, "http://webhook-push/reload")
+	r := testReloader(&countingTransport{statuses: []int{200}}, h)
+	r.pusher = newMetricsPusher(gateway.URL, "reloader", time.Second)
+	r.reloadAll(context.Background(), reloadEvent{id: newReloadID()})
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the metrics were not pushed after the reload")
+	}
+	// As at shutdown.
+	r.pusher.push()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pushes) != 2 {
+		t.Fatalf("pushed %d times, want after the reload and at shutdown", len(pushes))
+	}
+	for _, p := range pushes {
+		if p.method != http.MethodPut || p.path != "/metrics/job/reloader/instance/"+host {
+			t.Errorf("pushed with %s %s, want PUT to the job grouped by instance %s", p.method, p.path, host)
+		}
+		if p.size == 0 {
+			t.Error("pushed no metrics")
+		}
+	}
+}
+
+func TestPushMetricsHangingGateway(t *testing.T) {
+	release := make(chan struct{})
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer gateway.Close()
+	defer close(release)
+	logs := captureLog(t)
+
+	h := mustParseWebhook(t, "http://webhook-push-hang/reload")
+	rt := &countingTransport{statuses: []int{200}}
+	r := testReloader(rt, h)
+	const timeout = 200 * time.Millisecond
+	r.pusher = newMetricsPusher(gateway.URL, "reloader", timeout)
+
+	// Reloads complete while the Pushgateway does not respond.
+	begun := time.Now()
+	for i := 0; i < 3; i++ {
+		r.reloadAll(context.Background(), reloadEvent{id: newReloadID()})
+	}
+	if took := time.Since(begun); took >= timeout {
+		t.Errorf("3 reloads took %s, want them not to wait for the Pushgateway", took)
+	}
+	if got := rt.count(); got != 3 {
+		t.Errorf("sent %d reloads, want 3", got)
+	}
+
+	// The push at shutdown gives up after the timeout.
+	begun = time.Now()
+	r.pusher.push()
+	if took := time.Since(begun); took > 5*timeout {
+		t.Errorf("the push took %s, want it to give up after %s", took, timeout)
+	}
+	if !strings.Contains(logs.String(), "error: pushing metrics:") {
+		t.Errorf("logged %q, want the failed push", logs)
+	}
+}
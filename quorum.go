@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// quorumDirs holds the -reload-quorum-dir values.
+var quorumDirs stringsFlag
+
+// reloadQuorum holds back the changes of directories that must change
+// together, e.g. a config split across several mounts, until every one of
+// them changed within the window, and then releases all of them at once.
+type reloadQuorum struct {
+	dirs   []string
+	window time.Duration
+
+	changed map[string]time.Time
+	held    map[string]reloadEvent
+}
+
+// newReloadQuorum returns the quorum of dirs, or of all watched directories
+// if dirs is empty. Each of dirs must be a watched -volume-dir.
+func newReloadQuorum(targets watchTargets, dirs []string, window time.Duration) (*reloadQuorum, error) {
+	q := &reloadQuorum{window: window, changed: map[string]time.Time{}, held: map[string]reloadEvent{}}
+	if len(dirs) == 0 {
+		q.dirs = targets.dirs()
+		return q, nil
+	}
+	for _, d := range dirs {
+		dir := filepath.Clean(d)
+		if _, ok := targets[dir]; !ok {
+			return nil, fmt.Errorf("invalid reload-quorum-dir %q: not a watched volume-dir", d)
+		}
+		q.dirs = append(q.dirs, dir)
+	}
+	sort.Strings(q.dirs)
+	return q, nil
+}
+
+// requires reports whether dir is part of the quorum.
+func (q *reloadQuorum) requires(dir string) bool {
+	for _, d := range q.dirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// add holds the change ev of a quorum directory detected at now. Once every
+// directory of the quorum changed within the window it returns the held
+// changes, ordered by directory, and starts over. Changes older than the
+// window are dropped, as they need to change again to count.
+func (q *reloadQuorum) add(ev reloadEvent, now time.Time) []reloadEvent {
+	for dir, at := range q.changed {
+		if now.Sub(at) > q.window {
+			q.held[dir].logf("dropping change of %s: not all of the reload quorum changed within %s", dir, q.window)
+			delete(q.changed, dir)
+			delete(q.held, dir)
+		}
+	}
+	if prev, ok := q.held[ev.dir]; ok {
+		ev = mergeEvents(prev, ev)
+	}
+	q.held[ev.dir] = ev
+	q.changed[ev.dir] = now
+	if len(q.changed) < len(q.dirs) {
+		return nil
+	}
+	ready := make([]reloadEvent, 0, len(q.dirs))
+	for _, dir := range q.dirs {
+		ready = append(ready, q.held[dir])
+	}
+	q.changed = map[string]time.Time{}
+	q.held = map[string]reloadEvent{}
+	return ready
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReloadQuorum(t *testing.T) {
+	captureLog(t)
+	targets := watchTargets{"/a": {}, "/b": {}, "/c": {}}
+	start := time.Now()
+	tests := []struct {
+		name    string
+		changes []string
+		after   []time.Duration
+		want    []string
+	}{
+		{name: "both within the window", changes: []string{"/a", "/b"}, after: []time.Duration{0, time.Second}, want: []string{"/a", "/b"}},
+		{name: "in either order", changes: []string{"/b", "/a"}, after: []time.Duration{0, time.Second}, want: []string{"/a", "/b"}},
+		{name: "second after the window", changes: []string{"/a", "/b"}, after: []time.Duration{0, 3 * time.Second}},
+		{name: "first changed again", changes: []string{"/a", "/b", "/a"}, after: []time.Duration{0, 3 * time.Second, 4 * time.Second}, want: []string{"/a", "/b"}},
+		{name: "one dir twice", changes: []string{"/a", "/a"}, after: []time.Duration{0, time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := newReloadQuorum(targets, []string{"/a", "/b"}, 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ready []reloadEvent
+			for i, dir := range tt.changes {
+				if ready != nil {
+					t.Fatalf("released %v before the change of %s", ready, dir)
+				}
+				ready = q.add(reloadEvent{id: newReloadID(), dir: dir}, start.Add(tt.after[i]))
+			}
+			var got []string
+			for _, ev := range ready {
+				got = append(got, ev.dir)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("released %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewReloadQuorum(t *testing.T) {
+	targets := watchTargets{"/a": {}, "/b": {}}
+	q, err := newReloadQuorum(targets, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(q.dirs, []string{"/a", "/b"}) {
+		t.Errorf("quorum of %q, want all watched directories", q.dirs)
+	}
+	if _, err := newReloadQuorum(targets, []string{"/a", "/c"}, time.Second); err == nil {
+		t.Error("a directory that is not watched is accepted")
+	}
+	q, err = newReloadQuorum(targets, []string{"/b/"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.requires("/b") || q.requires("/a") {
+		t.Errorf("quorum of %q, want /b only", q.dirs)
+	}
+}
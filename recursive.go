@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+// addNestedTargets adds a target for every directory below the directory
+// volume dirs in w, with the detection rules of the volume dir it is in.
+func (w watchTargets) addNestedTargets() {
+	seen := w.realDirs()
+	for _, dir := range w.dirs() {
+		t := w[dir]
+		if !t.dataDir || t.nested {
+			continue
+		}
+		for _, sub := range subdirs(dir, seen) {
+			if _, ok := w[sub]; !ok {
+				w[sub] = t.nestedTarget(sub)
+			}
+		}
+	}
+}
+
+// nestedTarget returns the target of sub, a directory below the directory
+// of t.
+func (t *watchTarget) nestedTarget(sub string) *watchTarget {
+	return &watchTarget{
+		files:      map[string]bool{},
+		dataDir:    true,
+		dataTarget: readDataTarget(sub),
+		ops:        t.ops,
+		triggers:   t.triggers,
+		nested:     true,
+	}
+}
+
+// realDirs returns the set of the target directories with their symlinks
+// resolved.
+func (w watchTargets) realDirs() map[string]bool {
+	seen := map[string]bool{}
+	for dir := range w {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			seen[real] = true
+		}
+	}
+	return seen
+}
+
+// subdirs returns the directories below root. Symlinks to directories are
+// followed, but every real directory is visited once, recorded in seen, so
+// that symlink loops end. Entries starting with ".." are a ConfigMap's
+// internal bookkeeping and skipped, as are the symlinks of its nested keys
+// into them; a swap of "..data" covers their changes.
+func subdirs(root string, seen map[string]bool) []string {
+	var dirs []string
+	var walk func(top string)
+	walk = func(top string) {
+		filepath.WalkDir(top, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || path == top {
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), "..") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			symlink := d.Type()&fs.ModeSymlink != 0
+			if symlink {
+				if link, err := os.Readlink(path); err != nil || strings.HasPrefix(link, "..") {
+					return nil
+				}
+				if info, err := os.Stat(path); err != nil || !info.IsDir() {
+					return nil
+				}
+			} else if !d.IsDir() {
+				return nil
+			}
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil || seen[real] {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			seen[real] = true
+			dirs = append(dirs, path)
+			if symlink {
+				// WalkDir does not follow symlinks, not even its root
+				// unless given with a trailing separator.
+				walk(path + string(filepath.Separator))
+			}
+			return nil
+		})
+	}
+	walk(root)
+	return dirs
+}
+
+// followTree keeps the watches in line with the directories created and
+// removed below the watched directories with -recursive: a created
+// directory is watched along with the directories below it, and a removed
+// nested directory is no longer watched.
+func (s *watchSet) followTree(event fsnotify.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := filepath.Base(event.Name)
+	if strings.HasPrefix(name, "..") {
+		return
+	}
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		parent, ok := s.targets[filepath.Dir(event.Name)]
+		if !ok || !parent.dataDir {
+			return
+		}
+		if _, ok := s.targets[event.Name]; ok {
+			return
+		}
+		info, err := os.Stat(event.Name)
+		if err != nil || !info.IsDir() {
+			return
+		}
+		if link, err := os.Readlink(event.Name); err == nil && strings.HasPrefix(link, "..") {
+			return
+		}
+		seen := s.targets.realDirs()
+		real, err := filepath.EvalSymlinks(event.Name)
+		if err != nil || seen[real] {
+			return
+		}
+		seen[real] = true
+		for _, dir := range append([]string{event.Name}, subdirs(event.Name, seen)...) {
+			t := parent.nestedTarget(dir)
+			snapshot, _ := t.takeSnapshot(dir)
+			t.setSnapshot(dir, snapshot)
+			s.targets[dir] = t
+			if err := s.addLocked(dir); err != nil {
+				log.Println("error:", err)
+			}
+		}
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		if t, ok := s.targets[event.Name]; !ok || !t.nested {
+			return
+		}
+		for dir, t := range s.targets {
+			if !t.nested || (dir != event.Name && !strings.HasPrefix(dir, event.Name+string(filepath.Separator))) {
+				continue
+			}
+			log.Printf("No longer watching removed directory: %q", dir)
+			_ = s.watcher.Remove(dir)
+			s.unregister(dir)
+			delete(s.targets, dir)
+		}
+	}
+}
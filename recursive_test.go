@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+func TestSubdirs(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{"a/b", "..2024_01_01/nested", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(outside, "deep"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		// A loop back to the volume dir ends at it.
+		"a/b/loop": root,
+		// A directory outside the volume dir is followed into.
+		"ext": outside,
+		// A second link to an already seen directory is skipped.
+		"c/again": filepath.Join(root, "a"),
+		// A nested ConfigMap key into "..data" is covered by its swap.
+		"key": "..data/key",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(root, "a", "file"), "x")
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := subdirs(root, map[string]bool{realRoot: true})
+	for i, dir := range got {
+		got[i], _ = filepath.Rel(root, dir)
+	}
+	slices.Sort(got)
+	want := []string{"a", "a/b", "c", "ext", "ext/deep"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got subdirs %q, want %q", got, want)
+	}
+}
+
+func TestFollowTree(t *testing.T) {
+	setFlag(t, recursive, true)
+	captureLog(t)
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestWatchSet(t, dir)
+	watched := func(want ...string) {
+		t.Helper()
+		var got []string
+		for d := range s.targets {
+			if s.registered[d] {
+				rel, _ := filepath.Rel(dir, d)
+				got = append(got, rel)
+			}
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("watching %q, want %q", got, want)
+		}
+	}
+	watched(".", "sub")
+
+	created := filepath.Join(dir, "new")
+	if err := os.MkdirAll(filepath.Join(created, "deep"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s.followTree(fsnotify.Event{Name: created, Op: fsnotify.Create})
+	watched(".", "new", "new/deep", "sub")
+	if !s.targets[filepath.Join(created, "deep")].nested {
+		t.Error("a created directory is not marked nested")
+	}
+
+	// A ConfigMap's timestamped directory is not a nested directory.
+	hidden := filepath.Join(dir, "..2024_01_01")
+	if err := os.Mkdir(hidden, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s.followTree(fsnotify.Event{Name: hidden, Op: fsnotify.Create})
+	watched(".", "new", "new/deep", "sub")
+
+	if err := os.RemoveAll(created); err != nil {
+		t.Fatal(err)
+	}
+	s.followTree(fsnotify.Event{Name: created, Op: fsnotify.Remove})
+	watched(".", "sub")
+	if _, ok := s.targets[filepath.Join(created, "deep")]; ok {
+		t.Error("the target below a removed directory was kept")
+	}
+
+	// A removed volume dir is left to /rewatch.
+	s.followTree(fsnotify.Event{Name: dir, Op: fsnotify.Remove})
+	watched(".", "sub")
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// webhookRetryInterval is the wait between the attempts of a webhook
+// reload request.
+const webhookRetryInterval = 10 * time.Second
+
+// reloadSettings are how a reloader sends each webhook request.
+type reloadSettings struct {
+	// retries is the number of attempts as given with -webhook-retries: 0
+	// makes a single attempt and a negative number retries until the
+	// request succeeded.
+	retries       int
+	retryInterval time.Duration
+	// timeout is the time limit of each attempt, none if 0.
+	timeout time.Duration
+	// status is the response status code of a successful request, unless
+	// the webhook has its own.
+	status int
+}
+
+// flagReloadSettings returns the reload settings given with the -webhook-
+// flags.
+func flagReloadSettings() reloadSettings {
+	return reloadSettings{
+		retries:       *webhookRetries,
+		retryInterval: webhookRetryInterval,
+		timeout:       *webhookTimeout,
+		status:        *webhookStatusCode,
+	}
+}
+
+// attempts returns the number of attempts of each request, which is
+// negative for unlimited attempts. 0 is taken as a single attempt, rather
+// than none.
+func (s reloadSettings) attempts() int {
+	if s.retries == 0 {
+		return 1
+	}
+	return s.retries
+}
+
+// reloadEvent describes the change a reload is sent for.
+type reloadEvent struct {
+	// id correlates the log lines and metric exemplars of the reload cycle
+	// of the change.
+	id string
+	// dir is the watched directory that changed.
+	dir string
+	// keys are the names of the files in dir that were added, changed or
+	// removed.
+	keys []string
+	// key is set when a reload is sent for a single changed key, see
+	// -reload-per-key.
+	key string
+	// hash identifies the content of dir after the change.
+	hash string
+	// state identifies the content of all watched directories after the
+	// change.
+	state string
+	// diff is the diff of all changed keys and diffs holds the diff of
+	// each, when -webhook-body-diff is set.
+	diff  string
+	diffs map[string]string
+	// base is the content of dir before the change, when -webhook-body-diff
+	// is set, so that merged changes are diffed against it.
+	base dirSnapshot
+	// snapshot is the content of dir after the change, when
+	// -webhook-body-contents or -webhook-body-diff is set.
+	snapshot dirSnapshot
+	// empty is set when dir has no keys after the change, e.g. because all
+	// keys were removed from the ConfigMap.
+	empty bool
+	// unchanged is set when no key changed as -change-detection requires,
+	// e.g. only the content of a key changed with permissions.
+	unchanged bool
+	// queued is set when the reload is the retry of a failed reload from
+	// -failed-reload-requeue, which is sent as it was queued.
+	queued *queuedReload
+	// teardown is set for the request to a -teardown-webhook-url after dir
+	// vanished, which is not kept for /replay.
+	teardown bool
+}
+
+// idempotencyKey returns a key identifying the content state ev was sent
+// for, or an empty string if the content is not known.
+func (ev reloadEvent) idempotencyKey() string {
+	if ev.hash == "" {
+		return ""
+	}
+	if ev.key == "" {
+		return ev.hash
+	}
+	sum := sha256.Sum256([]byte(ev.hash + "/" + ev.key))
+	return hex.EncodeToString(sum[:])
+}
+
+// errRetriesExhausted is returned by fire when no attempt succeeded.
+var errRetriesExhausted = errors.New("webhook reload retries exhausted")
+
+// reloader sends reload requests to webhooks with httpClient, numbering
+// them with sequence and queueing the failed ones in failed, if set.
+type reloader struct {
+	httpClient *http.Client
+	settings   reloadSettings
+	// mu guards webhooks, which -webhook-url-file-watch replaces when the
+	// file changes.
+	mu       sync.RWMutex
+	webhooks []*webhookTarget
+
+	sequence *reloadSequence
+	failed   *reloadQueue
+	// verifier confirms that reloads took effect with -verify-metrics-url.
+	verifier *reloadVerifier
+	// pusher pushes the metrics after every reload with -pushgateway-url.
+	pusher *metricsPusher
+}
+
+// reloadAll sends the reload request to every configured webhook in turn,
+// then runs the -exec-command notifiers and requests a push of the metrics
+// to -pushgateway-url. With -reload-per-key a separate round of webhook
+// requests is sent for each changed key.
+// Webhooks that fail are added to the failed queue, if set, for a later
+// retry.
+func (r *reloader) reloadAll(ctx context.Context, ev reloadEvent) {
+	if r.pusher != nil {
+		defer r.pusher.request()
+	}
+	defer runExecCommands(ctx, ev)
+	verify := func() {}
+	if r.verifier != nil {
+		verify = r.verifier.baseline(ctx, ev)
+	}
+	if !*reloadPerKey || len(ev.keys) == 0 {
+		if r.reloadWebhooks(ctx, ev) {
+			verify()
+		}
+		return
+	}
+	ok := true
+	for _, key := range ev.keys {
+		keyEv := ev
+		keyEv.key = key
+		if !r.reloadWebhooks(ctx, keyEv) {
+			ok = false
+		}
+	}
+	if ok {
+		verify()
+	}
+}
+
+// reloadWebhooks sends the reload to the webhooks, up to
+// -webhook-concurrency of them at once, and returns once all of them
+// succeeded or failed. With -webhook-ordered they are called one at a time
+// in the order they were given and a failure stops the chain, so that e.g.
+// a drain webhook must succeed before the reload webhook after it is
+// called. Canary webhooks are called one at a time before all others, which
+// are only called once every canary succeeded. It reports whether every
+// webhook succeeded.
+func (r *reloader) reloadWebhooks(ctx context.Context, ev reloadEvent) bool {
+	deliver := func(h *webhookTarget) bool {
+		state := ev.state
+		if ev.key != "" && state != "" {
+			state += "/" + ev.key
+		}
+		if *webhookDedupe && delivered.seen(h, state) {
+			ev.logf("skipping reload of %s: already reloaded for this content", h.Redacted())
+			return true
+		}
+		seq, done := r.failed.begin(h)
+		defer done()
+		if r.fire(ctx, h, ev) == nil {
+			delivered.record(h, state)
+			r.failed.remove(h, ev.key, seq)
+			return true
+		}
+		if ctx.Err() == nil {
+			r.failed.add(h, ev, seq)
+		}
+		return false
+	}
+
+	var canaries, rest []*webhookTarget
+	for _, h := range r.currentWebhooks() {
+		if h.canary {
+			canaries = append(canaries, h)
+		} else {
+			rest = append(rest, h)
+		}
+	}
+	for _, h := range canaries {
+		if ctx.Err() != nil {
+			return false
+		}
+		if !deliver(h) {
+			canaryReloads.WithLabelValues(webhookLabel(h), "failure").Inc()
+			ev.logf("error: canary reload of %s failed, skipping the %d other webhook(s)", h.Redacted(), len(rest))
+			return false
+		}
+		canaryReloads.WithLabelValues(webhookLabel(h), "success").Inc()
+	}
+
+	if *webhookOrdered {
+		for i, h := range rest {
+			if ctx.Err() != nil {
+				return false
+			}
+			if deliver(h) {
+				continue
+			}
+			if skipped := len(rest) - i - 1; skipped > 0 {
+				ev.logf("error: reload of %s failed, skipping the %d webhook(s) after it", h.Redacted(), skipped)
+			}
+			return false
+		}
+		return true
+	}
+
+	concurrency := *webhookConcurrency
+	if concurrency <= 0 || concurrency > len(rest) {
+		concurrency = len(rest)
+	}
+	slots := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	var failures int32
+	for _, h := range rest {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(h *webhookTarget) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if !deliver(h) {
+				atomic.AddInt32(&failures, 1)
+			}
+		}(h)
+	}
+	wg.Wait()
+	n := atomic.LoadInt32(&failures)
+	if n > 0 && ctx.Err() == nil && len(rest) > 1 {
+		ev.logf("error: %d of %d webhook(s) failed to reload", n, len(rest))
+	}
+	return n == 0 && ctx.Err() == nil
+}
+
+// fire sends the reload request for ev to h, retrying as configured, and
+// returns an error if it did not succeed. Retries stop early if ctx is
+// cancelled, which happens when a newer change supersedes this reload.
+func (r *reloader) fire(ctx context.Context, h *webhookTarget, ev reloadEvent) error {
+	begun := time.Now()
+	label := webhookLabel(h)
+	ctx, span := startReloadSpan(ctx, h, ev)
+	defer span.end()
+
+	header, body, err := ev.request()
+	if err != nil {
+		setFailureMetrics(label, "client_request_create", ev.id)
+		recordOutcome(ctx, h, ev, false, "client_request_create")
+		ev.logln("error:", err)
+		return err
+	}
+	// The request is kept for /replay without its sequence number.
+	reloadHeader := header.Clone()
+	// A dry run sends nothing, so it must not use up a sequence number.
+	if *webhookSeqHeader && !*dryRun {
+		seq, err := r.sequence.next(h)
+		if err != nil {
+			ev.logln("error: persisting reload sequence:", err)
+		}
+		header.Set("X-Reload-Seq", strconv.FormatUint(seq, 10))
+	}
+
+	attempts := r.settings.attempts()
+
+	// With -webhook-first-failure-grace the failure of the first attempt
+	// is only counted once the retry after it failed as well, as some
+	// endpoints fail the first call after their own restart.
+	attempt := 0
+	graced := ""
+	countGraced := func() {
+		if graced != "" {
+			setFailureMetrics(label, graced, ev.id)
+			graced = ""
+		}
+	}
+	retries := attempts
+	// retryAfter records a failed attempt and waits before the next one, if
+	// any. It reports false if the reload was cancelled meanwhile.
+	retryAfter := func(reason string) bool {
+		retryAttempts.WithLabelValues(label, "failure").Inc()
+		wait := r.settings.retryInterval
+		if attempt == 1 && *webhookFirstFailGrace > 0 && (attempts < 0 || attempts > 1) {
+			graced = reason
+			wait = *webhookFirstFailGrace
+		} else {
+			countGraced()
+			setFailureMetrics(label, reason, ev.id)
+		}
+		if retries == 1 {
+			return true
+		}
+		if !sleepContext(ctx, wait) {
+			ev.logf("reload of %s cancelled: superseded by a newer change", h.Redacted())
+			return false
+		}
+		return true
+	}
+
+	for ; retries != 0; retries-- {
+		attempt++
+		// The request is built for every attempt as its body is consumed
+		// by each send.
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if r.settings.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, r.settings.timeout)
+		}
+		req, err := newWebhookRequest(attemptCtx, h, header, body)
+		if err != nil {
+			cancel()
+			countGraced()
+			setFailureMetrics(label, "client_request_create", ev.id)
+			recordOutcome(ctx, h, ev, false, "client_request_create")
+			ev.logln("error:", err)
+			return err
+		}
+		if *dryRun {
+			cancel()
+			dryRunTriggers.WithLabelValues(label).Inc()
+			ev.logf("dry run: would send %s %s with headers %s", req.Method, h.Redacted(), redactHeaders(req.Header))
+			return nil
+		}
+		if jsonLogger == nil {
+			ev.logf("performing webhook request (%d/%d/%s)", retries, attempts, req.URL)
+		}
+		requestsByMethod.WithLabelValues(label, methodLabel(req.Method)).Inc()
+		span.attempt()
+		attemptBegun := time.Now()
+		resp, err := h.httpClient(r.httpClient).Do(req)
+		if resp != nil {
+			drainBody(resp.Body)
+		}
+		timedOut := ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if ctx.Err() == nil {
+			requestDurations.WithLabelValues(label).Observe(time.Since(attemptBegun).Seconds())
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				ev.logf("reload of %s cancelled: superseded by a newer change", req.URL)
+				return ctx.Err()
+			}
+			reason := "client_request_do"
+			if timedOut {
+				reason = "client_timeout"
+			} else if isResponseDeadline(err) {
+				reason = "response_deadline"
+			}
+			if jsonLogger == nil {
+				ev.logln("error:", err)
+			}
+			ev.logAttempt(h, attempt, attemptBegun, 0, reason, err)
+			if !retryAfter(reason) {
+				return ctx.Err()
+			}
+			continue
+		}
+		requestsByStatusCode.WithLabelValues(label, strconv.Itoa(resp.StatusCode)).Inc()
+		if want := h.successStatus(r.settings.status); resp.StatusCode != want {
+			err := fmt.Errorf("received response code %d, expected %d", resp.StatusCode, want)
+			if loc := resp.Header.Get("Location"); loc != "" {
+				err = fmt.Errorf("%v: redirected to %s", err, loc)
+			}
+			if jsonLogger == nil {
+				ev.logln("error:", "Received response code", resp.StatusCode, ", expected", want, "from", h.Redacted())
+				if loc := resp.Header.Get("Location"); loc != "" {
+					ev.logln("error: webhook", h.Redacted(), "redirected to", loc)
+				}
+			}
+			ev.logAttempt(h, attempt, attemptBegun, resp.StatusCode, "client_response", err)
+			if !retryAfter("client_response") {
+				return ctx.Err()
+			}
+			continue
+		}
+		if name := *webhookRequireHeader; name != "" && resp.Header.Get(name) == "" {
+			if jsonLogger == nil {
+				ev.logln("error:", "Response lacks required header", name, "from", h.Redacted())
+			}
+			ev.logAttempt(h, attempt, attemptBegun, resp.StatusCode, "missing_response_header", fmt.Errorf("response lacks required header %s", name))
+			if !retryAfter("missing_response_header") {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if graced != "" {
+			ev.logf("not counting the failed first attempt (%s): the retry after -webhook-first-failure-grace succeeded", graced)
+		}
+		ev.logAttempt(h, attempt, attemptBegun, resp.StatusCode, "", nil)
+		retryAttempts.WithLabelValues(label, "success").Inc()
+		setSuccessMetrics(label, begun, ev.id)
+		if !ev.teardown {
+			replays.record(h, reloadHeader, body)
+		}
+		recordOutcome(ctx, h, ev, true, "")
+		ev.logln("successfully triggered reload of", h.Redacted())
+		return nil
+	}
+
+	countGraced()
+	setFailureMetrics(label, "retries_exhausted", ev.id)
+	recordOutcome(ctx, h, ev, false, "retries_exhausted")
+	ev.logln("error:", "Webhook reload retries exhausted for", h.Redacted())
+	return errRetriesExhausted
+}
+
+// request returns the headers and body of the reload request for ev, which
+// are the same for every webhook, or those it was queued with if it is the
+// retry of a failed reload.
+func (ev reloadEvent) request() (http.Header, []byte, error) {
+	if ev.queued != nil {
+		header := ev.queued.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		return header, ev.queued.Body, nil
+	}
+	header := http.Header{}
+	if key := ev.idempotencyKey(); *webhookIdempotencyKey && key != "" {
+		header.Set("Idempotency-Key", key)
+	}
+	if ev.empty {
+		header.Set("X-Reload-Empty", "true")
+	}
+	body, contentType, err := requestBody(ev)
+	if err != nil {
+		return nil, nil, err
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return header, body, nil
+}
+
+// sensitiveHeaders are the headers whose values redactHeaders hides.
+var sensitiveHeaders = map[string]bool{"Authorization": true, "Proxy-Authorization": true, "Cookie": true}
+
+// redactHeaders formats header for logging, in the order of the names, with
+// the values of credential headers replaced by "xxxxx".
+func redactHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		for j, v := range header[name] {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			if sensitiveHeaders[name] {
+				v = "xxxxx"
+			}
+			b.WriteString(name + ": " + v)
+		}
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// maxDrainBytes is how much of a response body drainBody reads at most. An
+// endpoint sending more loses its connection instead of tying up the reload.
+const maxDrainBytes = 256 << 10
+
+// drainBody reads what is left of a response body and closes it, so that
+// its keep-alive connection can be reused by the next request.
+func drainBody(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrainBytes))
+	body.Close()
+}
+
+func newWebhookRequest(ctx context.Context, h *webhookTarget, header http.Header, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, h.httpMethod(), h.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// The webhook's own headers take precedence over -webhook-header, which
+	// takes precedence over -webhook-env-header.
+	hdrs := append(append([]webhookHeader{}, envHeaders...), webhookHeaders...)
+	for _, hdr := range append(hdrs, h.headers...) {
+		v, err := hdr.resolve()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(hdr.name, v)
+	}
+	if body != nil && *webhookExpectContinue > 0 {
+		// Let the endpoint reject the request before the body is sent.
+		req.Header.Set("Expect", "100-continue")
+	}
+	userInfo := h.User
+	if userInfo != nil {
+		if password, passwordSet := userInfo.Password(); passwordSet {
+			req.SetBasicAuth(userInfo.Username(), password)
+		}
+	}
+	return req, nil
+}
+
+// requestBody returns the body and content type to send for ev. With
+// -webhook-body-contents a reload for a single key carries its content, and
+// with -webhook-body-keys a reload carries the names of the changed keys. A
+// reload for a single key otherwise carries the key, and its diff with
+// -webhook-body-diff, as JSON. Otherwise the body is the diff of all changed
+// keys with -webhook-body-diff, the -webhook-body or -webhook-body-file
+// payload, or empty. The body is sent whatever the -webhook-method, e.g. for
+// APIs that expect a DELETE with a body to invalidate caches.
+func requestBody(ev reloadEvent) ([]byte, string, error) {
+	if *webhookBodyContents {
+		if body, contentType, ok, err := contentsBody(ev); ok || err != nil {
+			return body, contentType, err
+		}
+	}
+	if *webhookBodyKeys {
+		keys := ev.keys
+		if ev.key != "" {
+			keys = []string{ev.key}
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+		body, err := json.Marshal(keys)
+		return body, "application/json", err
+	}
+	if ev.key != "" {
+		body, err := json.Marshal(struct {
+			Directory string `json:"directory"`
+			Key       string `json:"key"`
+			Diff      string `json:"diff,omitempty"`
+		}{ev.dir, ev.key, ev.diffs[ev.key]})
+		return body, "application/json", err
+	}
+	if *webhookBodyDiff && ev.diff != "" {
+		return []byte(ev.diff), "text/x-diff; charset=utf-8", nil
+	}
+	if *webhookBody != "" {
+		return []byte(*webhookBody), *webhookContentType, nil
+	}
+	if *webhookBodyFile != "" {
+		// Re-read for every reload, so that another process can render
+		// the payload.
+		body, err := os.ReadFile(*webhookBodyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading webhook body: %v", err)
+		}
+		return body, *webhookContentType, nil
+	}
+	return nil, "", nil
+}
+
+// contentsBody returns the content of the single key ev is for as the body,
+// with the -webhook-content-type if given and the detected type otherwise.
+// It reports false if ev is not for exactly one key that still exists.
+func contentsBody(ev reloadEvent) ([]byte, string, bool, error) {
+	key := ev.key
+	if key == "" && len(ev.keys) == 1 {
+		key = ev.keys[0]
+	}
+	e, ok := ev.snapshot[key]
+	if key == "" || !ok {
+		return nil, "", false, nil
+	}
+	if e.unread {
+		return nil, "", false, fmt.Errorf("content of %s was not read because of -snapshot-max-files or -snapshot-max-file-bytes", key)
+	}
+	if len(e.data) > *webhookBodyContentsMax {
+		return nil, "", false, fmt.Errorf("content of %s is %d bytes, more than -webhook-body-contents-max-bytes", key, len(e.data))
+	}
+	contentType := sniffContentType(e.data)
+	if isFlagSet("webhook-content-type") {
+		contentType = *webhookContentType
+	}
+	return e.data, contentType, true, nil
+}
+
+// isFlagSet reports whether the flag name was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// sleepContext waits for d and reports whether it elapsed before ctx was done.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
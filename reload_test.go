@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// countingTransport answers each request with the next of statuses, the last
+// one once they are used up, and counts the requests.
+type countingTransport struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		body = string(b)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	c.bodies = append(c.bodies, body)
+	status := c.statuses[min(len(c.requests), len(c.statuses))-1]
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func (c *countingTransport) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.requests)
+}
+
+// blockingTransport fails every request once its context is done, as a
+// webhook that never responds does.
+type blockingTransport struct{ calls int }
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.calls++
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+// testReloader returns a reloader sending its requests with rt, a single
+// attempt each without waiting between retries.
+func testReloader(rt http.RoundTripper, webhooks ...*webhookTarget) *reloader {
+	return &reloader{
+		httpClient: &http.Client{Transport: rt},
+		settings:   reloadSettings{status: http.StatusOK},
+		webhooks:   webhooks,
+	}
+}
+
+// counterDelta returns a function reporting how much c grew since
+// counterDelta was called, so that the assertions on the package's metrics
+// hold when the tests run again with -count.
+func counterDelta(c prometheus.Collector) func() float64 {
+	before := testutil.ToFloat64(c)
+	return func() float64 { return testutil.ToFloat64(c) - before }
+}
+
+func TestFireRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		statuses []int
+		option   string
+		wantDo   int
+		wantErr  bool
+	}{
+		{name: "unlimited", retries: -1, statuses: []int{503, 503, 503, 200}, wantDo: 4},
+		{name: "zero is a single attempt", retries: 0, statuses: []int{503}, wantDo: 1, wantErr: true},
+		{name: "single attempt", retries: 1, statuses: []int{503}, wantDo: 1, wantErr: true},
+		{name: "exhausted", retries: 3, statuses: []int{503}, wantDo: 3, wantErr: true},
+		{name: "retry succeeds", retries: 3, statuses: []int{500, 200}, wantDo: 2},
+		{name: "first attempt succeeds", retries: 3, statuses: []int{200}, wantDo: 1},
+		{name: "webhook status", retries: 2, statuses: []int{200, 202}, option: ";status=202", wantDo: 2},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each case has its own webhook so that its metrics are its own.
+			h := mustParseWebhook(t, "http://webhook-"+strconv.Itoa(i)+"/reload"+tt.option)
+			label := webhookLabel(h)
+			rt := &countingTransport{statuses: tt.statuses}
+			r := testReloader(rt, h)
+			r.settings.retries = tt.retries
+			byStatusDelta := map[int]func() float64{}
+			for _, status := range tt.statuses {
+				byStatusDelta[status] = counterDelta(requestsByStatusCode.WithLabelValues(label, strconv.Itoa(status)))
+			}
+			failed := counterDelta(retryAttempts.WithLabelValues(label, "failure"))
+			succeeded := counterDelta(retryAttempts.WithLabelValues(label, "success"))
+
+			err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("fire returned %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, errRetriesExhausted) {
+				t.Errorf("fire returned %v, want %v", err, errRetriesExhausted)
+			}
+			if got := rt.count(); got != tt.wantDo {
+				t.Errorf("sent %d requests, want %d", got, tt.wantDo)
+			}
+
+			byStatus := map[int]float64{}
+			for n := 0; n < tt.wantDo; n++ {
+				byStatus[tt.statuses[min(n, len(tt.statuses)-1)]]++
+			}
+			for status, want := range byStatus {
+				if got := byStatusDelta[status](); got != want {
+					t.Errorf("requests_total{status_code=%q} grew by %g, want %g", strconv.Itoa(status), got, want)
+				}
+			}
+			failures, successes := float64(tt.wantDo), 0.0
+			if !tt.wantErr {
+				failures, successes = failures-1, 1
+			}
+			if got := failed(); got != failures {
+				t.Errorf("retry_attempts_total{outcome=\"failure\"} grew by %g, want %g", got, failures)
+			}
+			if got := succeeded(); got != successes {
+				t.Errorf("retry_attempts_total{outcome=\"success\"} grew by %g, want %g", got, successes)
+			}
+		})
+	}
+}
+
+func TestFireTimeout(t *testing.T) {
+	h := mustParseWebhook(t, "http://webhook-timeout/reload")
+	rt := &blockingTransport{}
+	r := testReloader(rt, h)
+	r.settings.retries = 2
+	r.settings.timeout = 10 * time.Millisecond
+	timeouts := counterDelta(requestErrorsByReason.WithLabelValues(webhookLabel(h), "client_timeout"))
+	requestErrors := counterDelta(requestErrorsByReason.WithLabelValues(webhookLabel(h), "client_request_do"))
+
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); !errors.Is(err, errRetriesExhausted) {
+		t.Fatalf("fire returned %v, want %v", err, errRetriesExhausted)
+	}
+	if rt.calls != 2 {
+		t.Errorf("sent %d requests, want 2", rt.calls)
+	}
+	if got := timeouts(); got != 2 {
+		t.Errorf("request_errors_total{reason=\"client_timeout\"} grew by %g, want 2", got)
+	}
+	if got := requestErrors(); got != 0 {
+		t.Errorf("request_errors_total{reason=\"client_request_do\"} grew by %g, want the timeouts counted apart", got)
+	}
+
+	// A reload cancelled by a newer change is not a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	r.settings.timeout = time.Minute
+	if err := r.fire(ctx, h, reloadEvent{id: newReloadID()}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("fire returned %v, want %v", err, context.Canceled)
+	}
+	if got := timeouts(); got != 2 {
+		t.Errorf("request_errors_total{reason=\"client_timeout\"} grew by %g after a cancelled reload, want 2", got)
+	}
+}
+
+func TestRequestDurations(t *testing.T) {
+	tests := []struct {
+		name    string
+		rt      http.RoundTripper
+		retries int
+		timeout time.Duration
+		cancel  bool
+		dryRun  bool
+		want    uint64
+	}{
+		{name: "success", rt: &countingTransport{statuses: []int{200}}, want: 1},
+		{name: "retried", rt: &countingTransport{statuses: []int{500, 503, 200}}, retries: 3, want: 3},
+		{name: "exhausted", rt: &countingTransport{statuses: []int{500}}, retries: 2, want: 2},
+		{name: "timeout", rt: &blockingTransport{}, retries: 2, timeout: 10 * time.Millisecond, want: 2},
+		{name: "cancelled", rt: &blockingTransport{}, cancel: true, want: 0},
+		{name: "dry run", rt: &countingTransport{statuses: []int{200}}, dryRun: true, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			setFlag(t, dryRun, tt.dryRun)
+			h := mustParseWebhook(t, "http://webhook-durations-"+strings.ReplaceAll(tt.name, " ", "-")+"/reload")
+			r := testReloader(tt.rt, h)
+			r.settings.retries = tt.retries
+			r.settings.timeout = tt.timeout
+			ctx := context.Background()
+			if tt.cancel {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			observed := func() uint64 {
+				var m dto.Metric
+				if err := requestDurations.WithLabelValues(webhookLabel(h)).(prometheus.Histogram).Write(&m); err != nil {
+					t.Fatal(err)
+				}
+				return m.GetHistogram().GetSampleCount()
+			}
+			before := observed()
+			r.fire(ctx, h, reloadEvent{id: newReloadID()})
+
+			if got := observed() - before; got != tt.want {
+				t.Errorf("request_duration_seconds observed %d attempts, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFireCancelled(t *testing.T) {
+	h := mustParseWebhook(t, "http://webhook-cancelled/reload")
+	rt := &countingTransport{statuses: []int{503}}
+	r := testReloader(rt, h)
+	r.settings.retries = -1
+	r.settings.retryInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := r.fire(ctx, h, reloadEvent{id: newReloadID()}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("fire returned %v, want %v", err, context.Canceled)
+	}
+	if got := rt.count(); got != 1 {
+		t.Errorf("sent %d requests, want 1 before the cancellation", got)
+	}
+}
+
+func TestFireSequenceSkipsDryRun(t *testing.T) {
+	setFlag(t, webhookSeqHeader, true)
+	sequence, err := newReloadSequence("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mustParseWebhook(t, "http://webhook-seq/reload")
+	rt := &countingTransport{statuses: []int{200}}
+	r := testReloader(rt, h)
+	r.sequence = sequence
+
+	setFlag(t, dryRun, true)
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+		t.Fatal(err)
+	}
+	*dryRun = false
+	for want := 1; want <= 2; want++ {
+		if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+			t.Fatal(err)
+		}
+		if got := rt.requests[want-1].Header.Get("X-Reload-Seq"); got != strconv.Itoa(want) {
+			t.Errorf("reload %d sent X-Reload-Seq %q, want %d", want, got, want)
+		}
+	}
+	if got := rt.count(); got != 2 {
+		t.Errorf("sent %d requests, want 2 after the dry run", got)
+	}
+}
+
+func TestFireSequenceHeader(t *testing.T) {
+	setFlag(t, webhookSeqHeader, true)
+	sequence, err := newReloadSequence("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mustParseWebhook(t, "http://webhook-seq-a/reload")
+	b := mustParseWebhook(t, "http://webhook-seq-b/reload")
+	rt := &countingTransport{statuses: []int{500, 200}}
+	r := testReloader(rt, a, b)
+	r.sequence = sequence
+	r.settings.retries = 2
+
+	// The retry of a failed attempt carries the number of the reload it
+	// retries, and b is numbered on its own.
+	for _, h := range []*webhookTarget{a, a, b} {
+		if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for _, req := range rt.requests {
+		got = append(got, req.URL.Host+"="+req.Header.Get("X-Reload-Seq"))
+	}
+	want := []string{"webhook-seq-a=1", "webhook-seq-a=1", "webhook-seq-a=2", "webhook-seq-b=1"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestFireMethodLabel(t *testing.T) {
+	tests := []struct {
+		webhook    string
+		wantMethod string
+		wantLabel  string
+	}{
+		{webhook: "http://webhook-method-default/reload", wantMethod: http.MethodPost, wantLabel: "POST"},
+		{webhook: "http://webhook-method-put/reload;method=PUT", wantMethod: http.MethodPut, wantLabel: "PUT"},
+		// Non-standard methods share a label to bound the cardinality.
+		{webhook: "http://webhook-method-purge/reload;method=PURGE", wantMethod: "PURGE", wantLabel: "OTHER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantMethod, func(t *testing.T) {
+			h := mustParseWebhook(t, tt.webhook)
+			rt := &countingTransport{statuses: []int{200}}
+			r := testReloader(rt, h)
+			requests := counterDelta(requestsByMethod.WithLabelValues(webhookLabel(h), tt.wantLabel))
+			if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+				t.Fatal(err)
+			}
+			if got := rt.requests[0].Method; got != tt.wantMethod {
+				t.Errorf("sent %s, want %s", got, tt.wantMethod)
+			}
+			if got := requests(); got != 1 {
+				t.Errorf("requests_by_method_total{method=%q} grew by %g, want 1", tt.wantLabel, got)
+			}
+		})
+	}
+}
+
+func TestReloadPerKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		perKey   bool
+		wantBody []string
+	}{
+		{name: "once", perKey: false, wantBody: []string{""}},
+		{name: "per key", perKey: true, wantBody: []string{
+			`{"directory":"/config","key":"a.yaml"}`,
+			`{"directory":"/config","key":"b.yaml"}`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, reloadPerKey, tt.perKey)
+			h := mustParseWebhook(t, "http://webhook-per-key/reload")
+			rt := &countingTransport{statuses: []int{200}}
+			r := testReloader(rt, h)
+
+			r.reloadAll(context.Background(), reloadEvent{id: newReloadID(), dir: "/config", keys: []string{"a.yaml", "b.yaml"}})
+			if strings.Join(rt.bodies, "\n") != strings.Join(tt.wantBody, "\n") {
+				t.Errorf("sent bodies %q, want %q", rt.bodies, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestFireIdempotencyKey(t *testing.T) {
+	setFlag(t, webhookIdempotencyKey, true)
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"a": "1"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfigMap(t, dir, "v2", map[string]string{"a": "2"})
+	ev, ok := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create})
+	if !ok {
+		t.Fatal("the ..data swap is not a change")
+	}
+	snapshot, err := takeSnapshot(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.hash != snapshot.hash() {
+		t.Fatalf("reload for content hash %q, want %q", ev.hash, snapshot.hash())
+	}
+
+	h := mustParseWebhook(t, "http://webhook-idempotency/reload")
+	rt := &countingTransport{statuses: []int{503, 200}}
+	r := testReloader(rt, h)
+	r.settings.retries = 2
+	if err := r.fire(context.Background(), h, ev); err != nil {
+		t.Fatal(err)
+	}
+	if rt.count() != 2 {
+		t.Fatalf("sent %d requests, want 2", rt.count())
+	}
+	// The retry carries the same key, so that the target can tell it is a
+	// duplicate of a delivery that only appeared to fail.
+	for i, req := range rt.requests {
+		if got := req.Header.Get("Idempotency-Key"); got != snapshot.hash() {
+			t.Errorf("attempt %d sent Idempotency-Key %q, want %q", i+1, got, snapshot.hash())
+		}
+	}
+
+	// A reload without known content has no key.
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rt.requests[2].Header.Get("Idempotency-Key"); got != "" {
+		t.Errorf("reload without content sent Idempotency-Key %q", got)
+	}
+}
+
+func TestReloadWebhooksOrdered(t *testing.T) {
+	setFlag(t, webhookOrdered, true)
+	tests := []struct {
+		name     string
+		statuses []int
+		wantOK   bool
+		wantSent []string
+	}{
+		{name: "all succeed", statuses: []int{200}, wantOK: true, wantSent: []string{"drain", "reload", "undrain"}},
+		{name: "failure stops the chain", statuses: []int{200, 500}, wantSent: []string{"drain", "reload"}},
+		{name: "first fails", statuses: []int{500}, wantSent: []string{"drain"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &countingTransport{statuses: tt.statuses}
+			r := testReloader(rt,
+				mustParseWebhook(t, "http://drain/"),
+				mustParseWebhook(t, "http://reload/"),
+				mustParseWebhook(t, "http://undrain/"),
+			)
+			if ok := r.reloadWebhooks(context.Background(), reloadEvent{id: newReloadID()}); ok != tt.wantOK {
+				t.Errorf("reloadWebhooks reported success: %v, want %v", ok, tt.wantOK)
+			}
+			var sent []string
+			for _, req := range rt.requests {
+				sent = append(sent, req.URL.Host)
+			}
+			if strings.Join(sent, " ") != strings.Join(tt.wantSent, " ") {
+				t.Errorf("called %q, want %q", sent, tt.wantSent)
+			}
+		})
+	}
+}
+
+// gatedTransport answers 200 to every request, after a pause, and holds the
+// requests to hosts starting with "slow" until release is closed. It
+// records the most requests it had in flight at once.
+type gatedTransport struct {
+	pause   time.Duration
+	release chan struct{}
+
+	mu            sync.Mutex
+	inFlight, max int
+}
+
+func (g *gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	g.mu.Lock()
+	g.inFlight++
+	g.max = max(g.max, g.inFlight)
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.inFlight--
+		g.mu.Unlock()
+	}()
+	time.Sleep(g.pause)
+	if strings.HasPrefix(req.URL.Host, "slow") {
+		select {
+		case <-g.release:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestReloadWebhooksConcurrency(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		hosts       []string
+		// wantFirst are the webhooks that succeed while the slow ones are
+		// held.
+		wantFirst []string
+		wantMax   int
+	}{
+		{
+			name:      "unbounded",
+			hosts:     []string{"slow-unbounded", "fast-unbounded-a", "fast-unbounded-b"},
+			wantFirst: []string{"fast-unbounded-a", "fast-unbounded-b"},
+			wantMax:   3,
+		},
+		{
+			name:        "bounded",
+			concurrency: 2,
+			hosts:       []string{"slow-bounded", "fast-bounded-a", "fast-bounded-b", "fast-bounded-c", "fast-bounded-d"},
+			wantFirst:   []string{"fast-bounded-a", "fast-bounded-b", "fast-bounded-c", "fast-bounded-d"},
+			wantMax:     2,
+		},
+		{
+			name:        "more than webhooks",
+			concurrency: 10,
+			hosts:       []string{"slow-more", "fast-more-a"},
+			wantFirst:   []string{"fast-more-a"},
+			wantMax:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, webhookConcurrency, tt.concurrency)
+			captureLog(t)
+			rt := &gatedTransport{pause: 20 * time.Millisecond, release: make(chan struct{})}
+			var webhooks []*webhookTarget
+			for _, host := range tt.hosts {
+				webhooks = append(webhooks, mustParseWebhook(t, "http://"+host+"/reload"))
+			}
+			r := testReloader(rt, webhooks...)
+			successes := map[string]func() float64{}
+			for i, host := range tt.hosts {
+				successes[host] = counterDelta(successReloads.WithLabelValues(webhookLabel(webhooks[i])))
+			}
+			succeeded := func(host string) float64 { return successes[host]() }
+
+			done := make(chan bool)
+			go func() { done <- r.reloadWebhooks(context.Background(), reloadEvent{id: newReloadID()}) }()
+			// The slow webhook holds a slot, not the others.
+			deadline := time.Now().Add(5 * time.Second)
+			for _, host := range tt.wantFirst {
+				for succeeded(host) != 1 {
+					if time.Now().After(deadline) {
+						t.Fatalf("%s did not succeed while the slow webhook was held", host)
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+			if got := succeeded(tt.hosts[0]); got != 0 {
+				t.Errorf("the slow webhook succeeded %g times before it was released", got)
+			}
+			close(rt.release)
+			if !<-done {
+				t.Error("reloadWebhooks reported a failure")
+			}
+			for _, host := range tt.hosts {
+				if got := succeeded(host); got != 1 {
+					t.Errorf("success_total{webhook=%q} grew by %g, want 1", host, got)
+				}
+			}
+			if rt.max != tt.wantMax {
+				t.Errorf("sent %d requests at once, want %d", rt.max, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestRetryAttemptsTotal(t *testing.T) {
+	// One reload cycle whose first webhook needs three attempts counts each
+	// of them, unlike requests_total which counts per reload.
+	setFlag(t, webhookOrdered, true)
+	flaky := mustParseWebhook(t, "http://webhook-attempts-flaky/reload")
+	steady := mustParseWebhook(t, "http://webhook-attempts-steady/reload")
+	rt := &countingTransport{statuses: []int{503, 502, 200}}
+	r := testReloader(rt, flaky, steady)
+	r.settings.retries = 5
+	tests := []struct {
+		h       *webhookTarget
+		outcome string
+		want    float64
+		delta   func() float64
+	}{
+		{h: flaky, outcome: "failure", want: 2},
+		{h: flaky, outcome: "success", want: 1},
+		{h: steady, outcome: "failure", want: 0},
+		{h: steady, outcome: "success", want: 1},
+	}
+	for i, tt := range tests {
+		tests[i].delta = counterDelta(retryAttempts.WithLabelValues(webhookLabel(tt.h), tt.outcome))
+	}
+
+	if !r.reloadWebhooks(context.Background(), reloadEvent{id: newReloadID()}) {
+		t.Fatal("reload failed")
+	}
+	for _, tt := range tests {
+		if got := tt.delta(); got != tt.want {
+			t.Errorf("retry_attempts_total{webhook=%q,outcome=%q} grew by %g, want %g", tt.h.Host, tt.outcome, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookDedupe(t *testing.T) {
+	setFlag(t, webhookDedupe, true)
+	a, b := t.TempDir(), t.TempDir()
+	writeConfigMap(t, a, "v1", map[string]string{"app": "1"})
+	writeConfigMap(t, b, "v1", map[string]string{"db": "1"})
+	targets, err := newWatchTargets([]string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &countingTransport{statuses: []int{200}}
+	r := testReloader(rt, mustParseWebhook(t, "http://webhook-dedupe/reload"))
+
+	// Both ConfigMaps are updated together; the events of the second are
+	// handled after the content of both changed.
+	writeConfigMap(t, a, "v2", map[string]string{"app": "2"})
+	writeConfigMap(t, b, "v2", map[string]string{"db": "2"})
+	for _, dir := range []string{a, b} {
+		ev, ok := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create})
+		if !ok {
+			t.Fatalf("the update of %s is not a change", dir)
+		}
+		if !r.reloadWebhooks(context.Background(), ev) {
+			t.Fatalf("reload for %s failed", dir)
+		}
+	}
+	if got := rt.count(); got != 1 {
+		t.Errorf("sent %d requests for one content state, want 1", got)
+	}
+
+	writeConfigMap(t, a, "v3", map[string]string{"app": "3"})
+	ev, _ := targets.change(fsnotify.Event{Name: filepath.Join(a, "..data"), Op: fsnotify.Create})
+	r.reloadWebhooks(context.Background(), ev)
+	if got := rt.count(); got != 2 {
+		t.Errorf("sent %d requests after a new content state, want 2", got)
+	}
+}
+
+func TestFireBodyWithMethod(t *testing.T) {
+	setFlag(t, webhookBody, `{"cache":"config"}`)
+	setFlag(t, webhookContentType, "application/json")
+	type request struct {
+		method, contentType, body string
+		length                    int64
+	}
+	received := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- request{r.Method, r.Header.Get("Content-Type"), string(b), r.ContentLength}
+	}))
+	defer srv.Close()
+
+	for _, method := range []string{http.MethodDelete, http.MethodGet, "PURGE"} {
+		t.Run(method, func(t *testing.T) {
+			h := mustParseWebhook(t, srv.URL+"/cache;method="+method)
+			r := testReloader(srv.Client().Transport, h)
+			if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+				t.Fatal(err)
+			}
+			want := request{method, "application/json", `{"cache":"config"}`, int64(len(`{"cache":"config"}`))}
+			if got := <-received; got != want {
+				t.Errorf("received %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestFireRequireResponseHeader(t *testing.T) {
+	setFlag(t, webhookRequireHeader, "X-Reloaded")
+	tests := []struct {
+		name    string
+		echo    bool
+		wantErr bool
+	}{
+		{name: "present", echo: true},
+		{name: "absent", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.echo {
+					w.Header().Set("X-Reloaded", "1")
+				}
+			}))
+			defer srv.Close()
+			h := mustParseWebhook(t, srv.URL+"/reload")
+			r := testReloader(srv.Client().Transport, h)
+			err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("fire returned %v, want error: %v", err, tt.wantErr)
+			}
+			want := 0.0
+			if tt.wantErr {
+				want = 1
+			}
+			if got := testutil.ToFloat64(requestErrorsByReason.WithLabelValues(webhookLabel(h), "missing_response_header")); got != want {
+				t.Errorf("request_errors_total{reason=\"missing_response_header\"} = %g, want %g", got, want)
+			}
+		})
+	}
+}
+
+func TestReloadWebhooksCanary(t *testing.T) {
+	tests := []struct {
+		name        string
+		canary      int
+		wantOK      bool
+		wantSent    int
+		wantOutcome string
+	}{
+		{name: "passing canary", canary: 200, wantOK: true, wantSent: 3, wantOutcome: "success"},
+		{name: "failing canary", canary: 500, wantSent: 1, wantOutcome: "failure"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &countingTransport{statuses: []int{tt.canary, 200}}
+			// The canary is called first wherever it is listed.
+			canary := mustParseWebhook(t, "http://canary-"+strconv.Itoa(i)+"/reload;canary=true")
+			r := testReloader(rt, mustParseWebhook(t, "http://rest-a/reload"), canary, mustParseWebhook(t, "http://rest-b/reload"))
+			outcomes := counterDelta(canaryReloads.WithLabelValues(webhookLabel(canary), tt.wantOutcome))
+			if ok := r.reloadWebhooks(context.Background(), reloadEvent{id: newReloadID()}); ok != tt.wantOK {
+				t.Errorf("reloadWebhooks reported success: %v, want %v", ok, tt.wantOK)
+			}
+			if rt.count() != tt.wantSent || rt.requests[0].URL.Host != canary.Host {
+				t.Errorf("sent %d requests starting with %s, want %d starting with the canary", rt.count(), rt.requests[0].URL.Host, tt.wantSent)
+			}
+			if got := outcomes(); got != 1 {
+				t.Errorf("canary_reloads_total{outcome=%q} grew by %g, want 1", tt.wantOutcome, got)
+			}
+		})
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	bodyFile := filepath.Join(t.TempDir(), "body.json")
+	tests := []struct {
+		name            string
+		body, file      string
+		fileContent     []string
+		wantContentType string
+	}{
+		{name: "none", fileContent: []string{"", ""}},
+		{name: "inline", body: `{"reload":true}`, fileContent: []string{`{"reload":true}`, `{"reload":true}`}, wantContentType: "application/json"},
+		// The file is read for every reload, so that another process can
+		// render it.
+		{name: "file", file: bodyFile, fileContent: []string{`{"v":1}`, `{"v":2}`}, wantContentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, webhookBody, tt.body)
+			setFlag(t, webhookBodyFile, tt.file)
+			setFlag(t, webhookContentType, "application/json")
+			rt := &countingTransport{statuses: []int{200}}
+			h := mustParseWebhook(t, "http://webhook-body/reload")
+			r := testReloader(rt, h)
+			for i, want := range tt.fileContent {
+				if tt.file != "" {
+					writeFile(t, tt.file, want)
+				}
+				if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+					t.Fatal(err)
+				}
+				req := rt.requests[i]
+				if rt.bodies[i] != want {
+					t.Errorf("reload %d sent body %q, want %q", i+1, rt.bodies[i], want)
+				}
+				if want == "" && req.Body != nil && req.Body != http.NoBody {
+					t.Errorf("reload %d sent a body without -webhook-body", i+1)
+				}
+				if got := req.Header.Get("Content-Type"); got != tt.wantContentType {
+					t.Errorf("reload %d sent Content-Type %q, want %q", i+1, got, tt.wantContentType)
+				}
+			}
+		})
+	}
+}
+
+func TestFireBodyContents(t *testing.T) {
+	setFlag(t, webhookBodyContents, true)
+	setFlag(t, webhookBodyContentsMax, 64)
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"config.json": `{"level":"info"}`})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mustParseWebhook(t, "http://webhook-contents/reload")
+	rt := &countingTransport{statuses: []int{200}}
+	r := testReloader(rt, h)
+	update := func(content string) error {
+		t.Helper()
+		writeConfigMap(t, dir, "v"+strconv.Itoa(rt.count()+2), map[string]string{"config.json": content})
+		ev, ok := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create})
+		if !ok {
+			t.Fatal("the update is not a change")
+		}
+		return r.fire(context.Background(), h, ev)
+	}
+
+	if err := update(`{"level":"debug"}`); err != nil {
+		t.Fatal(err)
+	}
+	if rt.bodies[0] != `{"level":"debug"}` {
+		t.Errorf("sent body %q, want the new content", rt.bodies[0])
+	}
+	if got := rt.requests[0].Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("sent Content-Type %q, want application/json", got)
+	}
+	// Content above -webhook-body-contents-max-bytes fails the reload
+	// rather than being cut.
+	if err := update(`{"level":"` + strings.Repeat("x", 64) + `"}`); err == nil {
+		t.Error("fire succeeded with content above the limit")
+	}
+	if rt.count() != 1 {
+		t.Errorf("sent %d requests, want none for content above the limit", rt.count()-1)
+	}
+}
+
+func TestFireFirstFailureGrace(t *testing.T) {
+	tests := []struct {
+		name       string
+		grace      time.Duration
+		statuses   []int
+		wantErrors float64
+	}{
+		{name: "without grace", statuses: []int{503, 200}, wantErrors: 1},
+		{name: "fails once", grace: time.Millisecond, statuses: []int{503, 200}},
+		// The first failure counts once the retry fails as well.
+		{name: "keeps failing", grace: time.Millisecond, statuses: []int{503, 503, 200}, wantErrors: 2},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, webhookFirstFailGrace, tt.grace)
+			h := mustParseWebhook(t, "http://webhook-grace-"+strconv.Itoa(i)+"/reload")
+			rt := &countingTransport{statuses: tt.statuses}
+			r := testReloader(rt, h)
+			r.settings.retries = 3
+			responseErrors := counterDelta(requestErrorsByReason.WithLabelValues(webhookLabel(h), "client_response"))
+			if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+				t.Fatal(err)
+			}
+			if got := responseErrors(); got != tt.wantErrors {
+				t.Errorf("request_errors_total{reason=\"client_response\"} grew by %g, want %g", got, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestEmptiedConfigMap(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantChange bool
+	}{
+		{policy: "reload", wantChange: true},
+		{policy: "skip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			setFlag(t, emptyConfig, tt.policy)
+			dir := t.TempDir()
+			writeConfigMap(t, dir, "v1", map[string]string{"a": "1", "b": "2"})
+			targets, err := newWatchTargets([]string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The update removes every key.
+			writeConfigMap(t, dir, "v2", map[string]string{})
+			ev, ok := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create})
+			if ok != tt.wantChange {
+				t.Fatalf("change returned %v, want %v", ok, tt.wantChange)
+			}
+			if !ev.empty || !slices.Equal(ev.keys, []string{"a", "b"}) {
+				t.Errorf("change returned empty %v with keys %q, want empty with the removed keys", ev.empty, ev.keys)
+			}
+			if !ok {
+				return
+			}
+			h := mustParseWebhook(t, "http://webhook-emptied-"+tt.policy+"/reload")
+			rt := &countingTransport{statuses: []int{200}}
+			if err := testReloader(rt, h).fire(context.Background(), h, ev); err != nil {
+				t.Fatal(err)
+			}
+			if got := rt.requests[0].Header.Get("X-Reload-Empty"); got != "true" {
+				t.Errorf("sent X-Reload-Empty %q, want true", got)
+			}
+		})
+	}
+}
+
+func TestFireBodyKeys(t *testing.T) {
+	setFlag(t, webhookBodyKeys, true)
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"app.yaml": "a: 1", "db.yaml": "b: 1", "log.yaml": "c: 1"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// app.yaml changes, db.yaml is removed, cache.yaml added and log.yaml
+	// is unchanged.
+	writeConfigMap(t, dir, "v2", map[string]string{"app.yaml": "a: 2", "cache.yaml": "d: 1", "log.yaml": "c: 1"})
+	ev, ok := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create})
+	if !ok {
+		t.Fatal("the update is not a change")
+	}
+	h := mustParseWebhook(t, "http://webhook-body-keys/reload")
+	rt := &countingTransport{statuses: []int{200}}
+	if err := testReloader(rt, h).fire(context.Background(), h, ev); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	if err := json.Unmarshal([]byte(rt.bodies[0]), &keys); err != nil {
+		t.Fatalf("sent body %q, not a JSON array: %v", rt.bodies[0], err)
+	}
+	if want := []string{"app.yaml", "cache.yaml", "db.yaml"}; !slices.Equal(keys, want) {
+		t.Errorf("sent keys %q, want %q", keys, want)
+	}
+	if got := rt.requests[0].Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("sent Content-Type %q, want application/json", got)
+	}
+
+	// A reload without changed keys, e.g. at startup, sends an empty array.
+	if err := testReloader(rt, h).fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+		t.Fatal(err)
+	}
+	if rt.bodies[1] != "[]" {
+		t.Errorf("sent body %q without changed keys, want []", rt.bodies[1])
+	}
+}
+
+func TestFireReusesConnections(t *testing.T) {
+	var requests, conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if requests.Add(1)%3 != 0 {
+			status = http.StatusServiceUnavailable
+		}
+		// A body the client must read for the connection to be reused.
+		w.WriteHeader(status)
+		w.Write([]byte(strings.Repeat("unavailable\n", 1000)))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	captureLog(t)
+	transport, err := newWebhookTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+
+	h := mustParseWebhook(t, srv.URL+"/reload")
+	r := testReloader(transport, h)
+	r.settings.retries = 3
+	// Two reloads, each succeeding on the third attempt.
+	for i := 0; i < 2; i++ {
+		if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests.Load() != 6 {
+		t.Fatalf("sent %d requests, want 6", requests.Load())
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("opened %d connections for the retries and reloads, want 1", got)
+	}
+}
+
+func TestLastReloadSuccessTimestamp(t *testing.T) {
+	h := mustParseWebhook(t, "http://webhook-last-success/reload")
+	label := webhookLabel(h)
+	rt := &countingTransport{statuses: []int{200, 503}}
+	r := testReloader(rt, h)
+	captureLog(t)
+
+	before := time.Now()
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+		t.Fatal(err)
+	}
+	succeeded := testutil.ToFloat64(lastReloadSuccess.WithLabelValues(label))
+	if succeeded < float64(before.Unix()) || succeeded > float64(time.Now().Unix()+1) {
+		t.Errorf("last_reload_success_timestamp_seconds = %g, want the time of the reload, %d", succeeded, before.Unix())
+	}
+	// A failed reload keeps the time of the last successful one.
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err == nil {
+		t.Fatal("fire succeeded, want the 503 to fail it")
+	}
+	if got := testutil.ToFloat64(lastReloadSuccess.WithLabelValues(label)); got != succeeded {
+		t.Errorf("last_reload_success_timestamp_seconds = %g after a failure, want %g", got, succeeded)
+	}
+	if got := testutil.ToFloat64(lastReloadError.WithLabelValues(label)); got != 1 {
+		t.Errorf("last_reload_error = %g after a failure, want 1", got)
+	}
+
+	// The gauge is exported along with the others.
+	n, err := testutil.GatherAndCount(registry, "configmap_reload_last_reload_success_timestamp_seconds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("the registry does not export configmap_reload_last_reload_success_timestamp_seconds")
+	}
+}
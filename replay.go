@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// lastReloads records, per webhook, the last request that successfully
+// reloaded it, so that /replay can send it again, e.g. after the webhook's
+// target restarted without its config.
+type lastReloads struct {
+	mu       sync.Mutex
+	requests map[string]storedReload
+}
+
+// storedReload is the reload request of a webhook as it was built for the
+// reload, before the headers of the webhook and its sequence number were
+// added.
+type storedReload struct {
+	h      *webhookTarget
+	header http.Header
+	body   []byte
+}
+
+var replays = &lastReloads{requests: map[string]storedReload{}}
+
+func (l *lastReloads) record(h *webhookTarget, header http.Header, body []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests[webhookKey(h)] = storedReload{h: h, header: header.Clone(), body: body}
+}
+
+// get returns the stored requests ordered by webhook, only the one of the
+// webhook given by webhook if it is not empty. A webhook is given by its
+// redacted URL, as /replay reports and the logs show it, or its key.
+func (l *lastReloads) get(webhook string) []storedReload {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var stored []storedReload
+	for k, s := range l.requests {
+		if webhook == "" || k == webhook || s.h.Redacted() == webhook {
+			stored = append(stored, s)
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].h.String() < stored[j].h.String() })
+	return stored
+}
+
+// replayResult reports the outcome of replaying the last reload of a
+// webhook.
+type replayResult struct {
+	Webhook    string `json:"webhook"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// replayHandler sends the last successful reload request of every webhook,
+// or of the one given with the webhook query parameter, again and reports
+// the responses. Replays are sent once, without retries, and do not affect
+// the reload metrics. A replay carries the body of the reload, but its
+// headers are resolved again, so that a rotated token is used, and it is
+// numbered as a new reload. It has no Idempotency-Key, as it is meant to be
+// applied again by a receiver that already saw the reload.
+func replayHandler(rl *reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		webhook := r.URL.Query().Get("webhook")
+		stored := replays.get(webhook)
+		if webhook != "" && len(stored) == 0 {
+			http.Error(w, "no successful reload of "+webhook+" to replay", http.StatusNotFound)
+			return
+		}
+		results := []replayResult{}
+		for _, s := range stored {
+			results = append(results, s.replay(r, rl))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+func (s storedReload) replay(r *http.Request, rl *reloader) replayResult {
+	res := replayResult{Webhook: s.h.Redacted()}
+	header := s.header.Clone()
+	header.Del("Idempotency-Key")
+	if *webhookSeqHeader {
+		seq, err := rl.sequence.next(s.h)
+		if err != nil {
+			log.Println("error: persisting reload sequence:", err)
+		}
+		header.Set("X-Reload-Seq", strconv.FormatUint(seq, 10))
+	}
+	req, err := newWebhookRequest(r.Context(), s.h, header, s.body)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	log.Printf("replaying the last reload of %s", s.h.Redacted())
+	resp, err := s.h.httpClient(rl.httpClient).Do(req)
+	if err != nil {
+		log.Println("error: replaying reload:", err)
+		res.Error = err.Error()
+		return res
+	}
+	drainBody(resp.Body)
+	res.StatusCode = resp.StatusCode
+	if want := s.h.successStatus(*webhookStatusCode); resp.StatusCode != want {
+		res.Error = "received response code " + strconv.Itoa(resp.StatusCode) + ", expected " + strconv.Itoa(want)
+		log.Printf("error: replaying reload of %s: %s", s.h.Redacted(), res.Error)
+	}
+	return res
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestReplayHandler(t *testing.T) {
+	dir := t.TempDir()
+	authToken, headerToken := filepath.Join(dir, "auth"), filepath.Join(dir, "header")
+	writeFile(t, authToken, "s3cret\n")
+	writeFile(t, headerToken, "t1")
+	setFlag(t, webAuthTokenFile, authToken)
+	setFlag(t, webhookBody, `{"reload":true}`)
+	setFlag(t, webhookSeqHeader, true)
+	setFlag(t, webhookIdempotencyKey, true)
+	setFlag(t, &replays, &lastReloads{requests: map[string]storedReload{}})
+	captureLog(t)
+
+	h := mustParseWebhook(t, "http://user:pw@replay/reload;method=PUT;header=X-Token: @"+headerToken)
+	rt := &countingTransport{statuses: []int{200}}
+	r := testReloader(rt, h)
+	sequence, err := newReloadSequence("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.sequence = sequence
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID(), hash: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	// The replay resolves the headers again, picking up the rotated token.
+	writeFile(t, headerToken, "t2")
+	handler := requireAuth(replayHandler(r), true)
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		token      string
+		wantStatus int
+		wantSent   int
+	}{
+		{name: "unauthenticated", method: http.MethodPost, wantStatus: http.StatusUnauthorized, wantSent: 1},
+		{name: "wrong method", method: http.MethodGet, token: "s3cret", wantStatus: http.StatusMethodNotAllowed, wantSent: 1},
+		{name: "unknown webhook", method: http.MethodPost, query: "?webhook=http://other/", token: "s3cret", wantStatus: http.StatusNotFound, wantSent: 1},
+		{name: "unredacted URL", method: http.MethodPost, query: "?webhook=" + url.QueryEscape(h.String()), token: "s3cret", wantStatus: http.StatusNotFound, wantSent: 1},
+		{name: "redacted URL", method: http.MethodPost, query: "?webhook=" + url.QueryEscape(h.Redacted()), token: "s3cret", wantStatus: http.StatusOK, wantSent: 2},
+		{name: "key", method: http.MethodPost, query: "?webhook=" + webhookKey(h), token: "s3cret", wantStatus: http.StatusOK, wantSent: 3},
+		{name: "every webhook", method: http.MethodPost, token: "s3cret", wantStatus: http.StatusOK, wantSent: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/replay"+tt.query, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("responded %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rt.count() != tt.wantSent {
+				t.Fatalf("sent %d requests, want %d", rt.count(), tt.wantSent)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var results []replayResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 || results[0] != (replayResult{Webhook: h.Redacted(), StatusCode: 200}) {
+				t.Errorf("reported %+v, want the replay of %s succeeded", results, h.Redacted())
+			}
+			stored, replayed := rt.requests[0], rt.requests[rt.count()-1]
+			if replayed.Method != stored.Method || replayed.URL.String() != stored.URL.String() {
+				t.Errorf("replayed %s %s, want %s %s", replayed.Method, replayed.URL, stored.Method, stored.URL)
+			}
+			if got := replayed.Header.Get("X-Token"); got != "t2" {
+				t.Errorf("replayed X-Token %q, want the rotated t2", got)
+			}
+			if got, want := replayed.Header.Get("X-Reload-Seq"), strconv.Itoa(rt.count()); got != want {
+				t.Errorf("replayed X-Reload-Seq %q, want a fresh %s", got, want)
+			}
+			if got := replayed.Header.Get("Idempotency-Key"); got != "" {
+				t.Errorf("replayed Idempotency-Key %q, want none", got)
+			}
+			if user, pw, _ := replayed.BasicAuth(); user != "user" || pw != "pw" {
+				t.Errorf("replayed basic auth %s:%s, want user:pw", user, pw)
+			}
+			if body := rt.bodies[rt.count()-1]; body != rt.bodies[0] {
+				t.Errorf("replayed body %q, want the stored %q", body, rt.bodies[0])
+			}
+		})
+	}
+}
+
+func TestReplayHandlerRequiresToken(t *testing.T) {
+	setFlag(t, webAuthTokenFile, "")
+	rec := httptest.NewRecorder()
+	requireAuth(replayHandler(testReloader(http.DefaultTransport)), true)(rec, httptest.NewRequest(http.MethodPost, "/replay", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("responded %d without -web.auth-token-file, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestReplayIgnoresTeardown(t *testing.T) {
+	setFlag(t, &replays, &lastReloads{requests: map[string]storedReload{}})
+	setFlag(t, &teardownWebhook, webhookFlag{mustParseWebhook(t, "http://teardown/unmounted")})
+	captureLog(t)
+	rt := &countingTransport{statuses: []int{200}}
+	d := &dispatcher{reloader: testReloader(rt, mustParseWebhook(t, "http://reload/"))}
+
+	d.teardown("/config")
+	if rt.count() != 1 {
+		t.Fatalf("sent %d requests, want the teardown", rt.count())
+	}
+	if stored := replays.get(""); len(stored) != 0 {
+		t.Errorf("stored %d teardown request(s) for /replay, want none", len(stored))
+	}
+}
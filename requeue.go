@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadQueue holds webhooks whose reload exhausted its retries so that they
+// can be retried later on their own schedule. It is bounded; when full the
+// oldest entry is dropped. If path is set the queue is persisted there so
+// that pending reloads survive a restart.
+//
+// A queued reload is never sent after, or in place of, a newer reload of
+// its webhook and key: reloads are numbered as they start, a success drops
+// the older entries, and the retry of an entry is only sent while no
+// reload of its webhook is in flight.
+type reloadQueue struct {
+	mu      sync.Mutex
+	path    string
+	size    int
+	pending []queuedReload
+	// seq is the number of the last reload started.
+	seq uint64
+	// succeeded is the number of the newest reload of each webhook and key
+	// that succeeded.
+	succeeded map[string]uint64
+	// sending is held shared by the reloads of a webhook in flight and
+	// exclusively by the retry of its queued reloads.
+	sending map[string]*sync.RWMutex
+}
+
+// queuedReload is a failed reload of a webhook with the headers and body it
+// was sent with, so that its retry carries the same changed keys, diff,
+// contents and Idempotency-Key. Credentials are not stored: the webhook is
+// identified by its webhookKey and, for the log, its URL without password
+// and query, and its headers are added again when the retry is sent.
+type queuedReload struct {
+	Webhook string      `json:"webhook"`
+	URL     string      `json:"url,omitempty"`
+	ID      string      `json:"id,omitempty"`
+	Dir     string      `json:"dir,omitempty"`
+	Key     string      `json:"key,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+	// Seq is the number of the reload, which orders it against newer ones.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// event returns the reload event the retry of q is sent for.
+func (q queuedReload) event() reloadEvent {
+	id := q.ID
+	if id == "" {
+		id = newReloadID()
+	}
+	return reloadEvent{id: id, dir: q.Dir, key: q.Key, queued: &q}
+}
+
+func newReloadQueue(path string, size int) (*reloadQueue, error) {
+	q := &reloadQueue{path: path, size: size, succeeded: map[string]uint64{}, sending: map[string]*sync.RWMutex{}}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.pending); err != nil {
+		return nil, err
+	}
+	if len(q.pending) > size {
+		q.pending = q.pending[len(q.pending)-size:]
+	}
+	for _, p := range q.pending {
+		q.seq = max(q.seq, p.Seq)
+	}
+	return q, nil
+}
+
+// begin is called when a reload of h starts. It returns the number of the
+// reload, to pass to add or remove, and a function to call once it is done.
+func (q *reloadQueue) begin(h *webhookTarget) (uint64, func()) {
+	if q == nil {
+		return 0, func() {}
+	}
+	sending := q.sendingLock(webhookKey(h))
+	sending.RLock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	return q.seq, sending.RUnlock
+}
+
+func (q *reloadQueue) sendingLock(webhook string) *sync.RWMutex {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l, ok := q.sending[webhook]
+	if !ok {
+		l = &sync.RWMutex{}
+		q.sending[webhook] = l
+	}
+	return l
+}
+
+// add queues the reload seq of h for ev, replacing an older one pending for
+// h and the same key. It is not queued if a newer reload of h and the key
+// succeeded or is queued already.
+func (q *reloadQueue) add(h *webhookTarget, ev reloadEvent, seq uint64) {
+	if q == nil {
+		return
+	}
+	header, body, err := ev.request()
+	if err != nil {
+		log.Printf("error: not queueing failed reload of %s: %v", h.Redacted(), err)
+		return
+	}
+	entry := queuedReload{Webhook: webhookKey(h), URL: h.display(), ID: ev.id, Dir: ev.dir, Key: ev.key, Header: header, Body: body, Seq: seq}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if seq <= q.succeeded[entry.Webhook+"/"+entry.Key] {
+		return
+	}
+	for i, p := range q.pending {
+		if p.Webhook == entry.Webhook && p.Key == entry.Key {
+			if p.Seq > seq {
+				return
+			}
+			q.pending[i] = entry
+			q.save()
+			return
+		}
+	}
+	if len(q.pending) >= q.size {
+		log.Printf("error: failed reload queue full, dropping %s", q.pending[0].URL)
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, entry)
+	log.Printf("queued failed reload of %s for a later retry", h.Redacted())
+	q.save()
+}
+
+// remove records that the reload seq of h for key succeeded and drops the
+// reload of h for key from the queue unless it is newer.
+func (q *reloadQueue) remove(h *webhookTarget, key string, seq uint64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	k := webhookKey(h)
+	q.succeeded[k+"/"+key] = max(q.succeeded[k+"/"+key], seq)
+	for i, p := range q.pending {
+		if p.Webhook == k && p.Key == key && p.Seq <= seq {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.save()
+			return
+		}
+	}
+}
+
+// queued returns the entries of the queue.
+func (q *reloadQueue) queued() []queuedReload {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]queuedReload(nil), q.pending...)
+}
+
+// current reports whether p is still queued, i.e. no newer reload of its
+// webhook and key replaced it or succeeded.
+func (q *reloadQueue) current(p queuedReload) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, e := range q.pending {
+		if e.Webhook == p.Webhook && e.Key == p.Key {
+			return e.Seq == p.Seq
+		}
+	}
+	return false
+}
+
+// discard drops p from the queue.
+func (q *reloadQueue) discard(p queuedReload) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, e := range q.pending {
+		if e.Webhook == p.Webhook && e.Key == p.Key && e.Seq == p.Seq {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.save()
+			return
+		}
+	}
+}
+
+func (q *reloadQueue) save() {
+	if q.path == "" {
+		return
+	}
+	data, err := json.Marshal(q.pending)
+	if err == nil {
+		err = writeFileAtomic(q.path, data)
+	}
+	if err != nil {
+		log.Println("error: persisting failed reload queue:", err)
+	}
+}
+
+// run retries the queued reloads every interval using retry, keeping the
+// ones that fail again queued. Entries for webhooks that are no longer among
+// those returned by webhooks, e.g. after -webhook-url-file changed, are
+// discarded.
+func (q *reloadQueue) run(interval time.Duration, webhooks func() []*webhookTarget, retry func(h *webhookTarget, ev reloadEvent) bool) {
+	for range time.Tick(interval) {
+		q.retryPending(webhooks(), retry)
+	}
+}
+
+// retryPending retries the queued reloads. An entry whose webhook has a
+// reload in flight is left for the next round, as that reload either
+// succeeds, which drops the entry, or fails and replaces it.
+func (q *reloadQueue) retryPending(webhooks []*webhookTarget, retry func(h *webhookTarget, ev reloadEvent) bool) {
+	for _, p := range q.queued() {
+		h := findWebhook(webhooks, p.Webhook)
+		if h == nil {
+			log.Printf("discarding queued reload of unknown webhook %s", p.URL)
+			q.discard(p)
+			continue
+		}
+		sending := q.sendingLock(p.Webhook)
+		if !sending.TryLock() {
+			continue
+		}
+		if q.current(p) {
+			log.Printf("retrying queued reload of %s", h.Redacted())
+			if retry(h, p.event()) {
+				q.remove(h, p.Key, p.Seq)
+			}
+		}
+		sending.Unlock()
+	}
+}
+
+// findWebhook returns the webhook with the webhookKey key.
+func findWebhook(webhooks []*webhookTarget, key string) *webhookTarget {
+	for _, h := range webhooks {
+		if webhookKey(h) == key {
+			return h
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReloadQueueRetryPending(t *testing.T) {
+	q, err := newReloadQueue("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a is configured at startup, b only later, e.g. by -webhook-url-file.
+	a := mustParseWebhook(t, "http://a/reload")
+	b := mustParseWebhook(t, "http://b/reload")
+	q.add(a, reloadEvent{id: newReloadID()}, 1)
+	q.add(b, reloadEvent{id: newReloadID()}, 2)
+
+	var retried []string
+	q.retryPending([]*webhookTarget{b}, func(h *webhookTarget, ev reloadEvent) bool {
+		retried = append(retried, h.String())
+		return false
+	})
+	if len(retried) != 1 || retried[0] != b.String() {
+		t.Fatalf("retried %q, want only %s", retried, b)
+	}
+	// The failed retry of b stays queued, the unknown a is discarded.
+	if pending := q.queued(); len(pending) != 1 || pending[0].Webhook != webhookKey(b) {
+		t.Fatalf("pending %v after retry, want only %s", pending, b)
+	}
+}
+
+func TestReloadQueueRetrySendsQueuedRequest(t *testing.T) {
+	setFlag(t, webhookIdempotencyKey, true)
+	setFlag(t, webhookBodyDiff, true)
+
+	type received struct {
+		header http.Header
+		body   string
+	}
+	var (
+		mu       sync.Mutex
+		requests []received
+		status   = http.StatusServiceUnavailable
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, received{r.Header, string(body)})
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	h := mustParseWebhook(t, strings.Replace(srv.URL, "://", "://user:secret@", 1)+"/reload?token=hunter2")
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := newReloadQueue(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testReloader(srv.Client().Transport, h)
+	r.failed = q
+	ev := reloadEvent{id: newReloadID(), dir: "/config", keys: []string{"a"}, hash: "abc", diff: "--- a\n+++ a\n-1\n+2\n"}
+	if r.reloadWebhooks(context.Background(), ev) {
+		t.Fatal("reload succeeded, want failure")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret", "hunter2", "Basic "} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("persisted queue %s contains %q", data, secret)
+		}
+	}
+
+	// The queue survives a restart with the request as it was sent.
+	restored, err := newReloadQueue(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	restored.retryPending(r.currentWebhooks(), func(h *webhookTarget, ev reloadEvent) bool {
+		return r.fire(context.Background(), h, ev) == nil
+	})
+	if pending := restored.queued(); len(pending) != 0 {
+		t.Fatalf("pending %v after a successful retry", pending)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want the failed one and its retry", len(requests))
+	}
+	failed, retry := requests[0], requests[1]
+	if retry.body != ev.diff || retry.body != failed.body {
+		t.Errorf("retry body %q, want the diff %q", retry.body, ev.diff)
+	}
+	for _, name := range []string{"Idempotency-Key", "Content-Type"} {
+		if got, want := retry.header.Get(name), failed.header.Get(name); got == "" || got != want {
+			t.Errorf("retry %s %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReloadQueueSave(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "queue.json")
+	q, err := newReloadQueue(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mustParseWebhook(t, "http://a/reload")
+	q.add(a, reloadEvent{id: newReloadID(), dir: "/config"}, 1)
+	q.add(mustParseWebhook(t, "http://b/reload"), reloadEvent{id: newReloadID()}, 2)
+	q.remove(a, "", 1)
+
+	// Every save replaces the file by a rename, leaving no temporary file.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "queue.json" {
+		t.Errorf("the queue directory holds %v, want only queue.json", entries)
+	}
+	restored, err := newReloadQueue(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := restored.queued(); len(pending) != 1 || pending[0].URL != "http://b/reload" {
+		t.Errorf("restored %v, want only http://b/reload", pending)
+	}
+}
+
+func TestReloadQueueNewerReloadWins(t *testing.T) {
+	q, err := newReloadQueue("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mustParseWebhook(t, "http://a/reload")
+	stale := reloadEvent{id: newReloadID(), dir: "/config"}
+	staleSeq, staleDone := q.begin(h)
+	staleDone()
+	q.add(h, stale, staleSeq)
+
+	// While a newer reload is in flight the queued one is not retried.
+	newSeq, newDone := q.begin(h)
+	var retried []string
+	retry := func(h *webhookTarget, ev reloadEvent) bool {
+		retried = append(retried, ev.id)
+		return true
+	}
+	q.retryPending([]*webhookTarget{h}, retry)
+	if len(retried) != 0 {
+		t.Fatalf("retried %q while a newer reload was in flight", retried)
+	}
+	// Its success drops the queued reload, so it is never sent after it.
+	q.remove(h, "", newSeq)
+	newDone()
+	q.retryPending([]*webhookTarget{h}, retry)
+	if len(retried) != 0 {
+		t.Fatalf("retried %q after a newer reload succeeded", retried)
+	}
+	// A reload that started before and fails late is not queued again.
+	q.add(h, stale, staleSeq)
+	if pending := q.queued(); len(pending) != 0 {
+		t.Fatalf("pending %v, want the stale reload dropped", pending)
+	}
+
+	// A failed newer reload replaces the queued one, and an older failure
+	// does not replace it back.
+	olderSeq, olderDone := q.begin(h)
+	olderDone()
+	newerSeq, newerDone := q.begin(h)
+	newerDone()
+	newer := reloadEvent{id: newReloadID(), dir: "/config"}
+	q.add(h, newer, newerSeq)
+	q.add(h, reloadEvent{id: newReloadID(), dir: "/config"}, olderSeq)
+	q.retryPending([]*webhookTarget{h}, retry)
+	if len(retried) != 1 || retried[0] != newer.id {
+		t.Fatalf("retried %q, want only the newer reload", retried)
+	}
+}
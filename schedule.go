@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// reloadWindow is a daily time window, in minutes after local midnight,
+// during which reloads are allowed. A window whose end is before its start
+// spans midnight.
+type reloadWindow struct {
+	start, end int
+}
+
+// parseReloadWindow parses a -reload-window value such as 22:00-23:00.
+func parseReloadWindow(s string) (*reloadWindow, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid reload-window %q: must be HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid reload-window %q: %v", s, err)
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid reload-window %q: %v", s, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid reload-window %q: start and end are equal", s)
+	}
+	return &reloadWindow{start: start, end: end}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t is within the window.
+func (w *reloadWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// nextOpen returns the next time after t at which the window opens.
+func (w *reloadWindow) nextOpen(t time.Time) time.Time {
+	open := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+	if !open.After(t) {
+		open = time.Date(t.Year(), t.Month(), t.Day()+1, w.start/60, w.start%60, 0, 0, t.Location())
+	}
+	return open
+}
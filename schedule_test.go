@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReloadWindow(t *testing.T) {
+	for value, wantErr := range map[string]string{
+		"22:00-23:00": "",
+		"23:30-01:00": "",
+		"22:00":       "must be HH:MM-HH:MM",
+		"22:00-24:00": `"24:00" is not a HH:MM time`,
+		"10:00-10:00": "start and end are equal",
+	} {
+		_, err := parseReloadWindow(value)
+		if wantErr == "" && err != nil || wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)) {
+			t.Errorf("parseReloadWindow(%q) returned %v, want %q", value, err, wantErr)
+		}
+	}
+}
+
+func TestReloadWindow(t *testing.T) {
+	day := func(hour, min int) time.Time {
+		return time.Date(2024, 3, 1, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		window   string
+		now      time.Time
+		contains bool
+		nextOpen time.Time
+	}{
+		{window: "22:00-23:00", now: day(21, 59), nextOpen: day(22, 0)},
+		{window: "22:00-23:00", now: day(22, 0), contains: true, nextOpen: day(22, 0).AddDate(0, 0, 1)},
+		{window: "22:00-23:00", now: day(23, 0), nextOpen: day(22, 0).AddDate(0, 0, 1)},
+		// A window spanning midnight.
+		{window: "23:30-01:00", now: day(0, 30), contains: true, nextOpen: day(23, 30)},
+		{window: "23:30-01:00", now: day(12, 0), nextOpen: day(23, 30)},
+	}
+	for _, tt := range tests {
+		w, err := parseReloadWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(tt.now); got != tt.contains {
+			t.Errorf("%s contains %s: %v, want %v", tt.window, tt.now.Format("15:04"), got, tt.contains)
+		}
+		if got := w.nextOpen(tt.now); !got.Equal(tt.nextOpen) {
+			t.Errorf("%s next opens after %s at %s, want %s", tt.window, tt.now, got, tt.nextOpen)
+		}
+	}
+}
+
+func TestReloadWindowDefersChanges(t *testing.T) {
+	w, err := parseReloadWindow("22:00-23:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The clock is advanced by hand as the event loop's timers would.
+	now := time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)
+	held := heldChanges{}
+	for _, ev := range []reloadEvent{
+		{id: "first", dir: "/config", keys: []string{"a"}},
+		{id: "second", dir: "/config", keys: []string{"b"}},
+	} {
+		if w.contains(now) {
+			t.Fatalf("the window is open at %s", now)
+		}
+		held.hold(ev)
+		now = now.Add(time.Hour)
+	}
+	now = w.nextOpen(now)
+	if !w.contains(now) {
+		t.Fatalf("the window is not open at %s, when it opens", now)
+	}
+	got := held.take()
+	if len(got) != 1 || got[0].id != "first" || strings.Join(got[0].keys, ",") != "a,b" {
+		t.Errorf("sent %+v when the window opened, want one reload for a and b", got)
+	}
+}
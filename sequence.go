@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// webhookKey identifies h in the files reload state is persisted in. It is a
+// hash of the URL, so that credentials in it, such as a password or a token
+// query parameter, are not written to disk.
+func webhookKey(h *webhookTarget) string {
+	sum := sha256.Sum256([]byte(h.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// reloadSequence hands out a monotonically increasing number per webhook so
+// that receivers can order the reloads they are sent. If path is set the
+// counters are persisted there after every increment and restored at startup.
+type reloadSequence struct {
+	mu     sync.Mutex
+	path   string
+	values map[string]uint64
+}
+
+func newReloadSequence(path string) (*reloadSequence, error) {
+	s := &reloadSequence{path: path, values: map[string]uint64{}}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// next increments and returns the sequence number for h.
+func (s *reloadSequence) next(h *webhookTarget) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := webhookKey(h)
+	s.values[k]++
+	return s.values[k], s.save()
+}
+
+func (s *reloadSequence) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces the file at path with data by writing a
+// temporary file next to it and renaming it, so that a crash mid-write
+// leaves the old file rather than a truncated one.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadSequencePersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seq.json")
+	s, err := newReloadSequence(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mustParseWebhook(t, "http://user:secret@a/reload?token=hunter2")
+	b := mustParseWebhook(t, "http://b/reload")
+	for _, h := range []*webhookTarget{a, a, b} {
+		if _, err := s.next(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret", "hunter2"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("persisted sequence %s contains %q", data, secret)
+		}
+	}
+
+	restored, err := newReloadSequence(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, _ := restored.next(a); seq != 3 {
+		t.Errorf("next sequence number of a after a restart is %d, want 3", seq)
+	}
+	if seq, _ := restored.next(b); seq != 2 {
+		t.Errorf("next sequence number of b after a restart is %d, want 2", seq)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dirSnapshot maps the keys of a watched directory to their content.
+type dirSnapshot map[string]snapshotEntry
+
+type snapshotEntry struct {
+	sum string
+	// data is the content of the key's file, kept only if keepsData
+	// reports that a feature needs it.
+	data []byte
+	// size is the size of the key's file.
+	size int64
+	// unread is set if the key's file was not read because of
+	// -snapshot-max-files or -snapshot-max-file-bytes; sum is then derived
+	// from its size and modification time, and data is nil.
+	unread bool
+	// mode, uid and gid are the permissions and owner of the key's file,
+	// compared with -change-detection permissions or both.
+	mode     os.FileMode
+	uid, gid int
+}
+
+// takeSnapshot hashes the keys in dir. Entries starting with ".." are the
+// ConfigMap's internal bookkeeping and are skipped, as are directories. If
+// names is not nil only the keys it contains are included.
+//
+// Kubernetes updates a ConfigMap volume by swapping its "..data" symlink to
+// a new timestamped directory, so reading the keys through the symlinks in
+// dir could mix old and new content if a swap happens mid-read. Instead
+// "..data" is resolved once and the keys are read from its target; if the
+// target changed while reading, the snapshot is retaken.
+func takeSnapshot(dir string, names map[string]bool) (dirSnapshot, error) {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		target := readDataTarget(dir)
+		var snapshot dirSnapshot
+		snapshot, err = readSnapshot(dataRoot(dir, target), names)
+		if readDataTarget(dir) != target {
+			continue
+		}
+		return snapshot, err
+	}
+	if err == nil {
+		err = fmt.Errorf("%s changed while it was being read", dir)
+	}
+	return nil, err
+}
+
+// dataRoot returns the directory holding the keys of dir given the target
+// of its "..data" symlink, which is dir itself if it has none.
+func dataRoot(dir, target string) string {
+	if target == "" {
+		return dir
+	}
+	if filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(dir, target)
+}
+
+func readSnapshot(root string, names map[string]bool) (dirSnapshot, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := dirSnapshot{}
+	read := 0
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, "..") || (names != nil && !names[name]) {
+			continue
+		}
+		path := filepath.Join(root, name)
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		uid, gid := fileOwner(info)
+		if (*snapshotMaxFiles > 0 && read >= *snapshotMaxFiles) || (*snapshotMaxBytes > 0 && info.Size() > *snapshotMaxBytes) {
+			// Too costly to read: a change of size or modification time
+			// stands for a change of content.
+			sum := fmt.Sprintf("stat:%d:%d", info.Size(), info.ModTime().UnixNano())
+			snapshot[name] = snapshotEntry{sum: sum, size: info.Size(), unread: true, mode: info.Mode(), uid: uid, gid: gid}
+			continue
+		}
+		read++
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		entry := snapshotEntry{sum: hex.EncodeToString(sum[:]), size: int64(len(data)), mode: info.Mode(), uid: uid, gid: gid}
+		if keepsData(name) {
+			entry.data = data
+		}
+		snapshot[name] = entry
+	}
+	return snapshot, nil
+}
+
+// keepsData reports whether the content of key is kept in its snapshot
+// entry: for the diffs of -webhook-body-diff, the bodies of
+// -webhook-body-contents, and the filters of -content-type and a
+// -yaml-trigger of key. Otherwise only its sum is kept.
+func keepsData(key string) bool {
+	return *webhookBodyDiff || *webhookBodyContents || len(contentTypes) > 0 || len(triggers[key]) > 0
+}
+
+// changedKeys returns the sorted keys that changed between old and new as
+// -change-detection requires: keys that were added, removed or had their
+// content changed with content, keys whose permissions or owner changed with
+// permissions, and either with both.
+func changedKeys(old, new dirSnapshot) []string {
+	content := *changeDetection != "permissions"
+	permissions := *changeDetection != "content"
+	var keys []string
+	for k, v := range new {
+		o, ok := old[k]
+		if content && (!ok || o.sum != v.sum) {
+			keys = append(keys, k)
+		} else if permissions && ok && (o.mode != v.mode || o.uid != v.uid || o.gid != v.gid) {
+			keys = append(keys, k)
+		}
+	}
+	if content {
+		for k := range old {
+			if _, ok := new[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hash returns a hash over all keys and their content, identifying the
+// content state of the directory.
+func (s dirSnapshot) hash() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k + "\x00" + s[k].sum + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// size returns the total size of the content of all keys in bytes.
+func (s dirSnapshot) size() int64 {
+	var n int64
+	for _, e := range s {
+		n += e.size
+	}
+	return n
+}
+
+// snapshotResult is a snapshot of the directory of a target taken in the
+// background with -snapshot-async.
+type snapshotResult struct {
+	t        *watchTarget
+	dir      string
+	snapshot dirSnapshot
+	err      error
+}
+
+// asyncSnapshots takes the snapshots of changed directories in the
+// background with -snapshot-async, so that reading and hashing a large
+// directory does not hold up the handling of the events of others. At most
+// one snapshot of a directory is taken at a time; a change while it is
+// taken has it taken again once it is done. It is used by the event loop
+// only.
+type asyncSnapshots struct {
+	results chan snapshotResult
+	busy    map[string]bool
+	again   map[string]bool
+}
+
+func newAsyncSnapshots() *asyncSnapshots {
+	return &asyncSnapshots{results: make(chan snapshotResult), busy: map[string]bool{}, again: map[string]bool{}}
+}
+
+// take starts taking the snapshot of dir, the directory of t, which is sent
+// to results when done.
+func (a *asyncSnapshots) take(t *watchTarget, dir string) {
+	if a.busy[dir] {
+		a.again[dir] = true
+		return
+	}
+	a.busy[dir] = true
+	go func() {
+		snapshot, err := t.takeSnapshot(dir)
+		a.results <- snapshotResult{t: t, dir: dir, snapshot: snapshot, err: err}
+	}()
+}
+
+// done reports whether res is the current content of its directory. If the
+// directory changed while res was taken it is taken again instead, and done
+// reports false.
+func (a *asyncSnapshots) done(res snapshotResult) bool {
+	delete(a.busy, res.dir)
+	if a.again[res.dir] {
+		delete(a.again, res.dir)
+		a.take(res.t, res.dir)
+		return false
+	}
+	return true
+}
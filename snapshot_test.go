@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+func TestTakeSnapshotDuringSwap(t *testing.T) {
+	dir := t.TempDir()
+	keys := []string{"a", "b", "c", "d"}
+	for _, version := range []string{"..v1", "..v2"} {
+		for _, k := range keys {
+			writeFile(t, filepath.Join(dir, version, k), version)
+		}
+	}
+	swap := func(version string) error {
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(version, tmp); err != nil {
+			return err
+		}
+		return os.Rename(tmp, filepath.Join(dir, "..data"))
+	}
+	if err := swap("..v1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if err := os.Symlink(filepath.Join("..data", k), filepath.Join(dir, k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The kubelet swaps "..data" back and forth while the snapshots are
+	// taken; each must have the content of a single version.
+	stop := make(chan struct{})
+	swapped := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				swapped <- nil
+				return
+			default:
+			}
+			if err := swap("..v" + strconv.Itoa(i%2+1)); err != nil {
+				swapped <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		snapshot, err := takeSnapshot(dir, nil)
+		if err != nil {
+			// Swapping faster than the kubelet ever does can outpace the
+			// retakes; that is reported rather than a mixed snapshot.
+			continue
+		}
+		if len(snapshot) != len(keys) {
+			t.Fatalf("snapshot has %d keys, want %d", len(snapshot), len(keys))
+		}
+		version := string(snapshot["a"].data)
+		for _, k := range keys {
+			if got := string(snapshot[k].data); got != version {
+				t.Fatalf("snapshot mixes versions: %s has %s, a has %s", k, got, version)
+			}
+		}
+	}
+	close(stop)
+	if err := <-swapped; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotCaps(t *testing.T) {
+	setFlag(t, snapshotMaxFiles, 3)
+	setFlag(t, snapshotMaxBytes, 1024)
+	dir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		writeFile(t, filepath.Join(dir, "key-"+strconv.Itoa(i)), "small")
+	}
+	writeFile(t, filepath.Join(dir, "large"), strings.Repeat("x", 2048))
+	snapshot, err := takeSnapshot(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := 0
+	for name, e := range snapshot {
+		if !e.unread {
+			read++
+			if name == "large" {
+				t.Error("read the file above -snapshot-max-file-bytes")
+			}
+		}
+	}
+	if read != 3 || len(snapshot) != 6 {
+		t.Errorf("read %d of %d files, want 3 of 6", read, len(snapshot))
+	}
+
+	// A file that is not read still changes with its size.
+	writeFile(t, filepath.Join(dir, "large"), strings.Repeat("x", 4096))
+	changed, err := takeSnapshot(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := changedKeys(snapshot, changed); !slices.Contains(keys, "large") {
+		t.Errorf("changed keys %q, want large", keys)
+	}
+}
+
+func TestSnapshotKeepsData(t *testing.T) {
+	tests := []struct {
+		name     string
+		diff     bool
+		contents bool
+		types    stringsFlag
+		yaml     yamlTriggers
+		want     []string
+	}{
+		{name: "default"},
+		{name: "body diff", diff: true, want: []string{"a", "b"}},
+		{name: "body contents", contents: true, want: []string{"a", "b"}},
+		{name: "content type", types: stringsFlag{"text/*"}, want: []string{"a", "b"}},
+		{name: "yaml trigger", yaml: yamlTriggers{"b": {"x"}}, want: []string{"b"}},
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a"), "a: 1")
+	writeFile(t, filepath.Join(dir, "b"), "x: 2")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, webhookBodyDiff, tt.diff)
+			setFlag(t, webhookBodyContents, tt.contents)
+			setFlag(t, &contentTypes, tt.types)
+			setFlag(t, &triggers, tt.yaml)
+			snapshot, err := takeSnapshot(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for name, e := range snapshot {
+				if e.sum == "" {
+					t.Errorf("%s has no sum", name)
+				}
+				if e.data != nil {
+					kept = append(kept, name)
+				}
+			}
+			slices.Sort(kept)
+			if !slices.Equal(kept, tt.want) {
+				t.Errorf("kept the content of %q, want %q", kept, tt.want)
+			}
+		})
+	}
+}
+
+func TestAsyncSnapshots(t *testing.T) {
+	large, small := t.TempDir(), t.TempDir()
+	for i := 0; i < 200; i++ {
+		writeFile(t, filepath.Join(large, "key-"+strconv.Itoa(i)), strings.Repeat("x", 64<<10))
+	}
+	writeConfigMap(t, small, "v1", map[string]string{"a": "1"})
+	targets, err := newWatchTargets([]string{large, small})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots := newAsyncSnapshots()
+
+	writeFile(t, filepath.Join(large, "key-0"), "changed")
+	snapshots.take(targets[large], large)
+	// The event loop goes on handling the events of the small directory
+	// while the large one is read and hashed.
+	writeConfigMap(t, small, "v2", map[string]string{"a": "2"})
+	if ev, ok := targets.change(fsnotify.Event{Name: filepath.Join(small, "..data"), Op: fsnotify.Create}); !ok || ev.dir != small {
+		t.Fatalf("change of the small directory returned %v, %+v", ok, ev)
+	}
+	// A change while the snapshot is taken has it taken again.
+	writeFile(t, filepath.Join(large, "key-1"), "changed")
+	snapshots.take(targets[large], large)
+
+	res := <-snapshots.results
+	if snapshots.done(res) {
+		t.Fatal("the snapshot taken before the second change is reported current")
+	}
+	res = <-snapshots.results
+	if !snapshots.done(res) {
+		t.Fatal("the snapshot taken again is not reported current")
+	}
+	ev, ok := targets.applySnapshot(res.dir, res.snapshot, res.err)
+	if !ok || !slices.Equal(ev.keys, []string{"key-0", "key-1"}) {
+		t.Errorf("applySnapshot returned %v, %q, want key-0 and key-1 changed", ok, ev.keys)
+	}
+}
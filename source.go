@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sourcePoller polls a remote config source over HTTP and reports a reload
+// event when its content changes. Conditional requests with the last ETag
+// and Last-Modified avoid transferring unchanged content; the content hash
+// catches changes of servers that send neither.
+type sourcePoller struct {
+	url    string
+	client *http.Client
+
+	etag         string
+	lastModified string
+	hash         string
+}
+
+func newSourcePoller(url string, client *http.Client) *sourcePoller {
+	return &sourcePoller{url: url, client: client}
+}
+
+// poll fetches the source and reports whether it changed since the last
+// poll. The first successful poll only records the baseline.
+func (p *sourcePoller) poll() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	if p.lastModified != "" {
+		req.Header.Set("If-Modified-Since", p.lastModified)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("fetching %s: received response code %d", p.url, resp.StatusCode)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return false, fmt.Errorf("fetching %s: %v", p.url, err)
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	first := p.hash == ""
+	changed := hash != p.hash
+	p.etag = resp.Header.Get("ETag")
+	p.lastModified = resp.Header.Get("Last-Modified")
+	p.hash = hash
+	return changed && !first, nil
+}
+
+// run polls the source every interval and sends a reload event for every
+// change to changes.
+func (p *sourcePoller) run(interval time.Duration, changes chan<- reloadEvent) {
+	if _, err := p.poll(); err != nil {
+		sourcePollErrors.Inc()
+		log.Println("error:", err)
+	}
+	for range time.Tick(interval) {
+		changed, err := p.poll()
+		if err != nil {
+			sourcePollErrors.Inc()
+			log.Println("error:", err)
+			continue
+		}
+		if changed {
+			changes <- reloadEvent{id: newReloadID(), dir: p.url, hash: p.hash}
+		}
+	}
+}
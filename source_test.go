@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSourcePoller(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		etag    string
+		content string
+		fetched int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if etag != "" {
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+		}
+		fetched++
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+	p := newSourcePoller(srv.URL, srv.Client())
+
+	steps := []struct {
+		name        string
+		etag        string
+		content     string
+		wantChanged bool
+		wantFetched int
+	}{
+		{name: "baseline", etag: `"v1"`, content: "a", wantFetched: 1},
+		{name: "same ETag", etag: `"v1"`, content: "a", wantFetched: 1},
+		{name: "new ETag", etag: `"v2"`, content: "b", wantChanged: true, wantFetched: 2},
+		// A new ETag for the same content is not a change.
+		{name: "new ETag, same content", etag: `"v3"`, content: "b", wantFetched: 3},
+		{name: "no ETag, same content", content: "b", wantFetched: 4},
+		{name: "no ETag, new content", content: "c", wantChanged: true, wantFetched: 5},
+	}
+	for _, step := range steps {
+		mu.Lock()
+		etag, content = step.etag, step.content
+		mu.Unlock()
+		changed, err := p.poll()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if changed != step.wantChanged {
+			t.Errorf("%s: changed %v, want %v", step.name, changed, step.wantChanged)
+		}
+		mu.Lock()
+		if fetched != step.wantFetched {
+			t.Errorf("%s: fetched the content %d times, want %d", step.name, fetched, step.wantFetched)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestSourcePollerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	if changed, err := newSourcePoller(srv.URL, srv.Client()).poll(); changed || err == nil {
+		t.Errorf("poll of a failing source returned %v, %v, want an error", changed, err)
+	}
+}
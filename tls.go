@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// configureClientTLS applies -webhook-tls-ca, -webhook-tls-cert,
+// -webhook-tls-key and -webhook-tls-insecure-skip-verify to cfg.
+func configureClientTLS(cfg *tls.Config) error {
+	if *webhookTLSCA != "" {
+		pem, err := os.ReadFile(*webhookTLSCA)
+		if err != nil {
+			return fmt.Errorf("reading webhook-tls-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in webhook-tls-ca %s", *webhookTLSCA)
+		}
+		cfg.RootCAs = pool
+	}
+	if (*webhookTLSCert == "") != (*webhookTLSKey == "") {
+		return fmt.Errorf("webhook-tls-cert and webhook-tls-key must be given together")
+	}
+	if *webhookTLSCert != "" {
+		kp := &clientKeyPair{certFile: *webhookTLSCert, keyFile: *webhookTLSKey}
+		if _, err := kp.get(nil); err != nil {
+			return err
+		}
+		cfg.GetClientCertificate = kp.get
+	}
+	if *webhookTLSInsecure {
+		log.Println("warning: webhook TLS certificates are not verified; only use -webhook-tls-insecure-skip-verify for testing")
+		cfg.InsecureSkipVerify = true
+	}
+	return nil
+}
+
+// clientKeyPair is the client certificate presented to webhooks. Its files
+// are read on every handshake and the key pair is parsed again when they
+// changed, so that a certificate mounted from a Secret is picked up when it
+// is rotated. A rotation that fails to load keeps the last good key pair.
+type clientKeyPair struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (kp *clientKeyPair) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	cert, err := kp.load()
+	if err != nil {
+		if kp.cert == nil {
+			return nil, err
+		}
+		log.Println("error: reloading webhook client certificate:", err)
+		return kp.cert, nil
+	}
+	return cert, nil
+}
+
+// load parses the key pair, unless its files are unchanged.
+func (kp *clientKeyPair) load() (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(kp.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading webhook-tls-cert: %v", err)
+	}
+	keyPEM, err := os.ReadFile(kp.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading webhook-tls-key: %v", err)
+	}
+	if kp.cert != nil && bytes.Equal(certPEM, kp.certPEM) && bytes.Equal(keyPEM, kp.keyPEM) {
+		return kp.cert, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading webhook client certificate: %v", err)
+	}
+	if kp.cert != nil {
+		log.Println("webhook client certificate changed, reloaded it")
+	}
+	kp.cert, kp.certPEM, kp.keyPEM = &cert, certPEM, keyPEM
+	return kp.cert, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCert is a self-signed certificate for 127.0.0.1 that is its own CA.
+type testCert struct {
+	certPEM, keyPEM []byte
+	cert            tls.Certificate
+}
+
+func newTestCert(t *testing.T, name string) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testCert{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	c.cert, err = tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// writeCA writes the certificate as a CA bundle and returns its path.
+func (c testCert) writeCA(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTLSServer starts a server with the TLS config cfg that answers every
+// request with 200.
+func newTLSServer(t *testing.T, cfg *tls.Config) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeKeyPair writes the certificate and key of c to dir and returns their
+// paths.
+func (c testCert) writeKeyPair(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// clientNames starts a server with the certificate srv that requires a
+// client certificate, and returns it along with a function returning the
+// common names of the client certificates presented so far.
+func clientNames(t *testing.T, srv testCert) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var names []string
+	s := newTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{srv.cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			mu.Lock()
+			defer mu.Unlock()
+			names = append(names, cs.PeerCertificates[0].Subject.CommonName)
+			return nil
+		},
+	})
+	return s, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), names...)
+	}
+}
+
+func TestConfigureClientTLS(t *testing.T) {
+	captureLog(t)
+	server, client := newTestCert(t, "server"), newTestCert(t, "client")
+	certFile, keyFile := client.writeKeyPair(t, t.TempDir())
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("no certificates"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	plain := newTLSServer(t, &tls.Config{Certificates: []tls.Certificate{server.cert}})
+	mutual, _ := clientNames(t, server)
+
+	tests := []struct {
+		name           string
+		ca, cert, key  string
+		insecure       bool
+		url            func() string
+		wantConfigErr  string
+		wantRequestErr bool
+	}{
+		{name: "system roots", url: func() string { return plain.URL }, wantRequestErr: true},
+		{name: "ca", ca: server.writeCA(t), url: func() string { return plain.URL }},
+		{name: "insecure", insecure: true, url: func() string { return plain.URL }},
+		{name: "client cert", ca: server.writeCA(t), cert: certFile, key: keyFile, url: func() string { return mutual.URL }},
+		{name: "no client cert", ca: server.writeCA(t), url: func() string { return mutual.URL }, wantRequestErr: true},
+		{name: "cert without key", cert: certFile, wantConfigErr: "must be given together"},
+		{name: "key without cert", key: keyFile, wantConfigErr: "must be given together"},
+		{name: "missing ca", ca: filepath.Join(t.TempDir(), "missing.pem"), wantConfigErr: "reading webhook-tls-ca"},
+		{name: "empty ca", ca: empty, wantConfigErr: "no certificates found"},
+		{name: "invalid key pair", cert: certFile, key: empty, wantConfigErr: "loading webhook client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, webhookTLSCA, tt.ca)
+			setFlag(t, webhookTLSCert, tt.cert)
+			setFlag(t, webhookTLSKey, tt.key)
+			setFlag(t, webhookTLSInsecure, tt.insecure)
+			cfg := &tls.Config{}
+			err := configureClientTLS(cfg)
+			if tt.wantConfigErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantConfigErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantConfigErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+			resp, err := c.Get(tt.url())
+			if err == nil {
+				resp.Body.Close()
+			}
+			if gotErr := err != nil; gotErr != tt.wantRequestErr {
+				t.Errorf("got request error %v, want error: %v", err, tt.wantRequestErr)
+			}
+		})
+	}
+}
+
+func TestClientKeyPairRotation(t *testing.T) {
+	logs := captureLog(t)
+	server := newTestCert(t, "server")
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "first").writeKeyPair(t, dir)
+	setFlag(t, webhookTLSCA, server.writeCA(t))
+	setFlag(t, webhookTLSCert, certFile)
+	setFlag(t, webhookTLSKey, keyFile)
+	setFlag(t, webhookTLSInsecure, false)
+	cfg := &tls.Config{}
+	if err := configureClientTLS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	srv, names := clientNames(t, server)
+	// Every request makes a new handshake.
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+	get := func() {
+		t.Helper()
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	newTestCert(t, "second").writeKeyPair(t, dir)
+	get()
+	// A rotation that cannot be loaded keeps the last good key pair.
+	if err := os.WriteFile(keyFile, []byte("truncated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	get()
+
+	want := []string{"first", "second", "second"}
+	if got := names(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("presented %q, want %q", got, want)
+	}
+	for _, line := range []string{"webhook client certificate changed, reloaded it", "error: reloading webhook client certificate"} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("log %q does not contain %q", logs.String(), line)
+		}
+	}
+}
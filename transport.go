@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newWebhookTransport returns a copy of the default transport configured from
+// the webhook transport flags. It is used as the base for both the plain HTTP
+// and the Ziti transports.
+func newWebhookTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+
+	renegotiation, err := parseRenegotiation(*webhookTLSRenegotiation)
+	if err != nil {
+		return nil, err
+	}
+	if renegotiation != tls.RenegotiateNever {
+		log.Printf("warning: TLS renegotiation is enabled (%s); only use this for legacy endpoints that require it", *webhookTLSRenegotiation)
+	}
+	transport.TLSClientConfig.Renegotiation = renegotiation
+	if err := configureClientTLS(transport.TLSClientConfig); err != nil {
+		return nil, err
+	}
+
+	if *webhookALPN != "" {
+		protos, err := parseALPN(*webhookALPN)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.NextProtos = protos
+		if !containsString(protos, "h2") {
+			// The HTTP/2 support of the transport would otherwise add
+			// h2 back in front of the configured protocols.
+			transport.ForceAttemptHTTP2 = false
+			transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+	}
+
+	transport.ResponseHeaderTimeout = *webhookResponseTimeout
+	if *webhookExpectContinue > 0 {
+		transport.ExpectContinueTimeout = *webhookExpectContinue
+	}
+
+	transport.DialContext = newWebhookDialer().DialContext
+
+	return transport, nil
+}
+
+// newWebhookDialer returns the dialer of webhook connections, with the
+// -webhook-tcp-keepalive interval and the -webhook-resolver.
+func newWebhookDialer() *net.Dialer {
+	// Same timeout as the dialer of http.DefaultTransport.
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: *webhookTCPKeepAlive,
+		Resolver:  newWebhookResolver(),
+	}
+}
+
+// newWebhookClient returns a client sending webhook requests over rt that
+// handles redirects according to -webhook-follow-redirects.
+func newWebhookClient(rt http.RoundTripper) *http.Client {
+	return &http.Client{Transport: rt, CheckRedirect: checkRedirect}
+}
+
+// checkRedirect logs the redirect chain of a webhook request at debug level,
+// as a redirect to e.g. a login page otherwise goes unnoticed until the
+// status code check, and stops following redirects when disabled or after
+// -webhook-max-redirects.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	chain := make([]string, 0, len(via)+1)
+	for _, r := range via {
+		chain = append(chain, r.URL.String())
+	}
+	chain = append(chain, req.URL.String())
+	if !*webhookFollowRedirects {
+		log.Printf("not following redirect of webhook request: %s", strings.Join(chain, " -> "))
+		return http.ErrUseLastResponse
+	}
+	if len(via) > *webhookMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects: %s", *webhookMaxRedirects, strings.Join(chain, " -> "))
+	}
+	log.Printf("debug: following redirect of webhook request: %s", strings.Join(chain, " -> "))
+	return nil
+}
+
+// newWebhookResolver returns the resolver for webhook hostnames, which sends
+// its queries to -webhook-resolver if set.
+func newWebhookResolver() *net.Resolver {
+	addr := *webhookResolverAddr
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// isResponseDeadline reports whether err was caused by the endpoint not
+// sending response headers within -webhook-response-timeout. net/http does
+// not export a sentinel for this, so the error text is matched.
+func isResponseDeadline(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+// parseALPN parses a -webhook-alpn value, a comma-separated list of the
+// protocols to offer in order of preference.
+func parseALPN(value string) ([]string, error) {
+	var protos []string
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p != "h2" && p != "http/1.1" {
+			return nil, fmt.Errorf("invalid webhook-alpn protocol %q: must be h2 or http/1.1", p)
+		}
+		if !containsString(protos, p) {
+			protos = append(protos, p)
+		}
+	}
+	return protos, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRenegotiation(value string) (tls.RenegotiationSupport, error) {
+	switch value {
+	case "never":
+		return tls.RenegotiateNever, nil
+	case "once":
+		return tls.RenegotiateOnceAsClient, nil
+	case "freely":
+		return tls.RenegotiateFreelyAsClient, nil
+	}
+	return tls.RenegotiateNever, fmt.Errorf("invalid webhook-tls-renegotiation %q: must be one of never, once or freely", value)
+}
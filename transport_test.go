@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWebhookTLSRenegotiation(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    tls.RenegotiationSupport
+		wantErr bool
+	}{
+		{value: "never", want: tls.RenegotiateNever},
+		{value: "once", want: tls.RenegotiateOnceAsClient},
+		{value: "freely", want: tls.RenegotiateFreelyAsClient},
+		{value: "always", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			setFlag(t, webhookTLSRenegotiation, tt.value)
+			// Go's TLS server cannot ask for a renegotiation, so the test
+			// checks what the client offers to a legacy server that does.
+			transport, err := newWebhookTransport()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("newWebhookTransport succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := transport.TLSClientConfig.Renegotiation; got != tt.want {
+				t.Errorf("renegotiation %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookResponseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The headers are delayed past the deadline.
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	setFlag(t, webhookResponseTimeout, 50*time.Millisecond)
+	transport, err := newWebhookTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mustParseWebhook(t, srv.URL+"/reload")
+	r := testReloader(transport, h)
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err == nil {
+		t.Fatal("fire succeeded, want the response deadline to fail it")
+	}
+	if got := testutil.ToFloat64(requestErrorsByReason.WithLabelValues(webhookLabel(h), "response_deadline")); got != 1 {
+		t.Errorf("request_errors_total{reason=\"response_deadline\"} = %g, want 1", got)
+	}
+}
+
+// startDNSServer answers the A queries it receives over UDP with 127.0.0.1,
+// and all others with no records, returning its address and the names it
+// was asked for.
+func startDNSServer(t *testing.T) (string, func() []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			// The question follows the 12 byte header: the labels of the
+			// name up to an empty one, then its type and class.
+			end := 12
+			var labels []string
+			for end < len(query) && query[end] != 0 {
+				l := int(query[end])
+				labels = append(labels, string(query[end+1:end+1+l]))
+				end += 1 + l
+			}
+			question := query[12 : end+5]
+			isA := binary.BigEndian.Uint16(query[end+1:]) == 1
+			mu.Lock()
+			names = append(names, strings.Join(labels, "."))
+			mu.Unlock()
+
+			resp := append([]byte{}, query[:2]...)
+			resp = append(resp, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+			resp = append(resp, question...)
+			if isA {
+				resp[7] = 1
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, names...)
+	}
+}
+
+func TestWebhookResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	addr, queried := startDNSServer(t)
+
+	setFlag(t, webhookResolverAddr, addr)
+	transport, err := newWebhookTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name only resolves through the configured server.
+	h := mustParseWebhook(t, "http://reload.configmap-reload.test:"+port+"/reload")
+	r := testReloader(transport, h)
+	if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+		t.Fatal(err)
+	}
+	if got := queried(); !slices.Contains(got, "reload.configmap-reload.test") {
+		t.Errorf("the resolver was asked for %q, want reload.configmap-reload.test", got)
+	}
+}
+
+func TestWebhookExpectContinue(t *testing.T) {
+	body := strings.Repeat("x", 1<<20)
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		reject     bool
+		wantExpect string
+		wantErr    bool
+	}{
+		{name: "disabled", wantExpect: ""},
+		{name: "accepted", timeout: time.Second, wantExpect: "100-continue"},
+		{name: "rejected", timeout: time.Second, reject: true, wantExpect: "100-continue", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, webhookExpectContinue, tt.timeout)
+			setFlag(t, webhookBody, body)
+			var expect string
+			var received int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				expect = r.Header.Get("Expect")
+				if tt.reject {
+					// Answering before reading the body tells the client
+					// not to send it.
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				// Reading the body sends the 100 Continue response.
+				b, _ := io.ReadAll(r.Body)
+				received = len(b)
+			}))
+			defer srv.Close()
+
+			transport, err := newWebhookTransport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := mustParseWebhook(t, srv.URL+"/reload")
+			r := testReloader(transport, h)
+			err = r.fire(context.Background(), h, reloadEvent{id: newReloadID()})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("fire returned %v, want error: %v", err, tt.wantErr)
+			}
+			if expect != tt.wantExpect {
+				t.Errorf("sent Expect %q, want %q", expect, tt.wantExpect)
+			}
+			if !tt.reject && received != len(body) {
+				t.Errorf("the endpoint received %d bytes of the body, want %d", received, len(body))
+			}
+		})
+	}
+}
+
+func TestWebhookRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		follow  bool
+		path    string
+		wantErr bool
+		wantLog string
+	}{
+		{name: "follow", follow: true, path: "/reload", wantLog: "debug: following redirect of webhook request: " + srv.URL + "/reload -> " + srv.URL + "/login"},
+		{name: "no follow", path: "/reload", wantErr: true, wantLog: "not following redirect of webhook request"},
+		{name: "too many", follow: true, path: "/loop", wantErr: true, wantLog: "stopped after 2 redirects"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, webhookFollowRedirects, tt.follow)
+			setFlag(t, webhookMaxRedirects, 2)
+			logs := captureLog(t)
+			transport, err := newWebhookTransport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := mustParseWebhook(t, srv.URL+tt.path)
+			r := testReloader(transport, h)
+			r.httpClient = newWebhookClient(transport)
+			err = r.fire(context.Background(), h, reloadEvent{id: newReloadID()})
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("fire returned %v, want error: %v", err, tt.wantErr)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("logged %q, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestWebhookALPN(t *testing.T) {
+	c := newTestCert(t, "alpn")
+	offered := make(chan []string, 1)
+	negotiated := make(chan string, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		negotiated <- r.TLS.NegotiatedProtocol
+	}))
+	srv.EnableHTTP2 = true
+	cfg := &tls.Config{Certificates: []tls.Certificate{c.cert}, NextProtos: []string{"h2", "http/1.1"}}
+	srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		offered <- hello.SupportedProtos
+		return cfg, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(c.certPEM)
+
+	for _, tt := range []struct {
+		alpn           string
+		wantOffered    []string
+		wantNegotiated string
+	}{
+		{alpn: "", wantOffered: []string{"h2", "http/1.1"}, wantNegotiated: "h2"},
+		{alpn: "http/1.1", wantOffered: []string{"http/1.1"}, wantNegotiated: "http/1.1"},
+		{alpn: "h2,http/1.1", wantOffered: []string{"h2", "http/1.1"}, wantNegotiated: "h2"},
+		// The client's order is a preference; Go servers pick by their own.
+		{alpn: "http/1.1,h2", wantOffered: []string{"http/1.1", "h2"}, wantNegotiated: "h2"},
+	} {
+		t.Run(tt.alpn, func(t *testing.T) {
+			setFlag(t, webhookALPN, tt.alpn)
+			transport, err := newWebhookTransport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport.TLSClientConfig.RootCAs = roots
+			h := mustParseWebhook(t, srv.URL+"/reload")
+			r := testReloader(transport, h)
+			if err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-offered; !slices.Equal(got, tt.wantOffered) {
+				t.Errorf("offered %q, want %q", got, tt.wantOffered)
+			}
+			if got := <-negotiated; got != tt.wantNegotiated {
+				t.Errorf("negotiated %q, want %q", got, tt.wantNegotiated)
+			}
+		})
+	}
+}
+
+func TestWebhookDialerKeepAlive(t *testing.T) {
+	for _, keepAlive := range []time.Duration{30 * time.Second, 5 * time.Second, -1} {
+		setFlag(t, webhookTCPKeepAlive, keepAlive)
+		if got := newWebhookDialer().KeepAlive; got != keepAlive {
+			t.Errorf("with -webhook-tcp-keepalive %s the dialer keep-alive is %s", keepAlive, got)
+		}
+	}
+}
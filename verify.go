@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// verifyPollInterval is how often the target is scraped after a reload
+	// until its metric changed or -verify-timeout passed.
+	verifyPollInterval = time.Second
+	// verifyScrapeTimeout is the time limit of each scrape.
+	verifyScrapeTimeout = 5 * time.Second
+)
+
+// metricSelector selects the samples of a metric by name and label values,
+// given as e.g. app_config_version{job="app"}.
+type metricSelector struct {
+	name   string
+	labels map[string]string
+}
+
+var (
+	selectorPattern = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})?$`)
+	matcherPattern  = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*"((?:[^"\\]|\\.)*)"\s*(?:,|$)`)
+)
+
+func parseMetricSelector(s string) (metricSelector, error) {
+	m := selectorPattern.FindStringSubmatch(s)
+	if m == nil {
+		return metricSelector{}, fmt.Errorf("invalid verify-metric %q: expected name or name{label=\"value\",...}", s)
+	}
+	sel := metricSelector{name: m[1], labels: map[string]string{}}
+	for rest := m[2]; rest != ""; {
+		l := matcherPattern.FindStringSubmatch(rest)
+		if l == nil {
+			return metricSelector{}, fmt.Errorf("invalid verify-metric %q: expected label=\"value\" at %q", s, rest)
+		}
+		value, err := strconv.Unquote(`"` + l[2] + `"`)
+		if err != nil {
+			return metricSelector{}, fmt.Errorf("invalid verify-metric %q: %v", s, err)
+		}
+		sel.labels[l[1]] = value
+		rest = rest[len(l[0]):]
+	}
+	return sel, nil
+}
+
+func (s metricSelector) String() string {
+	if len(s.labels) == 0 {
+		return s.name
+	}
+	names := make([]string, 0, len(s.labels))
+	for name := range s.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	matchers := make([]string, len(names))
+	for i, name := range names {
+		matchers[i] = name + "=" + strconv.Quote(s.labels[name])
+	}
+	return s.name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// matches reports whether m carries every label value of s.
+func (s metricSelector) matches(m *dto.Metric) bool {
+	found := 0
+	for _, l := range m.GetLabel() {
+		if want, ok := s.labels[l.GetName()]; ok {
+			if l.GetValue() != want {
+				return false
+			}
+			found++
+		}
+	}
+	return found == len(s.labels)
+}
+
+// reloadVerifier confirms that a reload took effect by scraping the
+// target's metrics, with -verify-metrics-url, and checking that the value of
+// the -verify-metric, e.g. a config version or a last reload timestamp,
+// changed.
+type reloadVerifier struct {
+	url      string
+	selector metricSelector
+	timeout  time.Duration
+	client   *http.Client
+}
+
+// scrape returns the value of the first sample of the metric that matches
+// the selector.
+func (v *reloadVerifier) scrape(ctx context.Context) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, verifyScrapeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer drainBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("scraping %s: received response code %d", v.url, resp.StatusCode)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("scraping %s: %v", v.url, err)
+	}
+	if family, ok := families[v.selector.name]; ok {
+		for _, m := range family.GetMetric() {
+			if !v.selector.matches(m) {
+				continue
+			}
+			switch {
+			case m.Gauge != nil:
+				return m.Gauge.GetValue(), nil
+			case m.Counter != nil:
+				return m.Counter.GetValue(), nil
+			case m.Untyped != nil:
+				return m.Untyped.GetValue(), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("scraping %s: no sample of %s", v.url, v.selector)
+}
+
+// baseline scrapes the value before a reload. It returns a function that,
+// after the reload, polls the target until the value changed or
+// -verify-timeout passed, and logs and counts the outcome.
+func (v *reloadVerifier) baseline(ctx context.Context, ev reloadEvent) func() {
+	before, err := v.scrape(ctx)
+	if err != nil {
+		ev.logf("warning: reload will not be verified: %v", err)
+	}
+	return func() {
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			reloadVerifications.WithLabelValues("unverified").Inc()
+			return
+		}
+		deadline := time.Now().Add(v.timeout)
+		for {
+			after, err := v.scrape(ctx)
+			if err == nil && after != before {
+				reloadVerifications.WithLabelValues("verified").Inc()
+				ev.logf("reload verified: %s changed from %g to %g", v.selector, before, after)
+				return
+			}
+			if time.Now().Add(verifyPollInterval).After(deadline) {
+				reloadVerifications.WithLabelValues("unverified").Inc()
+				if err != nil {
+					ev.logf("warning: reload not verified within %s: %v", v.timeout, err)
+				} else {
+					ev.logf("warning: reload not verified: %s is still %g, unchanged within %s", v.selector, before, v.timeout)
+				}
+				return
+			}
+			if !sleepContext(ctx, verifyPollInterval) {
+				return
+			}
+		}
+	}
+}
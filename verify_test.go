@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseMetricSelector(t *testing.T) {
+	sel, err := parseMetricSelector(`app_config_version{job="app",path="a\"b"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel.name != "app_config_version" || len(sel.labels) != 2 || sel.labels["job"] != "app" || sel.labels["path"] != `a"b` {
+		t.Errorf("parsed %+v", sel)
+	}
+	if got := sel.String(); got != `app_config_version{job="app",path="a\"b"}` {
+		t.Errorf("String() = %s", got)
+	}
+	for _, s := range []string{"", "1version", `version{job=app}`, `version{job="app"`} {
+		if _, err := parseMetricSelector(s); err == nil {
+			t.Errorf("parseMetricSelector(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestReloadVerifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		reload bool
+		want   string
+	}{
+		{name: "metric changed", reload: true, want: "verified"},
+		{name: "metric unchanged", want: "unverified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			var version atomic.Int64
+			version.Store(1)
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "# TYPE app_config_version gauge\n")
+				fmt.Fprintf(w, "app_config_version{job=\"other\"} 7\n")
+				fmt.Fprintf(w, "app_config_version{job=\"app\"} %d\n", version.Load())
+			}))
+			defer target.Close()
+			sel, err := parseMetricSelector(`app_config_version{job="app"}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := &reloadVerifier{url: target.URL, selector: sel, timeout: 10 * time.Millisecond, client: target.Client()}
+			verified := reloadVerifications.WithLabelValues("verified")
+			unverified := reloadVerifications.WithLabelValues("unverified")
+			before := map[string]float64{"verified": testutil.ToFloat64(verified), "unverified": testutil.ToFloat64(unverified)}
+
+			verify := v.baseline(context.Background(), reloadEvent{id: newReloadID()})
+			if tt.reload {
+				version.Add(1)
+			}
+			verify()
+			got := map[string]float64{"verified": testutil.ToFloat64(verified) - before["verified"], "unverified": testutil.ToFloat64(unverified) - before["unverified"]}
+			for outcome, n := range got {
+				want := 0.0
+				if outcome == tt.want {
+					want = 1
+				}
+				if n != want {
+					t.Errorf("reload_verifications_total{outcome=%q} increased by %g, want %g", outcome, n, want)
+				}
+			}
+		})
+	}
+}
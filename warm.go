@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// keepWarm sends a HEAD request to the origin of every webhook right away
+// and then every interval, so that the first reload, and every one after a
+// quiet spell, finds an open connection with its TLS handshake done instead
+// of paying for them. The origin is requested rather than the reload URL, as
+// the webhook's own requests must not be sent without their credentials nor
+// trigger a reload. Any response counts as a success, as the connection is
+// warm whatever the status, e.g. a 404 or 405 of servers that serve nothing
+// at their root; only transport errors count as failures, and are logged at
+// debug level.
+func (r *reloader) keepWarm(interval time.Duration) {
+	for {
+		for _, h := range r.currentWebhooks() {
+			r.warm(h, interval)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (r *reloader) warm(h *webhookTarget, timeout time.Duration) {
+	label := webhookLabel(h)
+	if err := r.warmOrigin(h, timeout); err != nil {
+		webhookWarmups.WithLabelValues(label, "failure").Inc()
+		log.Printf("debug: warming the connection to %s: %v", h.Redacted(), err)
+		return
+	}
+	webhookWarmups.WithLabelValues(label, "success").Inc()
+}
+
+func (r *reloader) warmOrigin(h *webhookTarget, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	origin := url.URL{Scheme: h.Scheme, Host: h.Host, Path: "/"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.httpClient(r.httpClient).Do(req)
+	if err != nil {
+		return err
+	}
+	drainBody(resp.Body)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWarm(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		wantOutcome string
+	}{
+		{name: "ok", status: http.StatusOK, wantOutcome: "success"},
+		{name: "redirect", status: http.StatusNotModified, wantOutcome: "success"},
+		// The connection is warm whatever the status.
+		{name: "not found", status: http.StatusNotFound, wantOutcome: "success"},
+		{name: "method not allowed", status: http.StatusMethodNotAllowed, wantOutcome: "success"},
+		{name: "unreachable", wantOutcome: "failure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, path = r.Method, r.URL.Path
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			if tt.status == 0 {
+				srv.Close()
+			}
+			logs := captureLog(t)
+
+			h := mustParseWebhook(t, srv.URL+"/-/reload")
+			r := testReloader(srv.Client().Transport, h)
+			r.warm(h, time.Second)
+
+			if tt.status == 0 {
+				if !strings.Contains(logs.String(), "debug: warming the connection to "+h.Redacted()) {
+					t.Errorf("logged %q, want the failure at debug level", logs)
+				}
+			} else if method != http.MethodHead || path != "/" {
+				t.Errorf("got %s %s, want HEAD /", method, path)
+			}
+			for _, outcome := range []string{"success", "failure"} {
+				want := 0.0
+				if outcome == tt.wantOutcome {
+					want = 1
+				}
+				if got := testutil.ToFloat64(webhookWarmups.WithLabelValues(webhookLabel(h), outcome)); got != want {
+					t.Errorf("webhook_warmups_total{outcome=%q} = %g, want %g", outcome, got, want)
+				}
+			}
+		})
+	}
+}
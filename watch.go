@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+// watchTarget describes a directory registered with the fsnotify watcher and
+// the events within it that should trigger a reload.
+type watchTarget struct {
+	// dataDir is set when the directory itself was given as a volume dir and
+	// should be treated as a ConfigMap mount with an atomically swapped
+	// "..data" symlink.
+	dataDir bool
+	// dataTarget is the last seen target of the "..data" symlink.
+	dataTarget string
+	// files holds the base names of single files given as volume dirs, e.g. a
+	// ConfigMap key mounted via subPath. These are watched through their
+	// parent directory so that atomic replacements are seen.
+	files map[string]bool
+	// snapshot is the content of the target as of the last reported change.
+	snapshot dirSnapshot
+	// lastChange is when the last change was reported.
+	lastChange time.Time
+	// vanished is set once the "..data" symlink was removed, until it
+	// reappears.
+	vanished bool
+	// ops and triggers are the per-directory detection rules given as
+	// -volume-dir options: an event with one of ops on an entry matching
+	// one of the triggers patterns triggers a reload. ops is zero if the
+	// directory has no rules.
+	ops      fsnotify.Op
+	triggers []string
+	// stale is set once the target went without a change for longer than
+	// -max-config-age, until it changes again.
+	stale bool
+	// nested is set for directories found below a -volume-dir with
+	// -recursive. They are no longer watched once removed.
+	nested bool
+}
+
+// watchTargets maps each directory registered with the watcher to its target.
+type watchTargets map[string]*watchTarget
+
+func newWatchTargets(volumeDirs []string) (watchTargets, error) {
+	targets := watchTargets{}
+	for _, value := range volumeDirs {
+		d, ops, patterns, err := parseVolumeDir(value)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(d)
+		missing := os.IsNotExist(err) && *volumeDirAllowMissing
+		if err != nil && !missing {
+			return nil, err
+		}
+		dir := filepath.Clean(d)
+		if missing {
+			// With -volume-dir-allow-missing a volume dir that does not
+			// exist yet, e.g. because its volume is mounted later, is
+			// watched once /rewatch finds it.
+			log.Printf("warning: volume dir %q does not exist yet; it is watched once it does and /rewatch is called", dir)
+		} else if !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		t, ok := targets[dir]
+		if !ok {
+			t = &watchTarget{files: map[string]bool{}}
+			targets[dir] = t
+		}
+		if missing || info.IsDir() {
+			t.dataDir = true
+			t.dataTarget = readDataTarget(dir)
+			t.ops = ops
+			t.triggers = patterns
+		} else {
+			t.files[filepath.Base(d)] = true
+		}
+	}
+	if *recursive {
+		targets.addNestedTargets()
+	}
+	for dir, t := range targets {
+		snapshot, _ := t.takeSnapshot(dir)
+		t.setSnapshot(dir, snapshot)
+	}
+	return targets, nil
+}
+
+// parseVolumeDir parses a -volume-dir value, a path optionally followed by
+// semicolon-separated key=value options setting the detection rules of a
+// directory:
+//
+//	/etc/app;ops=create,write,remove;trigger=*.conf,*.yaml
+//
+// ops is a comma-separated list of the event ops that trigger a reload and
+// defaults to create,write when trigger is given. trigger is a
+// comma-separated list of file name patterns, as understood by
+// filepath.Match, and defaults to any name when ops is given.
+func parseVolumeDir(value string) (string, fsnotify.Op, []string, error) {
+	parts := strings.Split(value, ";")
+	var ops fsnotify.Op
+	var patterns []string
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return "", 0, nil, fmt.Errorf("invalid volume-dir option %q: expected key=value", opt)
+		}
+		switch key, val := kv[0], kv[1]; key {
+		case "ops":
+			for _, name := range strings.Split(val, ",") {
+				op, ok := eventOps[strings.ToLower(strings.TrimSpace(name))]
+				if !ok {
+					return "", 0, nil, fmt.Errorf("invalid volume-dir op %q: must be one of create, write, remove, rename or chmod", name)
+				}
+				ops |= op
+			}
+		case "trigger":
+			for _, p := range strings.Split(val, ",") {
+				if _, err := filepath.Match(p, ""); err != nil {
+					return "", 0, nil, fmt.Errorf("invalid volume-dir trigger %q: %v", p, err)
+				}
+				patterns = append(patterns, p)
+			}
+		default:
+			return "", 0, nil, fmt.Errorf("unknown volume-dir option %q", key)
+		}
+	}
+	if ops == 0 && len(patterns) > 0 {
+		ops = fsnotify.Create | fsnotify.Write
+	}
+	return parts[0], ops, patterns, nil
+}
+
+var eventOps = map[string]fsnotify.Op{
+	"create": fsnotify.Create,
+	"write":  fsnotify.Write,
+	"remove": fsnotify.Remove,
+	"rename": fsnotify.Rename,
+	"chmod":  fsnotify.Chmod,
+}
+
+// matchesRules reports whether an event with op on the entry name matches
+// the detection rules of the directory.
+func (t *watchTarget) matchesRules(name string, op fsnotify.Op) bool {
+	if t.ops == 0 || op&t.ops == 0 || strings.HasPrefix(name, "..") {
+		return false
+	}
+	if len(t.triggers) == 0 {
+		return true
+	}
+	for _, p := range t.triggers {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *watchTarget) takeSnapshot(dir string) (dirSnapshot, error) {
+	if t.dataDir {
+		return takeSnapshot(dir, nil)
+	}
+	return takeSnapshot(dir, t.files)
+}
+
+// setSnapshot records snapshot as the current content of the target and
+// updates its size in the config bytes gauge.
+func (t *watchTarget) setSnapshot(dir string, snapshot dirSnapshot) {
+	t.snapshot = snapshot
+	configBytes.WithLabelValues(dir).Set(float64(snapshot.size()))
+}
+
+// change returns the reload event for a valid event, recording the current
+// content of its directory as the new baseline for the next change. It
+// returns false if none of the changed keys pass the -content-type and
+// -yaml-trigger filters, if the directory became empty and -empty-config is
+// skip, or if no key changed as -change-detection permissions or both
+// require.
+func (w watchTargets) change(event fsnotify.Event) (reloadEvent, bool) {
+	return w.changeDir(filepath.Dir(event.Name))
+}
+
+func (w watchTargets) changeDir(dir string) (reloadEvent, bool) {
+	t, ok := w[dir]
+	if !ok {
+		return reloadEvent{id: newReloadID(), dir: dir}, true
+	}
+	snapshot, err := t.takeSnapshot(dir)
+	return w.applySnapshot(dir, snapshot, err)
+}
+
+// applySnapshot returns the reload event for the change of dir to snapshot,
+// taken by changeDir or in the background with -snapshot-async, like change.
+func (w watchTargets) applySnapshot(dir string, snapshot dirSnapshot, err error) (reloadEvent, bool) {
+	ev := reloadEvent{id: newReloadID(), dir: dir}
+	t, ok := w[dir]
+	if !ok {
+		return ev, true
+	}
+	if err != nil {
+		log.Printf("error: reading %s: %v", dir, err)
+		return ev, true
+	}
+	if t.vanished {
+		t.vanished = false
+		directoryVanished.WithLabelValues(dir).Set(0)
+		log.Printf("%s reappeared", dir)
+	}
+	ev.keys = changedKeys(t.snapshot, snapshot)
+	if len(ev.keys) == 0 && *changeDetection != "content" {
+		ev.unchanged = true
+		t.setSnapshot(dir, snapshot)
+		return ev, false
+	}
+	ev.empty = len(snapshot) == 0
+	if ev.empty && *emptyConfig == "skip" {
+		t.setSnapshot(dir, snapshot)
+		return ev, false
+	}
+	if len(ev.keys) > 0 && (len(contentTypes) > 0 || len(triggers) > 0) {
+		if len(contentTypes) > 0 {
+			ev.keys = filterContentTypes(t.snapshot, snapshot, ev.keys)
+		}
+		if len(triggers) > 0 {
+			ev.keys = triggers.filter(t.snapshot, snapshot, ev.keys)
+		}
+		if len(ev.keys) == 0 {
+			t.setSnapshot(dir, snapshot)
+			return ev, false
+		}
+	}
+	ev.hash = snapshot.hash()
+	if *webhookDedupe {
+		ev.state = w.state()
+	}
+	if *webhookBodyContents || *webhookBodyDiff {
+		ev.snapshot = snapshot
+	}
+	if *webhookBodyDiff {
+		ev.base = t.snapshot
+		ev.setDiffs()
+	}
+	t.setSnapshot(dir, snapshot)
+	t.observeChange(dir, time.Now())
+	return ev, true
+}
+
+// dirs returns the directories to register with the watcher in a stable order.
+func (w watchTargets) dirs() []string {
+	dirs := make([]string, 0, len(w))
+	for d := range w {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+func (w watchTargets) isValidEvent(event fsnotify.Event) bool {
+	t, ok := w[filepath.Dir(event.Name)]
+	if !ok {
+		return false
+	}
+	name := filepath.Base(event.Name)
+	if t.dataDir {
+		// Some Kubernetes versions swap the "..data" target without a
+		// Create event on "..data" itself, so any event in the directory
+		// checks whether the target changed. A Create of "..data" whose
+		// target was already reported this way is not reported twice.
+		target := readDataTarget(filepath.Dir(event.Name))
+		if target != "" && target != t.dataTarget {
+			t.dataTarget = target
+			return true
+		}
+		if target == "" && isValidEvent(event) {
+			return true
+		}
+	}
+	if t.files[name] && event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+		return true
+	}
+	// A changed mode or owner is only reported as a Chmod of the key.
+	if *changeDetection != "content" && event.Op&fsnotify.Chmod != 0 && !strings.HasPrefix(name, "..") && (t.dataDir || t.files[name]) {
+		return true
+	}
+	if t.matchesRules(name, event.Op) {
+		return true
+	}
+	if *watchAllEvents && !strings.HasPrefix(name, "..") && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
+		return true
+	}
+	if event.Op&fsnotify.Create == fsnotify.Create && hasWatchPrefix(name) {
+		return true
+	}
+	return false
+}
+
+func (t *watchTarget) observeChange(dir string, at time.Time) {
+	if !t.lastChange.IsZero() {
+		interChange.WithLabelValues(dir).Observe(at.Sub(t.lastChange).Seconds())
+	}
+	t.lastChange = at
+	if t.stale {
+		t.stale = false
+		configStale.WithLabelValues(dir).Set(0)
+		log.Printf("%s is no longer stale", dir)
+	}
+}
+
+// checkStale flags the targets that have not changed for longer than maxAge
+// as of now, counting from since for targets that have not changed yet.
+func (w watchTargets) checkStale(now, since time.Time, maxAge time.Duration) {
+	for _, dir := range w.dirs() {
+		t := w[dir]
+		last := t.lastChange
+		if last.IsZero() {
+			last = since
+		}
+		if t.stale || now.Sub(last) <= maxAge {
+			continue
+		}
+		t.stale = true
+		configStale.WithLabelValues(dir).Set(1)
+		log.Printf("%s is stale: it has not changed for more than %s", dir, maxAge)
+	}
+}
+
+// staleCheckInterval returns how often to check for stale targets given
+// -max-config-age, which is a tenth of it between a second and a minute.
+func staleCheckInterval(maxAge time.Duration) time.Duration {
+	interval := maxAge / 10
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
+// state returns a hash over the current content of all watched
+// directories. The directories are read afresh, rather than using their
+// last snapshots, so that directories which changed together yield the same
+// state whichever of their events is handled first.
+func (w watchTargets) state() string {
+	h := sha256.New()
+	for _, dir := range w.dirs() {
+		snapshot, err := w[dir].takeSnapshot(dir)
+		if err != nil {
+			return ""
+		}
+		h.Write([]byte(dir + "\x00" + snapshot.hash() + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isVanishEvent reports whether event removed the "..data" symlink of a
+// ConfigMap directory, i.e. the ConfigMap was unmounted, and records it.
+// A swap of "..data" replaces the symlink without removing it, so this is
+// only reported when no "..data" is left behind.
+func (w watchTargets) isVanishEvent(event fsnotify.Event) bool {
+	dir := filepath.Dir(event.Name)
+	t, ok := w[dir]
+	if !ok || !t.dataDir || t.vanished || filepath.Base(event.Name) != "..data" {
+		return false
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+		return false
+	}
+	if _, err := os.Lstat(event.Name); !os.IsNotExist(err) {
+		return false
+	}
+	t.vanished = true
+	t.dataTarget = ""
+	directoryVanished.WithLabelValues(dir).Set(1)
+	return true
+}
+
+// changedDirs returns the directories whose content checksums differ from
+// their last snapshot, which catches changes, e.g. in-place writes on
+// filesystems without reliable notifications, that were not reported.
+// Touching a file without changing its content is not a change.
+func (w watchTargets) changedDirs() []string {
+	var dirs []string
+	for _, dir := range w.dirs() {
+		if w.dirChanged(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// dirChanged reports whether the content checksums of dir differ from its
+// last snapshot.
+func (w watchTargets) dirChanged(dir string) bool {
+	t := w[dir]
+	snapshot, err := t.takeSnapshot(dir)
+	if err != nil {
+		return false
+	}
+	return len(changedKeys(t.snapshot, snapshot)) > 0
+}
+
+// recheckEvents returns an event for every ConfigMap directory, which the
+// caller passes through isValidEvent like any other event so that a swapped
+// "..data" target is noticed even if the watcher did not report it. The op
+// is one that never triggers a reload by itself.
+func (w watchTargets) recheckEvents() []fsnotify.Event {
+	var events []fsnotify.Event
+	for _, dir := range w.dirs() {
+		if w[dir].dataDir {
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Chmod})
+		}
+	}
+	return events
+}
+
+// readDataTarget returns the target of dir's "..data" symlink, or an empty
+// string if it cannot be read.
+func readDataTarget(dir string) string {
+	target, err := os.Readlink(filepath.Join(dir, "..data"))
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+// hasWatchPrefix reports whether name starts with one of the -watch-prefix
+// values, e.g. a newly rolled "config-2024-01.yaml" for prefix "config-".
+func hasWatchPrefix(name string) bool {
+	for _, p := range watchPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventCoalescer merges raw watcher events for the same path, keeping the
+// order in which the paths were first seen.
+type eventCoalescer struct {
+	order  []string
+	events map[string]fsnotify.Event
+}
+
+// add records event and reports whether it was merged into a pending event
+// for the same path.
+func (c *eventCoalescer) add(event fsnotify.Event) bool {
+	if c.events == nil {
+		c.events = map[string]fsnotify.Event{}
+	}
+	if p, ok := c.events[event.Name]; ok {
+		p.Op |= event.Op
+		c.events[event.Name] = p
+		return true
+	}
+	c.order = append(c.order, event.Name)
+	c.events[event.Name] = event
+	return false
+}
+
+// take returns the pending events and clears them.
+func (c *eventCoalescer) take() []fsnotify.Event {
+	events := make([]fsnotify.Event, 0, len(c.order))
+	for _, name := range c.order {
+		events = append(events, c.events[name])
+	}
+	c.order, c.events = nil, nil
+	return events
+}
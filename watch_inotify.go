@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "time"
+
+// inotify and ReadDirectoryChangesW report the "..data" swap directly, so
+// no periodic recheck is needed by default.
+const defaultRecheckInterval time.Duration = 0
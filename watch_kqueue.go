@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "time"
+
+// fsnotify uses kqueue here, which reports changes to a directory by
+// rescanning it for new entries. Renaming "..data_tmp" over an existing
+// "..data" adds no entry, so the swap can go unreported; recheck the
+// symlink targets periodically by default.
+const defaultRecheckInterval = 10 * time.Second
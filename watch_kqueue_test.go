@@ -0,0 +1,57 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+func TestKqueueRecheckDefault(t *testing.T) {
+	if defaultRecheckInterval <= 0 {
+		t.Fatalf("the recheck is disabled by default, but kqueue can miss the ..data swap")
+	}
+}
+
+func TestKqueueSwapNoticedByRecheck(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"a": "1"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfigMap(t, dir, "v2", map[string]string{"a": "2"})
+	// Whatever kqueue reported for the swap, the recheck notices it once.
+	changed := 0
+	deadline := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case event := <-watcher.Events:
+			if targets.isValidEvent(event) {
+				changed++
+			}
+		case <-deadline:
+			done = true
+		}
+	}
+	for _, event := range targets.recheckEvents() {
+		if targets.isValidEvent(event) {
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Errorf("the swap to %s was noticed %d times, want once", filepath.Join(dir, "..v2"), changed)
+	}
+}
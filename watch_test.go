@@ -0,0 +1,628 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// writeFile writes content to the file at path, creating its directory.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replaceFile atomically replaces the file at path with content, as tools
+// that write a temporary file and rename it over the original do.
+func replaceFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	writeFile(t, tmp, content)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	writeFile(t, file, "a: 1\n")
+	writeFile(t, filepath.Join(dir, "other.yaml"), "b: 1\n")
+	targets, err := newWatchTargets([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(targets.dirs(), []string{dir}) {
+		t.Fatalf("watching %q, want the directory of the file", targets.dirs())
+	}
+
+	replaceFile(t, file, "a: 2\n")
+	event := fsnotify.Event{Name: file, Op: fsnotify.Create}
+	if !targets.isValidEvent(event) {
+		t.Fatal("replacing the file is not a valid event")
+	}
+	ev, ok := targets.change(event)
+	if !ok || !slices.Equal(ev.keys, []string{"config.yaml"}) {
+		t.Fatalf("change returned %v, %q, want config.yaml changed", ok, ev.keys)
+	}
+
+	// Other files of the directory are not watched.
+	replaceFile(t, filepath.Join(dir, "other.yaml"), "b: 2\n")
+	if targets.isValidEvent(fsnotify.Event{Name: filepath.Join(dir, "other.yaml"), Op: fsnotify.Create}) {
+		t.Error("replacing another file of the directory is a valid event")
+	}
+	if targets.isValidEvent(fsnotify.Event{Name: file + ".tmp", Op: fsnotify.Create}) {
+		t.Error("creating the temporary file is a valid event")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	setFlag(t, &watchPrefixes, stringsFlag{"config-"})
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "config-2024-01.yaml"), "a: 1\n")
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rolled := filepath.Join(dir, "config-2024-02.yaml")
+	writeFile(t, rolled, "a: 2\n")
+	event := fsnotify.Event{Name: rolled, Op: fsnotify.Create}
+	if !targets.isValidEvent(event) {
+		t.Fatal("creating a file matching the prefix is not a valid event")
+	}
+	if ev, ok := targets.change(event); !ok || !slices.Equal(ev.keys, []string{"config-2024-02.yaml"}) {
+		t.Fatalf("change returned %v, %q, want the new file changed", ok, ev.keys)
+	}
+
+	for _, event := range []fsnotify.Event{
+		{Name: rolled, Op: fsnotify.Write},
+		{Name: filepath.Join(dir, "other.yaml"), Op: fsnotify.Create},
+		{Name: filepath.Join(dir, "app-config-2024-02.yaml"), Op: fsnotify.Create},
+	} {
+		if targets.isValidEvent(event) {
+			t.Errorf("%v is a valid event", event)
+		}
+	}
+}
+
+// writeConfigMap updates dir like the kubelet updates a ConfigMap volume: the
+// keys are written to a new "..<version>" directory, which the "..data"
+// symlink is atomically swapped to, each key is a symlink into "..data" and
+// the directory of the previous version is removed. It returns the events
+// inotify reports for the update, in order.
+func writeConfigMap(t *testing.T, dir, version string, data map[string]string) []fsnotify.Event {
+	t.Helper()
+	var events []fsnotify.Event
+	event := func(name string, op fsnotify.Op) {
+		events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: op})
+	}
+	previous := readDataTarget(dir)
+	versionDir := ".." + version
+	if err := os.MkdirAll(filepath.Join(dir, versionDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range data {
+		writeFile(t, filepath.Join(dir, versionDir, k), v)
+	}
+	event(versionDir, fsnotify.Create)
+	event(versionDir, fsnotify.Chmod)
+	if err := os.Symlink(versionDir, filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	event("..data_tmp", fsnotify.Create)
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	event("..data_tmp", fsnotify.Rename)
+	event("..data", fsnotify.Create)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if _, ok := data[e.Name()]; !ok && e.Name()[0] != '.' {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				t.Fatal(err)
+			}
+			event(e.Name(), fsnotify.Remove)
+		}
+	}
+	for k := range data {
+		if _, err := os.Lstat(filepath.Join(dir, k)); os.IsNotExist(err) {
+			if err := os.Symlink(filepath.Join("..data", k), filepath.Join(dir, k)); err != nil {
+				t.Fatal(err)
+			}
+			event(k, fsnotify.Create)
+		}
+	}
+	if previous != "" {
+		if err := os.RemoveAll(filepath.Join(dir, previous)); err != nil {
+			t.Fatal(err)
+		}
+		event(previous, fsnotify.Remove)
+	}
+	return events
+}
+
+func TestWatchDataTargetChange(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"a": "1"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfigMap(t, dir, "v2", map[string]string{"a": "2"})
+	// Some Kubernetes versions swap "..data" without a Create event of
+	// "..data" itself; any event in the directory notices the new target.
+	event := fsnotify.Event{Name: filepath.Join(dir, "..v2"), Op: fsnotify.Create}
+	if !targets.isValidEvent(event) {
+		t.Fatal("an event after the ..data target changed is not valid")
+	}
+	if ev, ok := targets.change(event); !ok || !slices.Equal(ev.keys, []string{"a"}) {
+		t.Fatalf("change returned %v, %q, want a changed", ok, ev.keys)
+	}
+	// The Create of "..data" that follows is not reported again.
+	if targets.isValidEvent(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create}) {
+		t.Error("the Create of the already reported ..data target is valid")
+	}
+}
+
+func TestInterChangeSeconds(t *testing.T) {
+	dir := "/config-inter-change"
+	// The histogram is compared as a whole, so it starts over for every run
+	// with -count.
+	interChange.DeleteLabelValues(dir)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	target := &watchTarget{}
+	// The first change has no previous one to measure from.
+	for _, offset := range []time.Duration{0, 5 * time.Second, 2 * time.Minute, 3 * time.Hour} {
+		target.observeChange(dir, start.Add(offset))
+	}
+
+	var m dto.Metric
+	if err := interChange.WithLabelValues(dir).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	h := m.GetHistogram()
+	if got := h.GetSampleCount(); got != 3 {
+		t.Errorf("observed %d gaps, want 3", got)
+	}
+	if got, want := h.GetSampleSum(), (5*time.Second + 115*time.Second + (3*time.Hour - 2*time.Minute)).Seconds(); got != want {
+		t.Errorf("observed %gs in total, want %gs", got, want)
+	}
+	cumulative := map[float64]uint64{}
+	for _, b := range h.GetBucket() {
+		cumulative[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	for bound, want := range map[float64]uint64{1: 0, 10: 1, 300: 2, 3600: 2, 6 * 3600: 3} {
+		if got := cumulative[bound]; got != want {
+			t.Errorf("bucket le=%g has %d observations, want %d", bound, got, want)
+		}
+	}
+}
+
+func TestRecheckEvents(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"a": "1"})
+	plain := t.TempDir()
+	writeFile(t, filepath.Join(plain, "a"), "1")
+	targets, err := newWatchTargets([]string{dir, plain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() int {
+		n := 0
+		for _, event := range targets.recheckEvents() {
+			if targets.isValidEvent(event) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := valid(); n != 0 {
+		t.Fatalf("recheck before any swap found %d changes", n)
+	}
+	// The swap is not reported by the watcher, as can happen with kqueue.
+	writeConfigMap(t, dir, "v2", map[string]string{"a": "2"})
+	if n := valid(); n != 1 {
+		t.Errorf("recheck after the swap found %d changes, want 1", n)
+	}
+	if n := valid(); n != 0 {
+		t.Errorf("second recheck after the swap found %d changes, want 0", n)
+	}
+}
+
+func TestEventCoalescer(t *testing.T) {
+	var c eventCoalescer
+	raw := []fsnotify.Event{
+		{Name: "/config/app.yaml", Op: fsnotify.Write},
+		{Name: "/config/app.yaml", Op: fsnotify.Write},
+		{Name: "/config/..data", Op: fsnotify.Create},
+		{Name: "/config/app.yaml", Op: fsnotify.Chmod},
+		{Name: "/config/..data", Op: fsnotify.Create},
+	}
+	coalesced := 0
+	for _, event := range raw {
+		if c.add(event) {
+			coalesced++
+		}
+	}
+	if coalesced != 3 {
+		t.Errorf("coalesced %d raw events, want 3", coalesced)
+	}
+	want := []fsnotify.Event{
+		{Name: "/config/app.yaml", Op: fsnotify.Write | fsnotify.Chmod},
+		{Name: "/config/..data", Op: fsnotify.Create},
+	}
+	if got := c.take(); !slices.Equal(got, want) {
+		t.Errorf("took %v, want %v", got, want)
+	}
+	if got := c.take(); len(got) != 0 {
+		t.Errorf("took %v again after taking the pending events", got)
+	}
+	if c.add(raw[0]) {
+		t.Error("the first event after taking is coalesced into a taken one")
+	}
+}
+
+func TestCheckStale(t *testing.T) {
+	rotated, forgotten := t.TempDir(), t.TempDir()
+	targets, err := newWatchTargets([]string{rotated, forgotten})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const maxAge = time.Hour
+	stale := func(dir string) float64 {
+		return testutil.ToFloat64(configStale.WithLabelValues(dir))
+	}
+
+	// Directories that have not changed yet are counted from startup.
+	targets.checkStale(started.Add(maxAge), started, maxAge)
+	if stale(rotated) != 0 || stale(forgotten) != 0 {
+		t.Fatal("a directory is stale right at -max-config-age")
+	}
+	targets[rotated].observeChange(rotated, started.Add(50*time.Minute))
+	targets.checkStale(started.Add(maxAge+time.Second), started, maxAge)
+	if stale(rotated) != 0 {
+		t.Error("the directory that changed is stale")
+	}
+	if stale(forgotten) != 1 {
+		t.Error("the directory that never changed is not stale past -max-config-age")
+	}
+
+	targets.checkStale(started.Add(50*time.Minute+maxAge+time.Second), started, maxAge)
+	if stale(rotated) != 1 {
+		t.Error("the directory is not stale -max-config-age after its last change")
+	}
+	// A change clears the flag.
+	targets[forgotten].observeChange(forgotten, started.Add(2*maxAge))
+	if stale(forgotten) != 0 {
+		t.Error("the directory is still stale after it changed")
+	}
+}
+
+func TestStaleCheckInterval(t *testing.T) {
+	for maxAge, want := range map[time.Duration]time.Duration{
+		5 * time.Second: time.Second,
+		time.Minute:     6 * time.Second,
+		24 * time.Hour:  time.Minute,
+	} {
+		if got := staleCheckInterval(maxAge); got != want {
+			t.Errorf("staleCheckInterval(%s) = %s, want %s", maxAge, got, want)
+		}
+	}
+}
+
+func TestPollChecksums(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.conf")
+	writeFile(t, path, "level=info\n")
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Touching the file changes its modification time only.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := targets.changedDirs(); len(got) != 0 {
+		t.Fatalf("touching a file changed %q", got)
+	}
+
+	// An in-place write of the same size, as some filesystems report
+	// without a usable event or modification time.
+	if err := os.WriteFile(path, []byte("level=warn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := targets.changedDirs(); !slices.Equal(got, []string{dir}) {
+		t.Fatalf("changing the content changed %q, want %s", got, dir)
+	}
+	if ev, ok := targets.changeDir(dir); !ok || !slices.Equal(ev.keys, []string{"app.conf"}) {
+		t.Fatalf("changeDir returned %v, %q, want app.conf changed", ok, ev.keys)
+	}
+	if got := targets.changedDirs(); len(got) != 0 {
+		t.Errorf("%q still changed after the change was handled", got)
+	}
+}
+
+func TestVolumeDirRules(t *testing.T) {
+	strict, loose := t.TempDir(), t.TempDir()
+	writeConfigMap(t, strict, "v1", map[string]string{"app.conf": "1"})
+	writeFile(t, filepath.Join(loose, "app.conf"), "1")
+	targets, err := newWatchTargets([]string{strict, loose + ";ops=write,remove;trigger=*.conf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir, name string
+		op        fsnotify.Op
+		want      bool
+	}{
+		{loose, "app.conf", fsnotify.Write, true},
+		{loose, "old.conf", fsnotify.Remove, true},
+		{loose, "app.log", fsnotify.Write, false},
+		{loose, "new.conf", fsnotify.Create, false},
+		// The ConfigMap mount keeps the default rules: only the swap of
+		// "..data" triggers, not writes to its keys.
+		{strict, "app.conf", fsnotify.Write, false},
+		{strict, "app.conf", fsnotify.Remove, false},
+	}
+	for _, tt := range tests {
+		event := fsnotify.Event{Name: filepath.Join(tt.dir, tt.name), Op: tt.op}
+		if got := targets.isValidEvent(event); got != tt.want {
+			t.Errorf("%s is valid: %v, want %v", event, got, tt.want)
+		}
+	}
+	writeConfigMap(t, strict, "v2", map[string]string{"app.conf": "2"})
+	if !targets.isValidEvent(fsnotify.Event{Name: filepath.Join(strict, "..data"), Op: fsnotify.Create}) {
+		t.Error("the ..data swap of the ConfigMap mount is not valid")
+	}
+}
+
+func TestParseVolumeDir(t *testing.T) {
+	tests := []struct {
+		value        string
+		wantDir      string
+		wantOps      fsnotify.Op
+		wantPatterns []string
+		wantErr      string
+	}{
+		{value: "/etc/app", wantDir: "/etc/app"},
+		{value: "/etc/app;trigger=*.conf", wantDir: "/etc/app", wantOps: fsnotify.Create | fsnotify.Write, wantPatterns: []string{"*.conf"}},
+		{value: "/etc/app;ops=remove,Rename", wantDir: "/etc/app", wantOps: fsnotify.Remove | fsnotify.Rename},
+		{value: "/etc/app;ops=delete", wantErr: "invalid volume-dir op"},
+		{value: "/etc/app;trigger=[", wantErr: "invalid volume-dir trigger"},
+		{value: "/etc/app;mode=strict", wantErr: "unknown volume-dir option"},
+		{value: "/etc/app;ops", wantErr: "expected key=value"},
+	}
+	for _, tt := range tests {
+		dir, ops, patterns, err := parseVolumeDir(tt.value)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseVolumeDir(%q) returned %v, want %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || dir != tt.wantDir || ops != tt.wantOps || !slices.Equal(patterns, tt.wantPatterns) {
+			t.Errorf("parseVolumeDir(%q) = %s, %v, %q, %v", tt.value, dir, ops, patterns, err)
+		}
+	}
+}
+
+func TestIsValidEvent(t *testing.T) {
+	for _, tc := range []struct {
+		event fsnotify.Event
+		want  bool
+	}{
+		{fsnotify.Event{Name: "/config/..data", Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: "/config/..data", Op: fsnotify.Rename}, true},
+		{fsnotify.Event{Name: "/config/..data", Op: fsnotify.Create | fsnotify.Chmod}, true},
+		{fsnotify.Event{Name: "/config/..data", Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: "/config/..data", Op: fsnotify.Remove}, false},
+		{fsnotify.Event{Name: "/config/..data", Op: fsnotify.Chmod}, false},
+		{fsnotify.Event{Name: "/config/..data_tmp", Op: fsnotify.Create}, false},
+		{fsnotify.Event{Name: "/config/..data_tmp", Op: fsnotify.Rename}, false},
+		{fsnotify.Event{Name: "/config/..2024_01_01_00_00_00.000000001", Op: fsnotify.Create}, false},
+		{fsnotify.Event{Name: "/config/app.yaml", Op: fsnotify.Create}, false},
+	} {
+		if got := isValidEvent(tc.event); got != tc.want {
+			t.Errorf("isValidEvent(%v) = %v, want %v", tc.event, got, tc.want)
+		}
+	}
+}
+
+// TestWatchEventSequences feeds the events Kubernetes volume updates produce,
+// in order, and counts those that trigger a reload.
+func TestWatchEventSequences(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		watchAll  bool
+		setup     func(t *testing.T, dir string)
+		update    func(t *testing.T, dir string) []fsnotify.Event
+		wantValid int
+	}{
+		{
+			name: "ConfigMap update",
+			setup: func(t *testing.T, dir string) {
+				writeConfigMap(t, dir, "v1", map[string]string{"a": "1"})
+			},
+			update: func(t *testing.T, dir string) []fsnotify.Event {
+				return writeConfigMap(t, dir, "v2", map[string]string{"a": "2"})
+			},
+			wantValid: 1,
+		},
+		{
+			name: "ConfigMap update adding and removing keys",
+			setup: func(t *testing.T, dir string) {
+				writeConfigMap(t, dir, "v1", map[string]string{"a": "1", "b": "1"})
+			},
+			update: func(t *testing.T, dir string) []fsnotify.Event {
+				return writeConfigMap(t, dir, "v2", map[string]string{"a": "1", "c": "1"})
+			},
+			wantValid: 1,
+		},
+		{
+			name:     "ConfigMap update adding and removing keys, all events",
+			watchAll: true,
+			setup: func(t *testing.T, dir string) {
+				writeConfigMap(t, dir, "v1", map[string]string{"a": "1", "b": "1"})
+			},
+			update: func(t *testing.T, dir string) []fsnotify.Event {
+				return writeConfigMap(t, dir, "v2", map[string]string{"a": "1", "c": "1"})
+			},
+			// The swap, the Remove of b and the Create of c.
+			wantValid: 3,
+		},
+		{
+			// A key mounted with subPath is a plain file that is written in
+			// place, without a "..data" symlink.
+			name: "subPath key written",
+			setup: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "app.yaml"), "a: 1\n")
+			},
+			update: func(t *testing.T, dir string) []fsnotify.Event {
+				writeFile(t, filepath.Join(dir, "app.yaml"), "a: 2\n")
+				return []fsnotify.Event{{Name: filepath.Join(dir, "app.yaml"), Op: fsnotify.Write}}
+			},
+			wantValid: 0,
+		},
+		{
+			name:     "subPath key written, all events",
+			watchAll: true,
+			setup: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "app.yaml"), "a: 1\n")
+			},
+			update: func(t *testing.T, dir string) []fsnotify.Event {
+				writeFile(t, filepath.Join(dir, "app.yaml"), "a: 2\n")
+				return []fsnotify.Event{{Name: filepath.Join(dir, "app.yaml"), Op: fsnotify.Write}}
+			},
+			wantValid: 1,
+		},
+		{
+			name:     "subPath key replaced, all events",
+			watchAll: true,
+			setup: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "app.yaml"), "a: 1\n")
+			},
+			update: func(t *testing.T, dir string) []fsnotify.Event {
+				replaceFile(t, filepath.Join(dir, "app.yaml"), "a: 2\n")
+				return []fsnotify.Event{
+					{Name: filepath.Join(dir, "app.yaml.tmp"), Op: fsnotify.Create},
+					{Name: filepath.Join(dir, "app.yaml.tmp"), Op: fsnotify.Write},
+					{Name: filepath.Join(dir, "app.yaml.tmp"), Op: fsnotify.Rename},
+					{Name: filepath.Join(dir, "app.yaml"), Op: fsnotify.Create},
+				}
+			},
+			wantValid: 4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlag(t, watchAllEvents, tc.watchAll)
+			dir := t.TempDir()
+			tc.setup(t, dir)
+			targets, err := newWatchTargets([]string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			valid := 0
+			for _, event := range tc.update(t, dir) {
+				if targets.isValidEvent(event) {
+					valid++
+				}
+			}
+			if valid != tc.wantValid {
+				t.Errorf("%d valid events, want %d", valid, tc.wantValid)
+			}
+		})
+	}
+}
+
+func TestConfigBytes(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"a": "12345", "b": "12"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gauge := configBytes.WithLabelValues(dir)
+	if got := testutil.ToFloat64(gauge); got != 7 {
+		t.Errorf("config_bytes = %g at startup, want 7", got)
+	}
+
+	writeConfigMap(t, dir, "v2", map[string]string{"a": "1"})
+	if _, ok := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create}); !ok {
+		t.Fatal("the update is not a change")
+	}
+	if got := testutil.ToFloat64(gauge); got != 1 {
+		t.Errorf("config_bytes = %g after the update, want 1", got)
+	}
+}
+
+func TestChangeDetection(t *testing.T) {
+	chmod := func(t *testing.T, file string) fsnotify.Event {
+		if err := os.Chmod(file, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fsnotify.Event{Name: file, Op: fsnotify.Chmod}
+	}
+	write := func(t *testing.T, file string) fsnotify.Event {
+		writeFile(t, file, "a: 2\n")
+		return fsnotify.Event{Name: file, Op: fsnotify.Write}
+	}
+	tests := []struct {
+		mode, name string
+		change     func(t *testing.T, file string) fsnotify.Event
+		want       bool
+	}{
+		{"content", "chmod", chmod, false},
+		{"content", "write", write, true},
+		{"permissions", "chmod", chmod, true},
+		{"permissions", "write", write, false},
+		{"both", "chmod", chmod, true},
+		{"both", "write", write, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.name, func(t *testing.T) {
+			setFlag(t, changeDetection, tt.mode)
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			writeFile(t, file, "a: 1\n")
+			if err := os.Chmod(file, 0644); err != nil {
+				t.Fatal(err)
+			}
+			targets, err := newWatchTargets([]string{file})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev := tt.change(t, file)
+			fired := false
+			if targets.isValidEvent(ev) {
+				_, fired = targets.change(ev)
+			}
+			if fired != tt.want {
+				t.Errorf("fired: %v, want %v", fired, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+// watchSet keeps track of the directories registered with the watcher, so
+// that the registrations can be reconciled with the watch targets after
+// mounts changed out-of-band.
+type watchSet struct {
+	mu         sync.Mutex
+	watcher    dirWatcher
+	targets    watchTargets
+	registered map[string]bool
+	// registeredAs holds the directory each registration was made for, so
+	// that reconcile tells a live watch from the stale one of a directory
+	// that was replaced since.
+	registeredAs map[string]os.FileInfo
+	// lost holds the volume dirs whose watch was lost because they were
+	// removed, until they are watched again.
+	lost map[string]bool
+	// rewatched receives the lost volume dirs once they are watched again,
+	// so that the event loop checks them for changes missed meanwhile.
+	rewatched chan string
+	// reconciles receives the /rewatch requests, which the event loop
+	// serves, as reconcile changes the targets it works on.
+	reconciles chan chan reconcileResult
+}
+
+// dirWatcher registers directories for change notifications, as
+// fsnotify.Watcher does.
+type dirWatcher interface {
+	Add(name string) error
+	Remove(name string) error
+}
+
+const (
+	// rewatchRetryMin and rewatchRetryMax bound the wait between the
+	// attempts to watch a removed volume dir again.
+	rewatchRetryMin = time.Second
+	rewatchRetryMax = 30 * time.Second
+)
+
+func newWatchSet(watcher dirWatcher, targets watchTargets) *watchSet {
+	return &watchSet{watcher: watcher, targets: targets, registered: map[string]bool{}, registeredAs: map[string]os.FileInfo{}, lost: map[string]bool{}, rewatched: make(chan string), reconciles: make(chan chan reconcileResult)}
+}
+
+func (s *watchSet) add(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addLocked(dir)
+}
+
+func (s *watchSet) addLocked(dir string) error {
+	log.Printf("Watching directory: %q", dir)
+	info, _ := os.Stat(dir)
+	if err := s.watcher.Add(dir); err != nil {
+		return err
+	}
+	s.register(dir, info)
+	return nil
+}
+
+// register marks dir registered as the directory described by info, which
+// is nil if it could not be found.
+func (s *watchSet) register(dir string, info os.FileInfo) {
+	s.registered[dir] = true
+	s.registeredAs[dir] = info
+}
+
+func (s *watchSet) unregister(dir string) {
+	delete(s.registered, dir)
+	delete(s.registeredAs, dir)
+}
+
+// watching returns the number of target directories registered with the
+// watcher and the number of target directories.
+func (s *watchSet) watching() (registered, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, dir := range s.targets.dirs() {
+		if s.registered[dir] {
+			registered++
+		}
+	}
+	return registered, len(s.targets)
+}
+
+// lostDirs returns the volume dirs whose watch was lost, in order.
+func (s *watchSet) lostDirs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirs := make([]string, 0, len(s.lost))
+	for dir := range s.lost {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// lose reports whether event removed or moved away a volume dir itself,
+// which loses its watch without an error, e.g. during a volume remount. The
+// directory is then marked unregistered and watched again in the background
+// once it reappears.
+func (s *watchSet) lose(event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+		return false
+	}
+	dir := filepath.Clean(event.Name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.targets[dir]; !ok || t.nested || s.lost[dir] {
+		return false
+	}
+	watchLost.WithLabelValues(dir).Inc()
+	log.Printf("error: lost the watch of %q: it was removed or moved", dir)
+	// A moved directory keeps its watch, on the wrong directory.
+	_ = s.watcher.Remove(dir)
+	s.unregister(dir)
+	s.lost[dir] = true
+	go s.recover(dir)
+	return true
+}
+
+// recover watches dir, a lost volume dir, again, retrying with a growing
+// wait until it reappears or reconcile watched it meanwhile.
+func (s *watchSet) recover(dir string) {
+	wait := rewatchRetryMin
+	for attempt := 1; ; attempt++ {
+		time.Sleep(wait)
+		s.mu.Lock()
+		if !s.lost[dir] {
+			s.mu.Unlock()
+			return
+		}
+		log.Printf("re-watching removed directory %q (attempt %d)", dir, attempt)
+		info, _ := os.Stat(dir)
+		err := s.watcher.Add(dir)
+		if err == nil {
+			s.register(dir, info)
+			delete(s.lost, dir)
+		}
+		s.mu.Unlock()
+		if err == nil {
+			log.Printf("Watching directory again: %q", dir)
+			s.rewatched <- dir
+			return
+		}
+		wait = min(wait*2, rewatchRetryMax)
+		log.Printf("error: re-watching %q: %v; retrying in %s", dir, err, wait)
+	}
+}
+
+// status returns the target directories in order and whether each is
+// registered with the watcher.
+func (s *watchSet) status() []indexDir {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var dirs []indexDir
+	for _, dir := range s.targets.dirs() {
+		dirs = append(dirs, indexDir{Dir: dir, Watched: s.registered[dir]})
+	}
+	return dirs
+}
+
+// reconcileResult reports the changes made by reconcile.
+type reconcileResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// reconcile registers every target directory that exists but has no live
+// watch, e.g. because it was replaced or did not exist yet at startup, and
+// unregisters the ones that no longer exist. Live watches are left alone, so
+// that no change is missed while /rewatch runs. With -recursive the
+// trees below the volume dirs are scanned again, so that directories created
+// below them while unwatched are added and the nested ones that are gone
+// are dropped. At most -rewatch-concurrency directories are registered at
+// once, so that many remounted directories do not flood the watcher with
+// adds.
+func (s *watchSet) reconcile() reconcileResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := reconcileResult{Added: []string{}, Removed: []string{}}
+	if *recursive {
+		s.rescanTrees()
+	}
+	desired := map[string]bool{}
+	var dirs []string
+	var infos []os.FileInfo
+	for _, dir := range s.targets.dirs() {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			if t := s.targets[dir]; t.nested && os.IsNotExist(err) {
+				delete(s.targets, dir)
+			}
+			continue
+		}
+		desired[dir] = true
+		dirs = append(dirs, dir)
+		infos = append(infos, info)
+	}
+	added := make([]bool, len(dirs))
+	errs := make([]error, len(dirs))
+	slots := make(chan struct{}, max(*rewatchConcurrency, 1))
+	var wg sync.WaitGroup
+	for i, dir := range dirs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			added[i], errs[i] = s.rewatch(dir, infos[i])
+		}(i, dir)
+	}
+	wg.Wait()
+	for i, dir := range dirs {
+		switch {
+		case errs[i] != nil:
+			res.Errors = append(res.Errors, errs[i].Error())
+		case added[i]:
+			s.register(dir, infos[i])
+			delete(s.lost, dir)
+			res.Added = append(res.Added, dir)
+		}
+	}
+	for dir := range s.registered {
+		if desired[dir] {
+			continue
+		}
+		log.Printf("No longer watching vanished directory: %q", dir)
+		// The kernel usually dropped the watch already.
+		_ = s.watcher.Remove(dir)
+		s.unregister(dir)
+		res.Removed = append(res.Removed, dir)
+	}
+	sort.Strings(res.Added)
+	sort.Strings(res.Removed)
+	return res
+}
+
+// rescanTrees adds a target for every directory below a volume dir that has
+// none, with its current content as the baseline. It is called by reconcile
+// with s.mu held.
+func (s *watchSet) rescanTrees() {
+	before := map[string]bool{}
+	for dir := range s.targets {
+		before[dir] = true
+	}
+	s.targets.addNestedTargets()
+	for dir, t := range s.targets {
+		if before[dir] {
+			continue
+		}
+		snapshot, _ := t.takeSnapshot(dir)
+		t.setSnapshot(dir, snapshot)
+	}
+}
+
+// rewatch watches dir, now the directory described by info, unless its
+// registration is still live, and reports whether it did. It is called by
+// reconcile with s.mu held, and does not write the fields of s that the lock
+// guards, so that several can run at once.
+func (s *watchSet) rewatch(dir string, info os.FileInfo) (bool, error) {
+	if s.registered[dir] {
+		if os.SameFile(s.registeredAs[dir], info) {
+			return false, nil
+		}
+		// The watch of a replaced directory is gone with it, or follows it
+		// when it was moved away.
+		_ = s.watcher.Remove(dir)
+	}
+	log.Printf("Watching directory: %q", dir)
+	return true, s.watcher.Add(dir)
+}
+
+// rewatchHandler has the event loop reconcile the watch set and reports the
+// changes.
+func (s *watchSet) rewatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	done := make(chan reconcileResult, 1)
+	select {
+	case s.reconciles <- done:
+	case <-r.Context().Done():
+		return
+	}
+	res := <-done
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
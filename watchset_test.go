@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestWatchSet returns a watch set of the volume dirs, registered as at
+// startup, whose /rewatch requests are served until the test ends.
+func newTestWatchSet(t *testing.T, volumeDirs ...string) *watchSet {
+	t.Helper()
+	targets, err := newWatchTargets(volumeDirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { watcher.Close() })
+	s := newWatchSet(watcher, targets)
+	for _, dir := range targets.dirs() {
+		if _, err := os.Stat(dir); err == nil {
+			if err := s.add(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		for {
+			select {
+			case done := <-s.reconciles:
+				done <- s.reconcile()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func rewatch(t *testing.T, s *watchSet) reconcileResult {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.rewatchHandler(rec, httptest.NewRequest(http.MethodPost, "/rewatch", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /rewatch: %d %s", rec.Code, rec.Body.String())
+	}
+	var res reconcileResult
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestMissingVolumeDir(t *testing.T) {
+	captureLog(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := newWatchTargets([]string{missing}); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing volume dir, want it to fail without -volume-dir-allow-missing", err)
+	}
+}
+
+func TestRewatchAddsDirectoryCreatedAfterStartup(t *testing.T) {
+	setFlag(t, volumeDirAllowMissing, true)
+	captureLog(t)
+	root := t.TempDir()
+	present := filepath.Join(root, "present")
+	later := filepath.Join(root, "later")
+	if err := os.Mkdir(present, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestWatchSet(t, present, later)
+	if registered, total := s.watching(); registered != 1 || total != 2 {
+		t.Fatalf("watching %d of %d directories at startup, want 1 of 2", registered, total)
+	}
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		readyHandler(s)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz responded %d while a volume dir is missing, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	if res := rewatch(t, s); len(res.Added) != 0 || len(res.Removed) != 0 {
+		t.Fatalf("rewatch before the directory exists: %+v", res)
+	}
+	if err := os.Mkdir(later, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if res := rewatch(t, s); !slices.Equal(res.Added, []string{later}) || len(res.Removed) != 0 {
+		t.Fatalf("rewatch after the directory was created: %+v, want %s added", res, later)
+	}
+	if registered, total := s.watching(); registered != 2 || total != 2 {
+		t.Fatalf("watching %d of %d directories, want 2 of 2", registered, total)
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("/readyz responded %d once every volume dir is watched, want %d", code, http.StatusOK)
+	}
+
+	if err := os.Remove(later); err != nil {
+		t.Fatal(err)
+	}
+	if res := rewatch(t, s); !slices.Equal(res.Removed, []string{later}) {
+		t.Fatalf("rewatch after the directory was removed: %+v, want %s removed", res, later)
+	}
+}
+
+func TestRewatchRescansRecursiveTrees(t *testing.T) {
+	setFlag(t, recursive, true)
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestWatchSet(t, root)
+	if _, total := s.watching(); total != 2 {
+		t.Fatalf("watching %d directories at startup, want the volume dir and a", total)
+	}
+
+	// Created while unwatched, so that no create event added them.
+	nested := filepath.Join(root, "b", "c")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "b"), nested}
+	if res := rewatch(t, s); !slices.Equal(res.Added, want) {
+		t.Fatalf("rewatch added %q, want %q", res.Added, want)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if res := rewatch(t, s); !slices.Equal(res.Removed, []string{filepath.Join(root, "a")}) {
+		t.Fatalf("rewatch removed %q, want %s", res.Removed, filepath.Join(root, "a"))
+	}
+	if registered, total := s.watching(); registered != 3 || total != 3 {
+		t.Fatalf("watching %d of %d directories, want 3 of 3", registered, total)
+	}
+}
+
+// recordingWatcher is a dirWatcher that records its calls.
+type recordingWatcher struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (w *recordingWatcher) Add(name string) error    { return w.record("add " + name) }
+func (w *recordingWatcher) Remove(name string) error { return w.record("remove " + name) }
+
+func (w *recordingWatcher) record(call string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls = append(w.calls, call)
+	return nil
+}
+
+func TestRewatchKeepsLiveWatches(t *testing.T) {
+	captureLog(t)
+	dir := filepath.Join(t.TempDir(), "config")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &recordingWatcher{}
+	s := newWatchSet(w, targets)
+	if err := s.add(dir); err != nil {
+		t.Fatal(err)
+	}
+	w.calls = nil
+
+	// Removing and adding a live watch would miss the changes in between.
+	if res := s.reconcile(); len(res.Added) != 0 || len(res.Removed) != 0 || len(w.calls) != 0 {
+		t.Fatalf("reconcile of a live watch: %+v with calls %q, want it left alone", res, w.calls)
+	}
+
+	// Replaced without an event, e.g. by a remount; the old directory is
+	// moved aside so that the new one cannot reuse its inode.
+	if err := os.Rename(dir, dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if res := s.reconcile(); !slices.Equal(res.Added, []string{dir}) {
+		t.Fatalf("reconcile of a replaced directory added %q, want %q", res.Added, dir)
+	}
+	if want := []string{"remove " + dir, "add " + dir}; !slices.Equal(w.calls, want) {
+		t.Errorf("calls %q, want %q", w.calls, want)
+	}
+}
+
+func TestRewatchRequiresPost(t *testing.T) {
+	s := newTestWatchSet(t, t.TempDir())
+	rec := httptest.NewRecorder()
+	s.rewatchHandler(rec, httptest.NewRequest(http.MethodGet, "/rewatch", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Fatalf("GET /rewatch: %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+// slowWatcher is a dirWatcher whose Add takes a while, recording the most
+// calls running at once.
+type slowWatcher struct {
+	running, most atomic.Int32
+	added         atomic.Int32
+}
+
+func (w *slowWatcher) Add(name string) error {
+	n := w.running.Add(1)
+	defer w.running.Add(-1)
+	for {
+		most := w.most.Load()
+		if n <= most || w.most.CompareAndSwap(most, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	w.added.Add(1)
+	return nil
+}
+
+func (w *slowWatcher) Remove(name string) error { return nil }
+
+func TestReconcileConcurrency(t *testing.T) {
+	const limit = 3
+	setFlag(t, rewatchConcurrency, limit)
+	captureLog(t)
+	root := t.TempDir()
+	var dirs []string
+	for i := 0; i < 10; i++ {
+		dir := filepath.Join(root, "config-"+strconv.Itoa(i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+	}
+	targets, err := newWatchTargets(dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// None are watched yet, as after they were all remounted.
+	w := &slowWatcher{}
+	res := newWatchSet(w, targets).reconcile()
+	if len(res.Added) != len(dirs) || w.added.Load() != int32(len(dirs)) {
+		t.Fatalf("added %q with %d watches, want all %d directories", res.Added, w.added.Load(), len(dirs))
+	}
+	if got := w.most.Load(); got != limit {
+		t.Errorf("%d watches were added at once, want %d", got, limit)
+	}
+}
+
+func TestLoseAndRecoverWatch(t *testing.T) {
+	logs := captureLog(t)
+	dir := filepath.Join(t.TempDir(), "config")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestWatchSet(t, dir)
+	ready := readyHandler(s)
+	readiness := func() (int, string) {
+		rec := httptest.NewRecorder()
+		ready.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code, rec.Body.String()
+	}
+	lostTotal := func() float64 { return testutil.ToFloat64(watchLost.WithLabelValues(dir)) }
+	before := lostTotal()
+
+	// Events that do not remove the volume dir itself keep its watch.
+	for _, event := range []fsnotify.Event{
+		{Name: dir, Op: fsnotify.Write},
+		{Name: filepath.Join(dir, "sub"), Op: fsnotify.Remove},
+		{Name: filepath.Join(dir, "key"), Op: fsnotify.Remove},
+	} {
+		if s.lose(event) {
+			t.Errorf("%v lost the watch", event)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !s.lose(fsnotify.Event{Name: dir, Op: fsnotify.Remove}) {
+		t.Fatal("removing the volume dir did not lose its watch")
+	}
+	if s.lose(fsnotify.Event{Name: dir, Op: fsnotify.Rename}) {
+		t.Error("a lost watch was lost again")
+	}
+	if got := lostTotal() - before; got != 1 {
+		t.Errorf("watch_lost_total increased by %g, want 1", got)
+	}
+	if got := s.lostDirs(); !slices.Equal(got, []string{dir}) {
+		t.Errorf("lost %q, want %q", got, dir)
+	}
+	if code, body := readiness(); code != http.StatusServiceUnavailable || body != "not ready: lost the watch of "+dir+" until it reappears\n" {
+		t.Errorf("/readyz while lost: %d %q", code, body)
+	}
+	if registered, _ := s.watching(); registered != 0 {
+		t.Errorf("%d directories registered, want the lost volume dir unregistered", registered)
+	}
+
+	// Once the directory reappears it is watched again in the background.
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-s.rewatched:
+		if got != dir {
+			t.Errorf("re-watched %q, want %q", got, dir)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the volume dir was not watched again once it reappeared")
+	}
+	if code, _ := readiness(); code != http.StatusOK {
+		t.Errorf("/readyz after re-watching: %d, want 200", code)
+	}
+	if !strings.Contains(logs.String(), "Watching directory again") {
+		t.Errorf("log %q does not report the re-watch", logs.String())
+	}
+
+	// A reconcile that finds the directory first ends the lost state too.
+	if !s.lose(fsnotify.Event{Name: dir, Op: fsnotify.Remove}) {
+		t.Fatal("removing the volume dir again did not lose its watch")
+	}
+	if res := s.reconcile(); !slices.Equal(res.Added, []string{dir}) {
+		t.Errorf("reconcile added %q, want %q", res.Added, dir)
+	}
+	if got := s.lostDirs(); len(got) != 0 {
+		t.Errorf("still lost %q after reconcile", got)
+	}
+	if got := lostTotal() - before; got != 2 {
+		t.Errorf("watch_lost_total increased by %g, want 2", got)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookTarget is a webhook URL together with its per-webhook options. The
+// options are given after the URL in the -webhook-url value as
+// semicolon-separated key=value pairs, see splitWebhookOptions, e.g.
+//
+//	https://a/reload;ca=/etc/ssl/a-ca.pem
+//
+// The URL must be absolute, with an http or https scheme, or ziti for a
+// webhook called over ziti, e.g.
+//
+//	ziti://prometheus/-/reload;identity=prometheus-0;dialtimeout=2s
+//
+// which dials the service named by the host, -ziti.service if it has none,
+// with the dial options given, the -ziti. flags for the others.
+//
+// ${VAR} placeholders in the value are replaced with the environment
+// variable VAR.
+type webhookTarget struct {
+	*url.URL
+
+	// caFile is a PEM bundle the webhook's TLS certificate is verified
+	// against instead of the system roots.
+	caFile string
+
+	// headers are sent with every request to the webhook.
+	headers []webhookHeader
+
+	// method and status override -webhook-method and -webhook-status-code
+	// for the webhook when set.
+	method string
+	status int
+
+	// identity, appData and dialTimeout are what a ziti:// webhook is
+	// dialed with instead of -ziti.target.identity, no app data and
+	// -ziti.dial.timeout.
+	identity    string
+	appData     string
+	dialTimeout time.Duration
+
+	// canary webhooks are called before the others, which are only called
+	// if all canaries succeeded.
+	canary bool
+
+	// client is the webhook's own client, if its options require a
+	// dedicated transport.
+	client *http.Client
+}
+
+func parseWebhookTarget(value string) (*webhookTarget, error) {
+	value, err := expandEnv(value)
+	if err != nil {
+		return nil, err
+	}
+	rawURL, opts := splitWebhookOptions(value)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "ziti":
+	default:
+		return nil, fmt.Errorf("invalid URL: must have an http, https or ziti scheme")
+	}
+	if u.Host == "" && u.Scheme != "ziti" {
+		return nil, fmt.Errorf("invalid URL: must have a host")
+	}
+	h := &webhookTarget{URL: u}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		switch key, val := kv[0], kv[1]; key {
+		case "ca":
+			h.caFile = val
+		case "identity", "appdata", "dialtimeout":
+			if u.Scheme != "ziti" {
+				return nil, fmt.Errorf("invalid webhook option %s=%q: only valid for ziti:// URLs", key, val)
+			}
+			switch key {
+			case "identity":
+				h.identity = val
+			case "appdata":
+				h.appData = val
+			case "dialtimeout":
+				timeout, err := time.ParseDuration(val)
+				if err != nil || timeout <= 0 {
+					return nil, fmt.Errorf("invalid webhook option dialtimeout=%q: not a positive duration", val)
+				}
+				h.dialTimeout = timeout
+			}
+		case "canary":
+			canary, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid webhook option canary=%q: %v", val, err)
+			}
+			h.canary = canary
+		case "method":
+			if val == "" || !isHeaderToken(val) {
+				return nil, fmt.Errorf("invalid webhook option method=%q: not a valid HTTP method", val)
+			}
+			h.method = val
+		case "status":
+			status, err := strconv.Atoi(val)
+			if err != nil || status < 100 || status > 999 {
+				return nil, fmt.Errorf("invalid webhook option status=%q: not an HTTP status code", val)
+			}
+			h.status = status
+		case "header":
+			hdr, err := parseWebhookHeader(val)
+			if err != nil {
+				return nil, err
+			}
+			h.headers = append(h.headers, hdr)
+		}
+	}
+	return h, nil
+}
+
+// webhookOptions are the keys of the per-webhook options.
+var webhookOptions = map[string]bool{
+	"ca": true, "canary": true, "method": true, "status": true, "header": true,
+	"identity": true, "appdata": true, "dialtimeout": true,
+}
+
+// splitWebhookOptions splits a -webhook-url value into the URL and its
+// options. Only the trailing semicolon-separated key=value segments with the
+// key of a webhook option are options, so that a URL with semicolons of its
+// own, e.g. http://a/reload;jsessionid=1, is kept whole.
+func splitWebhookOptions(value string) (string, []string) {
+	parts := strings.Split(value, ";")
+	i := len(parts)
+	for i > 1 {
+		key, _, ok := strings.Cut(parts[i-1], "=")
+		if !ok || !webhookOptions[key] {
+			break
+		}
+		i--
+	}
+	return strings.Join(parts[:i], ";"), parts[i:]
+}
+
+// zitiDial returns the options to dial a ziti:// webhook with: the service
+// named by its host and its own identity, app data and dial timeout, with
+// the -ziti. flags for those it does not set.
+func (h *webhookTarget) zitiDial() zitiDial {
+	d := zitiDial{service: h.Hostname(), identity: h.identity, timeout: h.dialTimeout}
+	if h.appData != "" {
+		d.appData = []byte(h.appData)
+	}
+	if d.service == "" {
+		d.service = *zitiService
+	}
+	if d.identity == "" {
+		d.identity = *zitiTarget
+	}
+	if d.timeout == 0 {
+		d.timeout = *zitiDialTimeout
+	}
+	return d
+}
+
+// display returns the URL of h as it is persisted or shown on the web page,
+// without its password and query, which may carry a token.
+func (h *webhookTarget) display() string {
+	c := *h.URL
+	c.RawQuery = ""
+	c.ForceQuery = false
+	return c.Redacted()
+}
+
+// httpMethod returns the HTTP method to send the webhook with.
+func (h *webhookTarget) httpMethod() string {
+	if h.method != "" {
+		return h.method
+	}
+	return *webhookMethod
+}
+
+// successStatus returns the status code indicating that the webhook
+// triggered the reload, def unless the webhook has its own.
+func (h *webhookTarget) successStatus(def int) int {
+	if h.status != 0 {
+		return h.status
+	}
+	return def
+}
+
+// webhookHeader is a header given with -webhook-header or the header option
+// as "Name: value". A value ending in "@path", e.g. "Bearer @path", takes the
+// rest of the value from the file at path whenever a request is sent, so that
+// rotated credentials such as bearer tokens are picked up.
+type webhookHeader struct {
+	name  string
+	value string
+	file  string
+}
+
+func parseWebhookHeader(s string) (webhookHeader, error) {
+	kv := strings.SplitN(s, ":", 2)
+	name := strings.TrimSpace(kv[0])
+	if len(kv) != 2 || name == "" {
+		return webhookHeader{}, fmt.Errorf("invalid webhook header %q: expected Name: value", s)
+	}
+	if !isHeaderToken(name) {
+		return webhookHeader{}, fmt.Errorf("invalid webhook header %q: %q is not a valid header name", s, name)
+	}
+	value := strings.TrimSpace(kv[1])
+	if strings.ContainsAny(value, "\r\n") {
+		return webhookHeader{}, fmt.Errorf("invalid webhook header %q: value contains a line break", s)
+	}
+	if i := strings.LastIndex(value, "@"); i >= 0 && (i == 0 || value[i-1] == ' ') && !strings.Contains(value[i:], " ") {
+		return webhookHeader{name: name, value: value[:i], file: value[i+1:]}, nil
+	}
+	return webhookHeader{name: name, value: value}, nil
+}
+
+// envHeadersFlag holds the -webhook-env-header values, headers whose values
+// are taken from environment variables when the flag is parsed, e.g. the pod
+// metadata exposed through the Kubernetes downward API. Headers of unset or
+// empty variables are not sent.
+type envHeadersFlag []webhookHeader
+
+func (v *envHeadersFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	name := strings.TrimSpace(kv[0])
+	if len(kv) != 2 || name == "" || strings.TrimSpace(kv[1]) == "" {
+		return fmt.Errorf("invalid webhook env header %q: expected Name=VAR", value)
+	}
+	if !isHeaderToken(name) {
+		return fmt.Errorf("invalid webhook env header %q: %q is not a valid header name", value, name)
+	}
+	env := os.Getenv(strings.TrimSpace(kv[1]))
+	if strings.ContainsAny(env, "\r\n") {
+		return fmt.Errorf("invalid webhook env header %q: value contains a line break", value)
+	}
+	if env != "" {
+		*v = append(*v, webhookHeader{name: name, value: env})
+	}
+	return nil
+}
+
+func (v *envHeadersFlag) String() string {
+	return fmt.Sprint(*v)
+}
+
+// isHeaderToken reports whether s is a valid header name, i.e. an RFC 7230
+// token.
+func isHeaderToken(s string) bool {
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve returns the value of the header, reading the rest of it from its
+// file if it has one. Surrounding whitespace of the file content, e.g. a
+// trailing newline, is trimmed.
+func (hdr webhookHeader) resolve() (string, error) {
+	if hdr.file == "" {
+		return hdr.value, nil
+	}
+	data, err := os.ReadFile(hdr.file)
+	if err != nil {
+		return "", fmt.Errorf("reading value of header %s: %v", hdr.name, err)
+	}
+	return hdr.value + strings.TrimSpace(string(data)), nil
+}
+
+var envPlaceholder = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} placeholders in s with the value of the
+// environment variable VAR, so that the same manifest can be used across
+// environments. Unlike os.ExpandEnv it fails on unset variables and leaves
+// a bare $ alone, as both are more likely mistakes than intent in a URL.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	expanded := envPlaceholder.ReplaceAllStringFunc(s, func(m string) string {
+		name := envPlaceholder.FindStringSubmatch(m)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unset environment variable(s) referenced: %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// httpClient returns the client to send h's requests with, which is either
+// its own client or def.
+func (h *webhookTarget) httpClient(def *http.Client) *http.Client {
+	if h.client != nil {
+		return h.client
+	}
+	return def
+}
+
+// configureClient gives h a dedicated client derived from base if its
+// options require one.
+func (h *webhookTarget) configureClient(base *http.Transport) error {
+	if h.caFile == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(h.caFile)
+	if err != nil {
+		return fmt.Errorf("reading CA bundle for %s: %v", h.Redacted(), err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in CA bundle %s for %s", h.caFile, h.Redacted())
+	}
+	transport := base.Clone()
+	transport.TLSClientConfig.RootCAs = pool
+	h.client = newWebhookClient(transport)
+	return nil
+}
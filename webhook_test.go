@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitWebhookOptions(t *testing.T) {
+	tests := []struct {
+		value    string
+		wantURL  string
+		wantOpts []string
+	}{
+		{"http://a/reload", "http://a/reload", []string{}},
+		{"http://a/reload;jsessionid=1", "http://a/reload;jsessionid=1", []string{}},
+		{"http://a/reload;jsessionid=1;status=204", "http://a/reload;jsessionid=1", []string{"status=204"}},
+		{"http://a/reload;method=PUT;status=204", "http://a/reload", []string{"method=PUT", "status=204"}},
+		{"http://a/reload;header=Authorization: Bearer x=y", "http://a/reload", []string{"header=Authorization: Bearer x=y"}},
+		{"http://a/x;y;ca=/ca.pem", "http://a/x;y", []string{"ca=/ca.pem"}},
+		// A known key before a segment of the URL's own is part of the URL.
+		{"http://a/reload;status=204;v=2", "http://a/reload;status=204;v=2", []string{}},
+	}
+	for _, tt := range tests {
+		u, opts := splitWebhookOptions(tt.value)
+		if u != tt.wantURL || !slices.Equal(opts, tt.wantOpts) {
+			t.Errorf("splitWebhookOptions(%q) = %q, %q, want %q, %q", tt.value, u, opts, tt.wantURL, tt.wantOpts)
+		}
+	}
+}
+
+func TestParseWebhookTarget(t *testing.T) {
+	h := mustParseWebhook(t, "http://a/reload;jsessionid=1;method=PUT;status=204;canary=true")
+	if h.String() != "http://a/reload;jsessionid=1" || h.method != "PUT" || h.status != 204 || !h.canary {
+		t.Errorf("got %s with method %q, status %d, canary %v", h, h.method, h.status, h.canary)
+	}
+
+	for value, wantErr := range map[string]string{
+		"a/reload":                          "must have an http, https or ziti scheme",
+		"ftp://a/reload":                    "must have an http, https or ziti scheme",
+		"http:///reload":                    "must have a host",
+		"http://a/reload;status=99":         "not an HTTP status code",
+		"http://a/reload;method=GE T":       "not a valid HTTP method",
+		"http://a/reload;canary=maybe":      "invalid webhook option canary",
+		"http://a/reload;identity=x":        "only valid for ziti:// URLs",
+		"ziti://svc/reload;dialtimeout=-1s": "not a positive duration",
+	} {
+		if _, err := parseWebhookTarget(value); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("parseWebhookTarget(%q) returned %v, want %q", value, err, wantErr)
+		}
+	}
+	if h := mustParseWebhook(t, "ziti:///reload;identity=a;appdata=x;dialtimeout=2s"); h.zitiDial().service != *zitiService {
+		t.Errorf("ziti:// webhook without a host dials %q, want -ziti.service", h.zitiDial().service)
+	}
+}
+
+func TestWebhookCA(t *testing.T) {
+	a, b := newTestCert(t, "a"), newTestCert(t, "b")
+	srvA := newTLSServer(t, &tls.Config{Certificates: []tls.Certificate{a.cert}})
+	srvB := newTLSServer(t, &tls.Config{Certificates: []tls.Certificate{b.cert}})
+	base, err := newWebhookTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		ca      string
+		wantErr bool
+	}{
+		{name: "a trusting a", url: srvA.URL, ca: a.writeCA(t)},
+		{name: "b trusting b", url: srvB.URL, ca: b.writeCA(t)},
+		{name: "a trusting b", url: srvA.URL, ca: b.writeCA(t), wantErr: true},
+		{name: "no ca", url: srvB.URL, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := tt.url + "/reload"
+			if tt.ca != "" {
+				value += ";ca=" + tt.ca
+			}
+			h := mustParseWebhook(t, value)
+			if err := h.configureClient(base); err != nil {
+				t.Fatal(err)
+			}
+			r := testReloader(base, h)
+			err := r.fire(context.Background(), h, reloadEvent{id: newReloadID()})
+			if tt.wantErr != (err != nil) {
+				t.Errorf("fire returned %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookEnvExpansion(t *testing.T) {
+	t.Setenv("RELOAD_HOST", "app.prod.svc")
+	t.Setenv("RELOAD_TOKEN", "s3cret")
+	t.Setenv("RELOAD_EMPTY", "")
+
+	h := mustParseWebhook(t, "http://${RELOAD_HOST}:9090/-/reload?token=${RELOAD_TOKEN}${RELOAD_EMPTY}")
+	if got, want := h.String(), "http://app.prod.svc:9090/-/reload?token=s3cret"; got != want {
+		t.Errorf("parsed %s, want %s", got, want)
+	}
+	// A bare $ is not a placeholder.
+	if h := mustParseWebhook(t, "http://a/reload?price=$5"); h.String() != "http://a/reload?price=$5" {
+		t.Errorf("parsed %s, want the $ kept", h)
+	}
+
+	_, err := parseWebhookTarget("http://${RELOAD_HOST}/reload?token=${RELOAD_MISSING}&user=${RELOAD_USER_MISSING}")
+	if err == nil || !strings.Contains(err.Error(), "unset environment variable(s) referenced: RELOAD_MISSING, RELOAD_USER_MISSING") {
+		t.Errorf("parsing with unset variables returned %v, want them named", err)
+	}
+}
+
+func TestWebhookHeaderFile(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	writeFile(t, token, "first\n")
+	hdr, err := parseWebhookHeader("Authorization: Bearer @" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, &webhookHeaders, headersFlag{hdr})
+	own := mustParseWebhook(t, "http://webhook-header-file/reload;header=X-Token: @"+token)
+	rt := &countingTransport{statuses: []int{200}}
+	r := testReloader(rt, own)
+
+	for _, content := range []string{"first", "rotated"} {
+		replaceFile(t, token, content+"\n")
+		if err := r.fire(context.Background(), own, reloadEvent{id: newReloadID()}); err != nil {
+			t.Fatal(err)
+		}
+		req := rt.requests[len(rt.requests)-1]
+		if got := req.Header.Get("Authorization"); got != "Bearer "+content {
+			t.Errorf("sent Authorization %q, want Bearer %s", got, content)
+		}
+		if got := req.Header.Get("X-Token"); got != content {
+			t.Errorf("sent X-Token %q, want %s", got, content)
+		}
+	}
+
+	for value, want := range map[string]webhookHeader{
+		"X-Token: @/run/secrets/token":    {name: "X-Token", file: "/run/secrets/token"},
+		"Authorization: Bearer @/run/tok": {name: "Authorization", value: "Bearer ", file: "/run/tok"},
+		"X-Mail: ops@example.com":         {name: "X-Mail", value: "ops@example.com"},
+		"X-Note: @ not a file":            {name: "X-Note", value: "@ not a file"},
+	} {
+		got, err := parseWebhookHeader(value)
+		if err != nil || got != want {
+			t.Errorf("parseWebhookHeader(%q) = %+v, %v, want %+v", value, got, err, want)
+		}
+	}
+}
+
+func TestHeadersFlag(t *testing.T) {
+	var v headersFlag
+	for _, value := range []string{"Authorization: Bearer abc", "X-Reload-Token:  t0k3n "} {
+		if err := v.Set(value); err != nil {
+			t.Fatalf("Set(%q): %v", value, err)
+		}
+	}
+	want := headersFlag{{name: "Authorization", value: "Bearer abc"}, {name: "X-Reload-Token", value: "t0k3n"}}
+	if !slices.Equal(v, want) {
+		t.Errorf("parsed %+v, want %+v", v, want)
+	}
+
+	for value, wantErr := range map[string]string{
+		"Authorization":        "expected Name: value",
+		": value":              "expected Name: value",
+		"Bad Name: value":      `"Bad Name" is not a valid header name`,
+		"X-Token: a\nInjected": "value contains a line break",
+	} {
+		if err := v.Set(value); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("Set(%q) returned %v, want %q", value, err, wantErr)
+		}
+	}
+}
+
+func TestWebhookEnvHeaders(t *testing.T) {
+	t.Setenv("POD_NAME", "app-7d9f-x2k")
+	t.Setenv("POD_NAMESPACE", "prod")
+	t.Setenv("NODE_NAME", "")
+	var v envHeadersFlag
+	for _, value := range []string{"X-Pod-Name=POD_NAME", "X-Pod-Namespace = POD_NAMESPACE", "X-Node-Name=NODE_NAME", "X-Unset=CONFIGMAP_RELOAD_UNSET"} {
+		if err := v.Set(value); err != nil {
+			t.Fatalf("Set(%q): %v", value, err)
+		}
+	}
+	setFlag(t, &envHeaders, v)
+
+	h := mustParseWebhook(t, "http://webhook-env-headers/reload")
+	rt := &countingTransport{statuses: []int{200}}
+	if err := testReloader(rt, h).fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+		t.Fatal(err)
+	}
+	header := rt.requests[0].Header
+	if got := header.Get("X-Pod-Name"); got != "app-7d9f-x2k" {
+		t.Errorf("sent X-Pod-Name %q, want the value of POD_NAME", got)
+	}
+	if got := header.Get("X-Pod-Namespace"); got != "prod" {
+		t.Errorf("sent X-Pod-Namespace %q, want the value of POD_NAMESPACE", got)
+	}
+	// Headers of empty or unset variables are not sent.
+	for _, name := range []string{"X-Node-Name", "X-Unset"} {
+		if _, ok := header[name]; ok {
+			t.Errorf("sent %s %q, want it left out", name, header.Get(name))
+		}
+	}
+
+	t.Setenv("BROKEN", "a\r\nInjected: x")
+	for value, wantErr := range map[string]string{
+		"X-Pod-Name":        "expected Name=VAR",
+		"=POD_NAME":         "expected Name=VAR",
+		"Bad Name=POD_NAME": `"Bad Name" is not a valid header name`,
+		"X-Broken=BROKEN":   "value contains a line break",
+	} {
+		if err := v.Set(value); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("Set(%q) returned %v, want %q", value, err, wantErr)
+		}
+	}
+}
+
+func TestWebhookFlagSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{value: "http://a/reload"},
+		{value: "https://a.example.com:8443/-/reload?force=1"},
+		{value: "HTTP://a/reload"},
+		{value: "http://admin:s3cret@a/reload"},
+		{value: "https://user@a:8443/reload"},
+		{value: "http://[::1]:9090/-/reload"},
+		{value: "ziti://reload-service/reload"},
+		{value: "", wantErr: "must have an http, https or ziti scheme"},
+		{value: "a/reload", wantErr: "must have an http, https or ziti scheme"},
+		{value: "localhost:9090/-/reload", wantErr: "must have an http, https or ziti scheme"},
+		{value: "//a/reload", wantErr: "must have an http, https or ziti scheme"},
+		{value: "file:///etc/reload", wantErr: "must have an http, https or ziti scheme"},
+		{value: "http:/reload", wantErr: "must have a host"},
+		{value: "https://", wantErr: "must have a host"},
+		{value: "http://admin:s3cret@/reload", wantErr: "must have a host"},
+		{value: "http://a b/reload", wantErr: "invalid URL"},
+	}
+	for _, tt := range tests {
+		var v webhookFlag
+		err := v.Set(tt.value)
+		if tt.wantErr == "" {
+			if err != nil || len(v) != 1 {
+				t.Errorf("Set(%q) returned %v, want it accepted", tt.value, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) || len(v) != 0 {
+			t.Errorf("Set(%q) returned %v, want %q", tt.value, err, tt.wantErr)
+		}
+	}
+	// The password of a URL with userinfo is kept for the requests but not
+	// shown.
+	h := mustParseWebhook(t, "http://admin:s3cret@a/reload")
+	if h.URL.User.Username() != "admin" || strings.Contains(h.Redacted(), "s3cret") {
+		t.Errorf("parsed user %q, shown as %s", h.URL.User.Username(), h.Redacted())
+	}
+}
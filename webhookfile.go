@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+// readWebhookFile returns the webhooks of the -webhook-url-file at path,
+// which lists one -webhook-url value per line, e.g. from a ConfigMap that
+// manages the reload targets. Blank lines and lines starting with "#" are
+// ignored.
+func readWebhookFile(path string) ([]*webhookTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading webhook-url-file: %v", err)
+	}
+	return parseWebhookFile(path, data)
+}
+
+func parseWebhookFile(path string, data []byte) ([]*webhookTarget, error) {
+	var webhooks []*webhookTarget
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		h, err := parseWebhookTarget(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook-url-file %s, line %d: %v", path, i+1, err)
+		}
+		webhooks = append(webhooks, h)
+	}
+	return webhooks, nil
+}
+
+// watchWebhookFile re-reads the -webhook-url-file at path whenever it
+// changes and passes its webhooks, each given its client by prepare, to
+// apply. A file that cannot be read or has an invalid line is logged once
+// and the current webhooks are kept until it changes again. The directory
+// of the file is watched, so that a file mounted from a ConfigMap is seen
+// when its "..data" symlink is swapped.
+func watchWebhookFile(path string, prepare func(*webhookTarget) error, apply func([]*webhookTarget)) error {
+	last, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	reload := func() error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading webhook-url-file: %v", err)
+		}
+		if bytes.Equal(data, last) {
+			return nil
+		}
+		last = data
+		webhooks, err := parseWebhookFile(path, data)
+		if err != nil {
+			return err
+		}
+		for _, h := range webhooks {
+			if err := prepare(h); err != nil {
+				return err
+			}
+		}
+		log.Printf("webhook-url-file %s changed, now calling %d webhook(s) from it", path, len(webhooks))
+		apply(webhooks)
+		return nil
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if err := reload(); err != nil {
+					log.Printf("error: %v; keeping the current webhooks", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("error:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// currentWebhooks returns the webhooks to call for a reload.
+func (r *reloader) currentWebhooks() []*webhookTarget {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.webhooks
+}
+
+// setWebhooks replaces the webhooks to call, from the next reload on.
+func (r *reloader) setWebhooks(webhooks []*webhookTarget) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.webhooks = webhooks
+	consecutiveFailures.retain(append(append([]*webhookTarget{}, webhooks...), teardownWebhook...))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlTriggers maps keys to the YAML paths whose values must change for a
+// change of the key to trigger a reload. Keys without a path trigger on any
+// change.
+type yamlTriggers map[string][]string
+
+var triggers = yamlTriggers{}
+
+// Set parses a -yaml-trigger value of the form key=path, where path is a
+// dot-separated list of mapping keys and sequence indexes, e.g.
+// config.yaml=server.listeners.0.port.
+func (t yamlTriggers) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid yaml-trigger %q: must be key=path", value)
+	}
+	t[parts[0]] = append(t[parts[0]], strings.TrimPrefix(parts[1], "."))
+	return nil
+}
+
+func (t yamlTriggers) String() string {
+	return fmt.Sprint(map[string][]string(t))
+}
+
+// filter returns the keys whose change triggers a reload: those without a
+// YAML path, and those where the value of one of their paths changed between
+// old and new, or whose content was not read.
+func (t yamlTriggers) filter(old, new dirSnapshot, keys []string) []string {
+	var filtered []string
+	for _, k := range keys {
+		paths, ok := t[k]
+		if !ok || old[k].unread || new[k].unread || yamlPathsChanged(old[k].data, new[k].data, paths) {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered
+}
+
+// yamlPathsChanged reports whether the value of any of paths differs between
+// the YAML documents in old and new. Content that cannot be parsed counts as
+// changed, so that a broken config is not silently ignored.
+func yamlPathsChanged(old, new []byte, paths []string) bool {
+	for _, p := range paths {
+		o, err := yamlPathValue(old, p)
+		if err != nil {
+			return true
+		}
+		n, err := yamlPathValue(new, p)
+		if err != nil {
+			return true
+		}
+		if o != n {
+			return true
+		}
+	}
+	return false
+}
+
+// yamlPathValue returns the values at path in every document of data,
+// canonically encoded, so that formatting and comments do not matter.
+// Documents without the path contribute an empty value.
+func yamlPathValue(data []byte, path string) (string, error) {
+	var values []interface{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc interface{}
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		values = append(values, lookupYAMLPath(doc, path))
+	}
+	out, err := yaml.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func lookupYAMLPath(v interface{}, path string) interface{} {
+	if path == "" {
+		return v
+	}
+	for _, seg := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[seg]
+		case map[interface{}]interface{}:
+			v = node[seg]
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+)
+
+func TestYAMLTrigger(t *testing.T) {
+	setFlag(t, &triggers, yamlTriggers{"config.yaml": {"server.listeners.0.port"}})
+	const base = "server:\n  listeners:\n    - port: 8080\n  name: app\n"
+	tests := []struct {
+		name     string
+		config   string
+		wantFire bool
+	}{
+		{name: "unrelated field", config: "server:\n  listeners:\n    - port: 8080\n  name: other\n"},
+		{name: "comments and formatting", config: "# tuned\nserver: {listeners: [{port: 8080}], name: app}\n"},
+		{name: "watched path", config: "server:\n  listeners:\n    - port: 9090\n  name: app\n", wantFire: true},
+		{name: "watched path removed", config: "server:\n  name: app\n", wantFire: true},
+		{name: "another document", config: base + "---\nserver:\n  listeners:\n    - port: 1\n", wantFire: true},
+		{name: "invalid YAML", config: "server: [\n", wantFire: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeConfigMap(t, dir, "v1", map[string]string{"config.yaml": base})
+			targets, err := newWatchTargets([]string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeConfigMap(t, dir, "v2", map[string]string{"config.yaml": tt.config})
+			if _, fire := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create}); fire != tt.wantFire {
+				t.Errorf("change fires: %v, want %v", fire, tt.wantFire)
+			}
+		})
+	}
+}
+
+func TestYAMLTriggerOtherKeys(t *testing.T) {
+	// Keys without a path trigger on any change, even alongside a key
+	// whose path did not change.
+	setFlag(t, &triggers, yamlTriggers{"config.yaml": {"port"}})
+	dir := t.TempDir()
+	writeConfigMap(t, dir, "v1", map[string]string{"config.yaml": "port: 1\nname: a\n", "other": "1"})
+	targets, err := newWatchTargets([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, other := range []string{"1", "2"} {
+		writeConfigMap(t, dir, "v"+strconv.Itoa(i+2), map[string]string{"config.yaml": "port: 1\nname: " + other + "\n", "other": other})
+		ev, fire := targets.change(fsnotify.Event{Name: filepath.Join(dir, "..data"), Op: fsnotify.Create})
+		if wantFire := other == "2"; fire != wantFire {
+			t.Errorf("update %d fires: %v, want %v", i+1, fire, wantFire)
+		}
+		if fire && (len(ev.keys) != 1 || ev.keys[0] != "other") {
+			t.Errorf("update %d reloads for %q, want other only", i+1, ev.keys)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	fsnotify "github.com/fsnotify/fsnotify"
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/openziti/sdk-golang/ziti/config"
+)
+
+// setupZiti returns the client to call webhooks with over transport and,
+// with ziti:// webhooks, the dialer of their ziti transport. The ziti
+// transport is used when -ziti.enabled is set or the identity file exists;
+// otherwise webhooks are called over plain HTTP. With ziti:// webhooks the
+// transport is chosen per webhook instead: those are called over ziti and
+// the others over plain HTTP.
+func setupZiti(transport *http.Transport, webhooks []*webhookTarget) (*http.Client, *zitiDialer, error) {
+	if *zitiDialTimeout <= 0 {
+		return nil, nil, fmt.Errorf("invalid ziti.dial.timeout %s: must be positive", *zitiDialTimeout)
+	}
+	httpClient := newWebhookClient(transport)
+	var zitiWebhooks []*webhookTarget
+	var webhookDialer *zitiDialer
+	for _, h := range webhooks {
+		if h.Scheme == "ziti" {
+			zitiWebhooks = append(zitiWebhooks, h)
+		}
+	}
+	_, statErr := os.Stat(*zitiIdentityFile)
+	if *zitiEnabled || statErr == nil || len(zitiWebhooks) > 0 {
+		log.Println("creating ziti context using file at: ", *zitiIdentityFile)
+		dialer, err := newZitiDialer(*zitiIdentityFile)
+		if err != nil && (*zitiEnabled || len(zitiWebhooks) > 0) {
+			return nil, nil, err
+		}
+		if err == nil {
+			if err := dialer.watch(); err != nil {
+				log.Println("error: watching ziti identity file:", err)
+			}
+			if len(zitiWebhooks) > 0 {
+				webhookDialer = dialer
+			} else {
+				zitiTransport := transport.Clone() // copy webhook transport
+				zitiTransport.DialContext = dialer.DialContext
+				httpClient = newWebhookClient(zitiTransport)
+			}
+		} else {
+			log.Println("error: creating ziti context:", err)
+		}
+	}
+	switch {
+	case len(zitiWebhooks) > 0:
+		log.Println("using ziti transport for ziti:// webhooks and plain HTTP transport for the others")
+	case httpClient.Transport == transport:
+		log.Println("using plain HTTP transport for webhooks")
+	default:
+		log.Printf("using ziti transport for webhooks, dialing service %q", *zitiService)
+	}
+	return httpClient, webhookDialer, nil
+}
+
+// zitiDialer dials the ziti service through a context created from the
+// identity file, and rebuilds the context when the identity file is rotated
+// on disk so that long-running processes pick up new credentials.
+type zitiDialer struct {
+	file string
+
+	mu       sync.RWMutex
+	context  ziti.Context
+	identity []byte
+	// dialed reports whether context was dialed with. A context that never
+	// dialed holds nothing to release, and the SDK panics when closing it
+	// as its controller client was never initialized.
+	dialed bool
+	// dials tracks the dials in progress with context, which a replaced
+	// context is only closed after.
+	dials *sync.WaitGroup
+}
+
+func newZitiDialer(file string) (*zitiDialer, error) {
+	z := &zitiDialer{file: file}
+	if err := z.load(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// load creates a context from the identity file, replacing the current one
+// and closing it once the dials in progress with it returned, unless the
+// identity is unchanged.
+func (z *zitiDialer) load() error {
+	identity, err := os.ReadFile(z.file)
+	if err != nil {
+		return err
+	}
+	z.mu.RLock()
+	unchanged := z.context != nil && bytes.Equal(identity, z.identity)
+	z.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	cfg, err := config.NewFromFile(z.file)
+	if err != nil {
+		return err
+	}
+	zitiContext := ziti.NewContextWithConfig(cfg)
+
+	z.mu.Lock()
+	old, dialed, dials := z.context, z.dialed, z.dials
+	z.context = zitiContext
+	z.identity = identity
+	z.dialed = false
+	z.dials = nil
+	z.mu.Unlock()
+	if old != nil {
+		log.Println("ziti identity file changed, rebuilt ziti context")
+		zitiIdentityReloads.Inc()
+		if dialed {
+			dials.Wait()
+			old.Close()
+		}
+	}
+	return nil
+}
+
+func (z *zitiDialer) DialContext(_ context.Context, _ string, addr string) (net.Conn, error) {
+	return z.dial(zitiDial{service: *zitiService, identity: *zitiTarget, timeout: *zitiDialTimeout})
+}
+
+// zitiDial holds what a connection to a ziti service is dialed with: the
+// -ziti. flags, or the options of a ziti:// webhook.
+type zitiDial struct {
+	service string
+	// identity is the target identity to dial through, any if empty.
+	identity string
+	appData  []byte
+	timeout  time.Duration
+}
+
+func (z *zitiDialer) dial(d zitiDial) (net.Conn, error) {
+	log.Println("dialing service: ", d.service)
+	dialOpts := &ziti.DialOptions{
+		ConnectTimeout: d.timeout,
+		AppData:        d.appData,
+	}
+	if d.identity != "" {
+		log.Println("using target identity: ", d.identity)
+		dialOpts.Identity = d.identity
+	}
+	z.mu.Lock()
+	zitiContext := z.context
+	z.dialed = true
+	if z.dials == nil {
+		z.dials = &sync.WaitGroup{}
+	}
+	dials := z.dials
+	dials.Add(1)
+	z.mu.Unlock()
+	conn, err := zitiContext.DialWithOptions(d.service, dialOpts)
+	dials.Done()
+	if err != nil {
+		return nil, err
+	}
+	return newCountedConn(conn), nil
+}
+
+// webhookClient returns the client of h, a ziti:// webhook, which dials with
+// the options of h over a transport derived from base.
+func (z *zitiDialer) webhookClient(base *http.Transport, h *webhookTarget) *http.Client {
+	d := h.zitiDial()
+	transport := base.Clone()
+	transport.DialContext = func(context.Context, string, string) (net.Conn, error) {
+		return z.dial(d)
+	}
+	return newWebhookClient(zitiScheme{transport: transport, service: d.service})
+}
+
+// zitiScheme sends the requests of a ziti:// webhook as plain HTTP over its
+// ziti transport. A URL without a host is sent with the service as host.
+type zitiScheme struct {
+	transport *http.Transport
+	service   string
+}
+
+func (z zitiScheme) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "ziti" {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+		if req.URL.Host == "" {
+			req.URL.Host = z.service
+		}
+	}
+	return z.transport.RoundTrip(req)
+}
+
+// countedConn tracks a ziti connection in the open connections gauge until
+// it is closed, so that connections leaked by unclosed responses show up.
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func newCountedConn(conn net.Conn) *countedConn {
+	zitiOpenConnections.Inc()
+	return &countedConn{Conn: conn}
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(zitiOpenConnections.Dec)
+	return c.Conn.Close()
+}
+
+// watch rebuilds the context whenever the identity file changes. The
+// directory of the file is watched, rather than the file itself, so that an
+// identity mounted from a Kubernetes Secret is seen when its "..data"
+// symlink is swapped.
+func (z *zitiDialer) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(z.file)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if err := z.load(); err != nil {
+					log.Println("error: reloading ziti identity:", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("error:", err)
+			}
+		}
+	}()
+	return nil
+}
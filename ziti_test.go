@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeZitiIdentity writes an identity file for the controller at ztAPI with
+// a fresh certificate, as enrolling an identity does.
+func writeZitiIdentity(t *testing.T, path, ztAPI string) {
+	t.Helper()
+	c := newTestCert(t, "identity")
+	data, err := json.Marshal(map[string]interface{}{
+		"ztAPI": ztAPI,
+		"id": map[string]string{
+			"cert": "pem:" + string(c.certPEM),
+			"key":  "pem:" + string(c.keyPEM),
+			"ca":   "pem:" + string(c.certPEM),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replaced by a rename, as a rotation of a mounted Secret does.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZitiIdentityRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "identity.json")
+	writeZitiIdentity(t, file, "https://127.0.0.1:1")
+	z, err := newZitiDialer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := func() ziti.Context {
+		z.mu.RLock()
+		defer z.mu.RUnlock()
+		return z.context
+	}
+	first := current()
+	reloads := testutil.ToFloat64(zitiIdentityReloads)
+
+	// An event without a change of the identity keeps the context.
+	if err := z.load(); err != nil {
+		t.Fatal(err)
+	}
+	if current() != first {
+		t.Fatal("the context was rebuilt for an unchanged identity")
+	}
+
+	if err := z.watch(); err != nil {
+		t.Fatal(err)
+	}
+	writeZitiIdentity(t, file, "https://127.0.0.1:1")
+	deadline := time.Now().Add(5 * time.Second)
+	for current() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("the context was not rebuilt after the identity was rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(zitiIdentityReloads) - reloads; got != 1 {
+		t.Errorf("counted %g identity reloads, want 1", got)
+	}
+}
+
+func TestZitiContextClosedOnlyIfDialed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	captureLog(t)
+	file := filepath.Join(t.TempDir(), "identity.json")
+	writeZitiIdentity(t, file, "https://127.0.0.1:1")
+
+	// A context that never dialed is replaced without closing it.
+	undialed := &recordingZitiContext{addr: srv.Listener.Addr().String(), dials: map[string]ziti.DialOptions{}}
+	z := &zitiDialer{file: file, context: undialed}
+	if err := z.load(); err != nil {
+		t.Fatal(err)
+	}
+	if undialed.wasClosed() {
+		t.Error("closed a context that never dialed")
+	}
+
+	// One that dialed is closed once the identity is rotated.
+	dialed := &recordingZitiContext{addr: srv.Listener.Addr().String(), dials: map[string]ziti.DialOptions{}}
+	z.mu.Lock()
+	z.context = dialed
+	z.mu.Unlock()
+	conn, err := z.dial(zitiDial{service: "s", timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	writeZitiIdentity(t, file, "https://127.0.0.1:2")
+	if err := z.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !dialed.wasClosed() {
+		t.Error("the dialed context was not closed after the identity was rotated")
+	}
+}
+
+func TestZitiContextClosedAfterDials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	captureLog(t)
+	file := filepath.Join(t.TempDir(), "identity.json")
+	writeZitiIdentity(t, file, "https://127.0.0.1:1")
+	held := &recordingZitiContext{addr: srv.Listener.Addr().String(), dials: map[string]ziti.DialOptions{}, release: make(chan struct{})}
+	z := &zitiDialer{file: file, context: held}
+
+	dialed := make(chan error)
+	go func() {
+		conn, err := z.dial(zitiDial{service: "s", timeout: time.Second})
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+	for held.dialCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The identity is rotated while the dial is in progress: the replaced
+	// context stays open until the dial returned.
+	loaded := make(chan error)
+	go func() { loaded <- z.load() }()
+	time.Sleep(50 * time.Millisecond)
+	if held.wasClosed() {
+		t.Fatal("closed the replaced context while a dial held it")
+	}
+	close(held.release)
+	if err := <-dialed; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-loaded; err != nil {
+		t.Fatal(err)
+	}
+	if !held.wasClosed() {
+		t.Error("the replaced context was not closed after the dial returned")
+	}
+}
+
+func TestZitiOpenConnections(t *testing.T) {
+	open := testutil.ToFloat64(zitiOpenConnections)
+	var conns []*countedConn
+	for i := 0; i < 2; i++ {
+		c, peer := net.Pipe()
+		defer peer.Close()
+		conns = append(conns, newCountedConn(c))
+	}
+	if got := testutil.ToFloat64(zitiOpenConnections) - open; got != 2 {
+		t.Fatalf("gauge grew by %g after dialing 2 connections, want 2", got)
+	}
+	conns[0].Close()
+	// Closing a connection again, as http.Transport may, counts once.
+	conns[0].Close()
+	if got := testutil.ToFloat64(zitiOpenConnections) - open; got != 1 {
+		t.Errorf("gauge is %g above the start after closing 1 of 2 connections, want 1", got)
+	}
+	conns[1].Close()
+	if got := testutil.ToFloat64(zitiOpenConnections); got != open {
+		t.Errorf("gauge is %g after closing all connections, want %g", got, open)
+	}
+}
+
+// recordingZitiContext is a ziti context whose dials connect to addr,
+// recording the service and options they were dialed with.
+type recordingZitiContext struct {
+	ziti.Context
+	addr string
+	// release, if set, holds the dials until it is closed.
+	release chan struct{}
+
+	mu     sync.Mutex
+	dials  map[string]ziti.DialOptions
+	closed bool
+}
+
+func (c *recordingZitiContext) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+func (c *recordingZitiContext) dialCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.dials)
+}
+
+func (c *recordingZitiContext) wasClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// edgeConn serves a plain connection as a ziti one.
+type edgeConn struct {
+	net.Conn
+	edgeMethods
+}
+
+type edgeMethods struct{ edge.Conn }
+
+func (c *recordingZitiContext) DialWithOptions(service string, options *ziti.DialOptions) (edge.Conn, error) {
+	c.mu.Lock()
+	c.dials[service] = *options
+	c.mu.Unlock()
+	if c.release != nil {
+		<-c.release
+	}
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	return edgeConn{Conn: conn}, nil
+}
+
+func TestZitiWebhookDials(t *testing.T) {
+	hosts := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	}))
+	defer srv.Close()
+	setFlag(t, zitiService, "default-service")
+	setFlag(t, zitiTarget, "default-identity")
+	setFlag(t, zitiDialTimeout, 5*time.Second)
+	captureLog(t)
+	zc := &recordingZitiContext{addr: srv.Listener.Addr().String(), dials: map[string]ziti.DialOptions{}}
+	z := &zitiDialer{context: zc}
+	base, err := newWebhookTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := mustParseWebhook(t, "ziti://service-a/reload;identity=identity-a;appdata=from-a;dialtimeout=2s")
+	b := mustParseWebhook(t, "ziti://service-b/reload;identity=identity-b")
+	for _, h := range []*webhookTarget{a, b} {
+		h.client = z.webhookClient(base, h)
+		if err := testReloader(nil, h).fire(context.Background(), h, reloadEvent{id: newReloadID()}); err != nil {
+			t.Fatal(err)
+		}
+		if host := <-hosts; host != h.Host {
+			t.Errorf("sent Host %q, want the service %q", host, h.Host)
+		}
+	}
+	want := map[string]ziti.DialOptions{
+		"service-a": {Identity: "identity-a", AppData: []byte("from-a"), ConnectTimeout: 2 * time.Second},
+		"service-b": {Identity: "identity-b", ConnectTimeout: 5 * time.Second},
+	}
+	if len(zc.dials) != len(want) {
+		t.Fatalf("dialed %v, want service-a and service-b", zc.dials)
+	}
+	for service, w := range want {
+		got := zc.dials[service]
+		if got.Identity != w.Identity || !bytes.Equal(got.AppData, w.AppData) || got.ConnectTimeout != w.ConnectTimeout {
+			t.Errorf("dialed %s with identity %q, app data %q, timeout %s, want %q, %q, %s",
+				service, got.Identity, got.AppData, got.ConnectTimeout, w.Identity, w.AppData, w.ConnectTimeout)
+		}
+	}
+}
+
+func TestMixedZitiAndHTTPWebhooks(t *testing.T) {
+	serve := func(hosts chan<- string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	zitiHosts, plainHosts := make(chan string, 1), make(chan string, 1)
+	zitiSrv, plainSrv := serve(zitiHosts), serve(plainHosts)
+	setFlag(t, zitiService, "default-service")
+	setFlag(t, zitiTarget, "")
+	captureLog(t)
+	zc := &recordingZitiContext{addr: zitiSrv.Listener.Addr().String(), dials: map[string]ziti.DialOptions{}}
+	z := &zitiDialer{context: zc}
+	base, err := newWebhookTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A ziti:// webhook of the -config file, without a host.
+	cfg := WebhookConfig{URL: "ziti:///reload", Identity: "identity-a", AppData: "from-config", DialTimeout: "2s"}
+	zitiHook := mustParseWebhook(t, cfg.flagValue())
+	zitiHook.client = z.webhookClient(base, zitiHook)
+	plainHook := mustParseWebhook(t, plainSrv.URL+"/reload")
+	r := testReloader(base, zitiHook, plainHook)
+
+	if !r.reloadWebhooks(context.Background(), reloadEvent{id: newReloadID()}) {
+		t.Fatal("reload failed")
+	}
+	if host := <-zitiHosts; host != "default-service" {
+		t.Errorf("ziti webhook sent Host %q, want -ziti.service", host)
+	}
+	if host := <-plainHosts; host != plainSrv.Listener.Addr().String() {
+		t.Errorf("plain webhook sent Host %q, want %q", host, plainSrv.Listener.Addr())
+	}
+	if len(zc.dials) != 1 {
+		t.Fatalf("dialed %v over ziti, want default-service only", zc.dials)
+	}
+	got := zc.dials["default-service"]
+	if got.Identity != "identity-a" || string(got.AppData) != "from-config" || got.ConnectTimeout != 2*time.Second {
+		t.Errorf("dialed with identity %q, app data %q, timeout %s, want the webhook's options", got.Identity, got.AppData, got.ConnectTimeout)
+	}
+}
+
+func TestZitiDialTimeout(t *testing.T) {
+	if def := flag.Lookup("ziti.dial.timeout").DefValue; def != "5s" {
+		t.Errorf("ziti.dial.timeout defaults to %s, want 5s", def)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	setFlag(t, zitiService, "default-service")
+	setFlag(t, zitiDialTimeout, 3*time.Second)
+	captureLog(t)
+	zc := &recordingZitiContext{addr: srv.Listener.Addr().String(), dials: map[string]ziti.DialOptions{}}
+	conn, err := (&zitiDialer{context: zc}).DialContext(context.Background(), "tcp", "default-service:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := zc.dials["default-service"].ConnectTimeout; got != 3*time.Second {
+		t.Errorf("dialed with timeout %s, want the -ziti.dial.timeout 3s", got)
+	}
+
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		setFlag(t, zitiDialTimeout, timeout)
+		transport, err := newWebhookTransport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = setupZiti(transport, []*webhookTarget{mustParseWebhook(t, "http://a/reload")})
+		if err == nil || !strings.Contains(err.Error(), "must be positive") {
+			t.Errorf("ziti.dial.timeout %s: got error %v, want it rejected", timeout, err)
+		}
+	}
+}
+
+func TestSetupZiti(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		identity   bool
+		webhook    string
+		wantErr    bool
+		wantZiti   bool
+		wantDialer bool
+		wantLog    string
+	}{
+		{name: "no identity", webhook: "http://a/reload", wantLog: "using plain HTTP transport for webhooks"},
+		{name: "identity file", identity: true, webhook: "http://a/reload", wantZiti: true, wantLog: `using ziti transport for webhooks, dialing service "configmap-reload"`},
+		{name: "enabled", enabled: true, identity: true, webhook: "http://a/reload", wantZiti: true, wantLog: "using ziti transport"},
+		{name: "enabled without identity", enabled: true, webhook: "http://a/reload", wantErr: true},
+		{name: "ziti webhook", identity: true, webhook: "ziti://service/reload", wantDialer: true, wantLog: "using ziti transport for ziti:// webhooks and plain HTTP transport for the others"},
+		{name: "ziti webhook without identity", webhook: "ziti://service/reload", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "identity.json")
+			if tt.identity {
+				writeZitiIdentity(t, file, "https://127.0.0.1:1")
+			}
+			setFlag(t, zitiIdentityFile, file)
+			setFlag(t, zitiEnabled, tt.enabled)
+			setFlag(t, zitiService, "configmap-reload")
+			logs := captureLog(t)
+			transport, err := newWebhookTransport()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, dialer, err := setupZiti(transport, []*webhookTarget{mustParseWebhook(t, tt.webhook)})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("setupZiti succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ziti := client.Transport != transport; ziti != tt.wantZiti {
+				t.Errorf("client uses the ziti transport: %v, want %v", ziti, tt.wantZiti)
+			}
+			if (dialer != nil) != tt.wantDialer {
+				t.Errorf("returned dialer %v, want one: %v", dialer, tt.wantDialer)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("logged %q, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}